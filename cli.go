@@ -0,0 +1,159 @@
+/*
+ * Command line interface:
+ * Parses subcommands and their flags
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
+	quantifierPkg "thomas-leister.de/plantmonitor/quantifier"
+)
+
+const usageText = `Usage: plantmonitor [command] [flags]
+
+Commands:
+  run            Run plantmonitor (default if no command is given)
+  check-config   Parse and validate config and language file, print level table
+  replay         Replay recorded sensor readings offline and print resulting messages
+  version        Print version
+  help           Show this help
+
+Run "plantmonitor <command> -h" for the flags of a command.
+`
+
+func main() {
+	command := "run"
+	args := os.Args[1:]
+
+	// First argument is the command, unless it is a flag (backwards compatibility: "plantmonitor" == "plantmonitor run")
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		command = args[0]
+		args = args[1:]
+	}
+
+	switch command {
+	case "run":
+		configFilePath, langDirPath := parseConfigFlags("run", args)
+		runPlantmonitor(configFilePath, langDirPath)
+	case "check-config":
+		configFilePath, langDirPath := parseConfigFlags("check-config", args)
+		os.Exit(checkConfig(configFilePath, langDirPath))
+	case "replay":
+		os.Exit(parseReplayFlags(args))
+	case "version":
+		fmt.Println(versionString)
+	case "help":
+		fmt.Print(usageText)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command \"%s\"\n\n%s", command, usageText)
+		os.Exit(2)
+	}
+}
+
+/*
+ * Parses flags which are common to all commands reading the config:
+ *   --config    Path to config file
+ *   --lang-dir  Directory containing lang_<lang_code>.yaml files
+ */
+func parseConfigFlags(command string, args []string) (string, string) {
+	flagSet := flag.NewFlagSet(command, flag.ExitOnError)
+	configFilePath, langDirPath := addConfigFlags(flagSet)
+
+	// ExitOnError: Parse() exits on invalid flags
+	_ = flagSet.Parse(args)
+
+	return *configFilePath, *langDirPath
+}
+
+func addConfigFlags(flagSet *flag.FlagSet) (*string, *string) {
+	configFilePath := flagSet.String("config", "config.yaml", "path to config file")
+	langDirPath := flagSet.String("lang-dir", ".", "directory containing lang_<lang_code>.yaml files")
+
+	return configFilePath, langDirPath
+}
+
+/*
+ * Parses flags of the replay command and runs the replay.
+ * Returns exit code.
+ */
+func parseReplayFlags(args []string) int {
+	flagSet := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFilePath, langDirPath := addConfigFlags(flagSet)
+	inputPath := flagSet.String("input", "", "CSV (<time>,<moisture_raw>) or JSON lines file with recorded readings (required)")
+	outputPath := flagSet.String("output", "", "write messages to this file instead of stdout")
+	runOn := flagSet.Duration("run-on", 0, "keep simulating for this duration after the last reading, e.g. 12h")
+	verbose := flagSet.Bool("verbose", false, "print log output")
+
+	// ExitOnError: Parse() exits on invalid flags
+	_ = flagSet.Parse(args)
+
+	if *inputPath == "" {
+		fmt.Fprintln(os.Stderr, "Missing --input file")
+		flagSet.Usage()
+		return 2
+	}
+
+	return replayReadings(*configFilePath, *langDirPath, *inputPath, *outputPath, *runOn, *verbose)
+}
+
+/*
+ * Reads and validates config and language files, lints every language file
+ * and prints the level table.
+ * Returns exit code: 0 if config is valid, 1 otherwise. Lint findings are warnings only.
+ */
+func checkConfig(configFilePath string, langDirPath string) int {
+	config, err := configManagerPkg.ReadConfig(configFilePath, langDirPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config %s is invalid: %s\n", configFilePath, err)
+		return 1
+	}
+
+	var langFiles []string
+	for _, langCode := range configManagerPkg.LangCodes(config.Catalog) {
+		langFiles = append(langFiles, "lang_"+langCode+".yaml")
+	}
+
+	fmt.Printf("Config %s and language files %s are valid (default language: %s).\n\n", configFilePath, strings.Join(langFiles, ", "), config.LangCode)
+
+	for _, langCode := range configManagerPkg.LangCodes(config.Catalog) {
+		report, err := configManagerPkg.LintLangFile(&config, langDirPath, langCode)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not lint lang_%s.yaml: %s\n", langCode, err)
+			return 1
+		}
+		printLintReport(report, langCode == config.LangCode)
+	}
+
+	fmt.Printf("\nLevels:\n\n")
+	quantifierPkg.PrintLevelTable(os.Stdout, quantifierPkg.LevelsFromConfig(&config))
+
+	return 0
+}
+
+func printLintReport(report *configManagerPkg.LintReport, isDefault bool) {
+	if report.Ok() {
+		fmt.Printf("lang_%s.yaml: OK\n", report.LangCode)
+		return
+	}
+
+	fmt.Printf("lang_%s.yaml:\n", report.LangCode)
+	for _, key := range report.Missing {
+		if isDefault {
+			fmt.Printf("  missing key: %s\n", key)
+		} else {
+			fmt.Printf("  missing key: %s (taken from default language)\n", key)
+		}
+	}
+	for _, key := range report.Extra {
+		fmt.Printf("  extra key:   %s\n", key)
+	}
+	for _, invalid := range report.Invalid {
+		fmt.Printf("  invalid template: %s\n", invalid)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Clock:
+ * Abstraction of time.Now() and time.AfterFunc(), so the application
+ * can either run in real time or be driven by a virtual clock (replay mode).
+ */
+
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+/*
+ * Real clock: Uses the system time
+ */
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+/*
+ * Virtual clock: Time only moves if AdvanceTo() is called.
+ * Timer functions are run synchronously in the goroutine calling AdvanceTo().
+ */
+type Virtual struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+type virtualTimer struct {
+	clock    *Virtual
+	deadline time.Time
+	f        func()
+	active   bool
+}
+
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+func (c *Virtual) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *Virtual) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	timer := &virtualTimer{clock: c, deadline: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, timer)
+
+	return timer
+}
+
+/*
+ * Returns the deadline of the next active timer (if any)
+ */
+func (c *Virtual) NextDeadline() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	next := c.nextTimer()
+	if next == nil {
+		return time.Time{}, false
+	}
+	return next.deadline, true
+}
+
+/*
+ * Moves the clock forward to t and runs all timers which are due until then,
+ * in order of their deadlines. While a timer function runs, Now() returns its deadline.
+ */
+func (c *Virtual) AdvanceTo(t time.Time) {
+	for {
+		c.mutex.Lock()
+		next := c.nextTimer()
+		if next == nil || next.deadline.After(t) {
+			break
+		}
+
+		// Fire timer
+		next.active = false
+		c.removeInactiveTimers()
+		if next.deadline.After(c.now) {
+			c.now = next.deadline
+		}
+		c.mutex.Unlock()
+
+		next.f()
+	}
+
+	if t.After(c.now) {
+		c.now = t
+	}
+	c.mutex.Unlock()
+}
+
+// Needs to be called with mutex held
+func (c *Virtual) nextTimer() *virtualTimer {
+	c.removeInactiveTimers()
+	if len(c.timers) == 0 {
+		return nil
+	}
+
+	// Stable sort: Timers with the same deadline fire in order of creation
+	sort.SliceStable(c.timers, func(a, b int) bool {
+		return c.timers[a].deadline.Before(c.timers[b].deadline)
+	})
+	return c.timers[0]
+}
+
+// Needs to be called with mutex held
+func (c *Virtual) removeInactiveTimers() {
+	activeTimers := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.active {
+			activeTimers = append(activeTimers, timer)
+		}
+	}
+	c.timers = activeTimers
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	wasActive := t.active
+	t.active = false
+	t.clock.removeInactiveTimers()
+	return wasActive
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	wasActive := t.active
+	t.deadline = t.clock.now.Add(d)
+	if !wasActive {
+		t.active = true
+		t.clock.timers = append(t.clock.timers, t)
+	}
+	return wasActive
+}
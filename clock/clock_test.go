@@ -0,0 +1,53 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ * Timers of the virtual clock fire in order of their deadlines
+ * and see their deadline as current time.
+ */
+func TestVirtualAdvanceTo(t *testing.T) {
+	start := time.Date(2021, time.November, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewVirtual(start)
+
+	var fired []time.Duration
+	record := func() {
+		fired = append(fired, clock.Now().Sub(start))
+	}
+
+	clock.AfterFunc(10*time.Minute, record)
+	clock.AfterFunc(5*time.Minute, record)
+	stopped := clock.AfterFunc(7*time.Minute, record)
+	stopped.Stop()
+
+	// Timer which re-arms itself
+	var ticker Timer
+	ticker = clock.AfterFunc(4*time.Minute, func() {
+		record()
+		ticker.Reset(4 * time.Minute)
+	})
+
+	clock.AdvanceTo(start.Add(12 * time.Minute))
+
+	expected := []time.Duration{4 * time.Minute, 5 * time.Minute, 8 * time.Minute, 10 * time.Minute, 12 * time.Minute}
+	if len(fired) != len(expected) {
+		t.Fatalf("Expected %d timers to fire. Got %d: %v", len(expected), len(fired), fired)
+	}
+	for i := range expected {
+		if fired[i] != expected[i] {
+			t.Errorf("Expected timer %d to fire after %s. Got %s", i, expected[i], fired[i])
+		}
+	}
+
+	if now := clock.Now(); !now.Equal(start.Add(12 * time.Minute)) {
+		t.Errorf("Expected clock to be at %s. Got %s", start.Add(12*time.Minute), now)
+	}
+
+	deadline, ok := clock.NextDeadline()
+	if !ok || !deadline.Equal(start.Add(16*time.Minute)) {
+		t.Errorf("Expected next deadline at %s. Got %s", start.Add(16*time.Minute), deadline)
+	}
+}
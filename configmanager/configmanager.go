@@ -6,8 +6,12 @@
 package configmanager
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -17,27 +21,241 @@ type MessageType struct {
 	GifKeywords string   `yaml:"gif_keywords,omitempty"`
 }
 
+type CommandMessages struct {
+	Triggers    []string `yaml:"triggers"`    // Phrases which trigger the command
+	Usage       string   `yaml:"usage"`       // Arguments shown in help, e.g. "<duration>"
+	Description string   `yaml:"description"` // Description shown in help
+}
+
+type EventTypeMessages struct {
+	Name     string   `yaml:"name"`     // Name shown to users
+	Triggers []string `yaml:"triggers"` // Words which select the event type in chat commands, e.g. "unsubscribe reminders"
+}
+
 type Messages struct {
-	Online  []string               `yaml:"online"`
-	Levels  map[string]MessageType `yaml:"levels"`
+	LanguageName string `yaml:"language_name"` // Name of the language, shown to users who choose a language
+
+	Online     []string                     `yaml:"online"`  // Sent after startup
+	Offline    []string                     `yaml:"offline"` // Sent on shutdown
+	Levels     map[string]MessageType       `yaml:"levels"`
+	LevelNames map[string]string            `yaml:"level_names"` // Names of the levels shown to users. Default: name from config.yaml
+	Commands   map[string]CommandMessages   `yaml:"commands"`
+	EventTypes map[string]EventTypeMessages `yaml:"event_types"`
+	Keywords   struct {
+		On      []string `yaml:"on"`
+		Off     []string `yaml:"off"`
+		Default []string `yaml:"default"`
+		All     []string `yaml:"all"`
+	} `yaml:"keywords"` // Localized arguments of chat commands
 	Answers struct {
 		CurrentState          string `yaml:"current_state"`
 		UnknownCommand        string `yaml:"unknown_command"`
 		AvailableCommands     string `yaml:"available_commands"`
 		SensorDataUnavailable string `yaml:"sensor_data_unavailable"`
+
+		ReminderAcknowledged          string `yaml:"reminder_acknowledged"`
+		ReminderAcknowledgedBroadcast string `yaml:"reminder_acknowledged_broadcast"`
+		ReminderSnoozed               string `yaml:"reminder_snoozed"`
+		ReminderUnsnoozed             string `yaml:"reminder_unsnoozed"`
+		NoActiveReminder              string `yaml:"no_active_reminder"`
+		InvalidDuration               string `yaml:"invalid_duration"`
+
+		Preferences         string `yaml:"preferences"`
+		PreferencesSaved    string `yaml:"preferences_saved"`
+		PreferencesNotSaved string `yaml:"preferences_not_saved"`
+		UnknownEventType    string `yaml:"unknown_event_type"`
+		InvalidGifsArgument string `yaml:"invalid_gifs_argument"`
+		InvalidQuietHours   string `yaml:"invalid_quiet_hours"`
+		InvalidPlants       string `yaml:"invalid_plants"`
+		Languages           string `yaml:"languages"`
+		UnknownLanguage     string `yaml:"unknown_language"`
 	} `yaml:"answers"`
+	Summaries struct {
+		QuietHours string `yaml:"quiet_hours"`
+	} `yaml:"summaries"`
+	Formats struct {
+		MoistureSuffix        string `yaml:"moisture_suffix"`         // Appended to level messages and reminders
+		PresenceStatus        string `yaml:"presence_status"`         // XMPP status while the sensor sends values
+		PresenceSensorOffline string `yaml:"presence_sensor_offline"` // XMPP status after the watchdog has fired
+	} `yaml:"formats"`
+	Durations struct {
+		Day     string `yaml:"day"`
+		Days    string `yaml:"days"`
+		Hour    string `yaml:"hour"`
+		Hours   string `yaml:"hours"`
+		Minute  string `yaml:"minute"`
+		Minutes string `yaml:"minutes"`
+		And     string `yaml:"and"`  // Joins units, e.g. "2 days and 3 hours"
+		Ago     string `yaml:"ago"`  // Time in the past, e.g. "{{.}} ago"
+		In      string `yaml:"in"`   // Time in the future, e.g. "in {{.}}"
+		Now     string `yaml:"now"`  // Less than a minute ago
+		Soon    string `yaml:"soon"` // Less than a minute from now
+	} `yaml:"durations"` // Used by the template functions duration, ago and in
 	Warnings struct {
-		SensorOffline string `yaml:"sensor_offline"`
+		SensorOffline       string `yaml:"sensor_offline"`
+		SensorOnline        string `yaml:"sensor_online"`
+		FrameCounterGap     string `yaml:"frame_counter_gap"`
+		SensorStuck         string `yaml:"sensor_stuck"`
+		SensorPinnedDry     string `yaml:"sensor_pinned_dry"`
+		SensorPinnedWet     string `yaml:"sensor_pinned_wet"`
+		VarianceCollapse    string `yaml:"variance_collapse"`
+		ValueUnquantifiable string `yaml:"value_unquantifiable"`
 	} `yaml:"warnings"`
 }
 
+// Returns the name of a level shown to users, e.g. "trocken" for "low"
+func (m *Messages) LevelName(level string) string {
+	if name := m.LevelNames[level]; name != "" {
+		return name
+	}
+	return level
+}
+
+/*
+ * Daily quiet hours, e.g. from 22:00 to 07:00
+ */
+type QuietHours struct {
+	Start          string `yaml:"start"`           // Start time, "HH:MM"
+	End            string `yaml:"end"`             // End time, "HH:MM"
+	Timezone       string `yaml:"timezone"`        // IANA time zone, e.g. "Europe/Berlin". Default: local time zone
+	WatchdogBypass bool   `yaml:"watchdog_bypass"` // Deliver sensor offline warnings during quiet hours
+}
+
+func (q *QuietHours) Enabled() bool {
+	return q.Start != "" || q.End != ""
+}
+
+// Types of events recipients can subscribe to
+const (
+	EventLevelChange = "level_change"
+	EventReminder    = "reminder"
+	EventWatchdog    = "watchdog"
+)
+
+var EventTypes = []string{EventLevelChange, EventReminder, EventWatchdog}
+
+/*
+ * Settings for a single recipient.
+ * Recipients can change them via chat. Those changes override these settings.
+ */
+type RecipientSettings struct {
+	QuietHours QuietHours `yaml:"quiet_hours"` // Overrides global quiet hours
+	Events     []string   `yaml:"events"`      // Subscribed event types. Default: all
+	Plants     []string   `yaml:"plants"`      // Plants (plant_name) the recipient is notified about. Default: all
+	Gifs       *bool      `yaml:"gifs"`        // Whether GIFs are sent. Default: true
+	Language   string     `yaml:"language"`    // Language code, e.g. "en". Default: lang_code
+}
+
+/*
+ * Multi-user chat room (XEP-0045). Rooms receive notifications like recipients.
+ */
+type MucRoom struct {
+	Jid            string   `yaml:"jid"`             // Bare JID of the room, e.g. "plants@conference.my.xmpp.host"
+	Nickname       string   `yaml:"nickname"`        // Nickname of plantmonitor in the room
+	Password       string   `yaml:"password"`        // Optional: Room password
+	AllowedSenders []string `yaml:"allowed_senders"` // Occupants (real JIDs or nicknames) whose commands are answered. Empty = none
+}
+
+/*
+ * Escalation tier for reminders: Reminders are sent to the recipients of a tier
+ * once a number of reminders was sent or some time has passed without acknowledgement.
+ */
+type EscalationTier struct {
+	Recipients     []string `yaml:"recipients"`
+	AfterReminders int      `yaml:"after_reminders"` // Number of unanswered reminders before this tier is reminded as well. Reminders held back for quiet hours do not count.
+	After          int      `yaml:"after"`           // Seconds since the level was reached before this tier is reminded as well
+}
+
+// GIF providers
+const (
+	GifProviderGiphy = "giphy" // Giphy API, needs giphy.api_key
+	GifProviderTenor = "tenor" // Tenor API, needs gifs.tenor.api_key
+	GifProviderLocal = "local" // GIFs from gifs.local (URL lists and / or a served directory)
+	GifProviderNone  = "none"  // No GIFs at all
+)
+
+// GIF content ratings
+const (
+	GifRatingG  = "g"  // Suitable for all ages
+	GifRatingPG = "pg" // Parental guidance suggested
+)
+
+// XMPP presence of plantmonitor on a level
+const (
+	PresenceAvailable = "available"
+	PresenceAway      = "away"
+	PresenceDnd       = "dnd"
+)
+
+// Types of reminder schedules
+const (
+	ReminderScheduleInterval    = "interval"    // Every notification_interval seconds (default)
+	ReminderScheduleExponential = "exponential" // First after notification_interval seconds, then with growing intervals
+	ReminderScheduleOffsets     = "offsets"     // At fixed offsets since the level was reached
+	ReminderScheduleTimes       = "times"       // At fixed times of day
+)
+
+/*
+ * Schedule of reminders for a level
+ */
+type ReminderSchedule struct {
+	Type        string   `yaml:"type"`         // One of the ReminderSchedule* types. Default: interval
+	Factor      float64  `yaml:"factor"`       // exponential: Interval is multiplied by factor after every reminder (default: 2)
+	MaxInterval int      `yaml:"max_interval"` // exponential: Max. seconds between two reminders (0 = no limit)
+	Offsets     []int    `yaml:"offsets"`      // offsets: Seconds since the level was reached, ascending
+	Times       []string `yaml:"times"`        // times: Times of day ("HH:MM")
+	Timezone    string   `yaml:"timezone"`     // times: IANA time zone. Default: local time zone
+	MaxCount    int      `yaml:"max_count"`    // Max. number of reminders until the level changes (0 = no limit)
+}
+
+type Level struct {
+	Start                int              `yaml:"start"`
+	End                  int              `yaml:"end"`
+	Name                 string           `yaml:"name"`
+	NotificationInterval int              `yaml:"notification_interval"`
+	ReminderSchedule     ReminderSchedule `yaml:"reminder_schedule"`
+	MinDwellReadings     int              `yaml:"min_dwell_readings"`
+	MinDwellTime         int              `yaml:"min_dwell_time"`
+	Escalation           []EscalationTier `yaml:"escalation"`
+	Presence             string           `yaml:"presence"` // XMPP presence while on this level (one of the Presence* values). Default: away if reminders are sent, otherwise available
+}
+
+/*
+ * Whether reminders are sent for this level
+ */
+func (l *Level) RemindersEnabled() bool {
+	switch l.ReminderSchedule.Type {
+	case ReminderScheduleOffsets:
+		return len(l.ReminderSchedule.Offsets) > 0
+	case ReminderScheduleTimes:
+		return len(l.ReminderSchedule.Times) > 0
+	default:
+		return l.NotificationInterval != 0
+	}
+}
+
 type Config struct {
+	PlantName string `yaml:"plant_name"` // Name of the plant, available in message templates
+
 	Xmpp struct {
 		Host       string   `yaml:"host"`
 		Port       int      `yaml:"port"`
 		Username   string   `yaml:"username"`
 		Password   string   `yaml:"password"`
 		Recipients []string `yaml:"recipients"`
+		Admins     []string `yaml:"admins"` // Receive technical warnings. Defaults to recipients.
+
+		GreetOnReconnect bool `yaml:"greet_on_reconnect"` // Send an online message after reconnecting, too
+
+		HttpUpload struct {
+			Enabled bool   `yaml:"enabled"`  // Upload GIFs to the XMPP server (XEP-0363) instead of linking them
+			Service string `yaml:"service"`  // JID of the upload service. Discovered if empty.
+			MaxSize int64  `yaml:"max_size"` // Max. size of uploaded files (bytes). Default: 10 MiB
+		} `yaml:"http_upload"`
+
+		Rooms []MucRoom `yaml:"rooms"` // Group chats to join
+
+		RecipientSettings map[string]RecipientSettings `yaml:"recipient_settings"` // Settings per recipient JID
 	} `yaml:"xmpp"`
 
 	Mqtt struct {
@@ -50,35 +268,80 @@ type Config struct {
 	} `yaml:"mqtt"`
 
 	Watchdog struct {
-		Timeout int `yaml:"timeout"`
+		Timeout         int  `yaml:"timeout"`           // Seconds without reading until users are warned. Fallback in adaptive mode.
+		RepeatInterval  int  `yaml:"repeat_interval"`   // Repeat warning while sensor is offline (seconds). 0 = warn once.
+		Adaptive        bool `yaml:"adaptive"`          // Learn the typical interval between uplinks and derive the timeout from it
+		MissedUplinks   int  `yaml:"missed_uplinks"`    // Adaptive mode: Warn after this many missed uplinks. Default: 3
+		FrameGapWarning int  `yaml:"frame_gap_warning"` // Warn admins if at least this many uplinks are missing according to f_cnt. 0 = off
+
+		DataQuality struct {
+			StuckTime      int     `yaml:"stuck_time"`      // Warn if the raw value has not changed for this many seconds. 0 = off
+			PinnedReadings int     `yaml:"pinned_readings"` // Warn after this many consecutive raw values at or beyond raw_lower_bound / raw_upper_bound. 0 = off
+			VarianceWindow int     `yaml:"variance_window"` // Number of recent raw values for the variance check. 0 = off
+			MinStdDev      float64 `yaml:"min_std_dev"`     // Warn if the standard deviation of these raw values is lower
+		} `yaml:"data_quality"` // Checks for sensors which send values, but no meaningful ones
 	} `yaml:"watchdog"`
 
 	Giphy struct {
 		ApiKey string `yaml:"api_key"`
 	}
 
+	Gifs struct {
+		Provider string `yaml:"provider"`  // One of the GifProvider* names. Default: giphy
+		Rating   string `yaml:"rating"`    // Content rating (g or pg). Default: g
+		Timeout  int    `yaml:"timeout"`   // Timeout of API requests (seconds). Default: 5
+		CacheTTL int    `yaml:"cache_ttl"` // Prefetched GIFs are used for this many seconds. Default: 1 day
+		PoolSize int    `yaml:"pool_size"` // Number of prefetched GIFs per keyword set. Default: 3
+		Tenor    struct {
+			ApiKey    string `yaml:"api_key"`
+			ClientKey string `yaml:"client_key"` // Optional: Name of this application towards Tenor
+		} `yaml:"tenor"`
+		Local struct {
+			Dir     string              `yaml:"dir"`      // Directory with one subdirectory per keyword set, e.g. "dying_death"
+			BaseUrl string              `yaml:"base_url"` // URL under which dir is served by a web server
+			Urls    map[string][]string `yaml:"urls"`     // GIF URLs by keyword set, e.g. "dying death"
+		} `yaml:"local"`
+	} `yaml:"gifs"`
+
 	Sensor struct {
 		Adc struct {
 			RawLowerBound  int `yaml:"raw_lower_bound"`
 			RawUpperBound  int `yaml:"raw_upper_bound"`
 			RawNoiseMargin int `yaml:"raw_noise_margin"`
 		} `yaml:"adc"`
-		MvgAvgLen int `yaml:"mvg_avg_len"`
+		MvgAvgLen         int `yaml:"mvg_avg_len"`
+		WateringThreshold int `yaml:"watering_threshold"` // Rise of moisture (%) which is detected as watering. Default: 10
 	} `yaml:"sensor"`
 
-	Levels []struct {
-		Start                int    `yaml:"start"`
-		End                  int    `yaml:"end"`
-		Name                 string `yaml:"name"`
-		NotificationInterval int    `yaml:"notification_interval"`
-	} `yaml:"levels"`
+	Levels []Level `yaml:"levels"`
+
+	QuietHours QuietHours `yaml:"quiet_hours"`
 
-	LangCode string `yaml:"lang_code"`
+	StateFile       string `yaml:"state_file"`       // JSON file for sensor history and level across restarts. Empty = not persisted.
+	PreferencesFile string `yaml:"preferences_file"` // JSON file for preferences changed via chat. Empty = changes are lost on restart.
 
-	Messages Messages // Not part of config.yaml, but language config will be put here.
+	LangCode string `yaml:"lang_code"` // Default language
+
+	Messages Messages             // Not part of config.yaml: Messages of the default language
+	Catalog  map[string]*Messages // Not part of config.yaml: Messages of all languages by language code
 }
 
-func ReadConfig(configFilePath string) (Config, error) {
+/*
+ * Returns the JIDs of all configured rooms
+ */
+func (c *Config) RoomJids() []string {
+	var roomJids []string
+	for _, room := range c.Xmpp.Rooms {
+		roomJids = append(roomJids, room.Jid)
+	}
+	return roomJids
+}
+
+/*
+ * Reads config file at configFilePath and all language files
+ * lang_<code>.yaml from directory langDirPath
+ */
+func ReadConfig(configFilePath string, langDirPath string) (Config, error) {
 	config := Config{}
 
 	log.Println("Initializing configmanager ...")
@@ -99,20 +362,68 @@ func ReadConfig(configFilePath string) (Config, error) {
 	}
 
 	/*
-	 * Parse language config file lang_<lang>.yaml
+	 * Parse language files lang_<lang>.yaml
 	 */
-
-	langFile, err := os.Open("lang_" + config.LangCode + ".yaml")
+	config.Catalog, err = ReadCatalog(langDirPath, config.LangCode)
 	if err != nil {
 		return config, err
 	}
-	defer langFile.Close()
+	config.Messages = *config.Catalog[config.LangCode]
 
-	// Decode language file
-	langFileDecoder := yaml.NewDecoder(langFile)
-	if err := langFileDecoder.Decode(&config.Messages); err != nil {
+	/*
+	 * Validate levels and messages, so problems are found now and not at runtime
+	 */
+	if err := ValidateConfig(&config); err != nil {
 		return config, err
 	}
 
-	return config, err
+	return config, nil
+}
+
+/*
+ * Reads all language files lang_<code>.yaml from directory langDirPath.
+ * Messages which are missing in a language file are taken from the default language.
+ * Returns messages by language code.
+ */
+func ReadCatalog(langDirPath string, defaultLangCode string) (map[string]*Messages, error) {
+	catalog := make(map[string]*Messages)
+
+	defaultLangFile, err := ioutil.ReadFile(LangFilePath(langDirPath, defaultLangCode))
+	if err != nil {
+		return nil, err
+	}
+
+	langFilePaths, err := filepath.Glob(LangFilePath(langDirPath, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, langFilePath := range langFilePaths {
+		langCode := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(langFilePath), "lang_"), ".yaml")
+		messages := &Messages{}
+
+		// Default language first, so the language file only overrides messages it contains
+		if err := yaml.Unmarshal(defaultLangFile, messages); err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Base(LangFilePath(langDirPath, defaultLangCode)), err)
+		}
+
+		if langCode != defaultLangCode {
+			langFile, err := ioutil.ReadFile(langFilePath)
+			if err != nil {
+				return nil, err
+			}
+			if err := yaml.Unmarshal(langFile, messages); err != nil {
+				return nil, fmt.Errorf("%s: %s", filepath.Base(langFilePath), err)
+			}
+		}
+
+		catalog[langCode] = messages
+	}
+
+	return catalog, nil
+}
+
+// Returns the path of the language file for a language code
+func LangFilePath(langDirPath string, langCode string) string {
+	return filepath.Join(langDirPath, "lang_"+langCode+".yaml")
 }
@@ -0,0 +1,264 @@
+package configmanager
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	_ "thomas-leister.de/plantmonitor/testing_init"
+)
+
+/*
+ * The example config and the shipped language file must always be valid
+ */
+func TestValidateExampleConfig(t *testing.T) {
+	config, err := ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		t.Fatalf("Example config is invalid: %s", err)
+	}
+
+	if err := ValidateConfig(&config); err != nil {
+		t.Errorf("Expected example config to be valid. Got: %s", err)
+	}
+}
+
+/*
+ * All problems of a broken level configuration are reported at once
+ */
+func TestValidateBrokenLevels(t *testing.T) {
+	config, err := ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		t.Fatalf("Example config is invalid: %s", err)
+	}
+
+	config.Levels = []Level{
+		{Name: "low", Start: 0, End: 30, NotificationInterval: 30},    // OK
+		{Name: "normal", Start: 32, End: 70},                          // Gap 31..31, overlaps with "high"
+		{Name: "high", Start: 67, End: 101, NotificationInterval: 30}, // End out of range
+		{Name: "high", Start: 90, End: 80},                            // Duplicate name, start > end
+		{Name: "soaked", Start: 100, End: 100},                        // No messages in language file
+	}
+
+	err = ValidateConfig(&config)
+	if err == nil {
+		t.Fatal("Expected validation to fail")
+	}
+
+	validationError, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected *ValidationError. Got %T", err)
+	}
+
+	expectedProblems := []string{
+		"level name 'high' is used more than once",
+		"level 'high': end 101 is outside 0..100",
+		"level 'high': start 90 is greater than end 80",
+		"gap: values 31..31 between levels 'low' and 'normal' are not covered by any level",
+		"overlap: levels 'normal' (32..70) and 'high' (67..101) overlap",
+		"language file lang_de.yaml: message type 'soaked_steady' is missing",
+	}
+
+	for _, expectedProblem := range expectedProblems {
+		found := false
+		for _, problem := range validationError.Problems {
+			if problem == expectedProblem {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Expected problem \"%s\" to be reported. Got:\n%s", expectedProblem, err)
+		}
+	}
+}
+
+/*
+ * A level spanning several others overlaps with all of them and does not leave gaps between them
+ */
+func TestValidateNestedLevels(t *testing.T) {
+	config, err := ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		t.Fatalf("Example config is invalid: %s", err)
+	}
+
+	config.Levels = []Level{
+		{Name: "low", Start: 0, End: 100},
+		{Name: "normal", Start: 10, End: 20},
+		{Name: "high", Start: 30, End: 40},
+	}
+
+	validationError, ok := ValidateConfig(&config).(*ValidationError)
+	if !ok {
+		t.Fatal("Expected *ValidationError")
+	}
+
+	expectedProblems := []string{
+		"overlap: levels 'low' (0..100) and 'normal' (10..20) overlap",
+		"overlap: levels 'low' (0..100) and 'high' (30..40) overlap",
+	}
+	if len(validationError.Problems) != len(expectedProblems) {
+		t.Fatalf("Expected %d problems. Got:\n%s", len(expectedProblems), validationError)
+	}
+	for i, expectedProblem := range expectedProblems {
+		if validationError.Problems[i] != expectedProblem {
+			t.Errorf("Expected problem \"%s\". Got \"%s\"", expectedProblem, validationError.Problems[i])
+		}
+	}
+}
+
+/*
+ * Messages missing in a language file are taken from the default language
+ */
+func TestReadCatalogFallback(t *testing.T) {
+	langDirPath := t.TempDir()
+
+	files := map[string]string{
+		"lang_de.yaml": "answers:\n  unknown_command: \"Unbekannt\"\n  current_state: \"Bodenfeuchte\"\n",
+		"lang_en.yaml": "answers:\n  unknown_command: \"Unknown\"\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(langDirPath, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	catalog, err := ReadCatalog(langDirPath, "de")
+	if err != nil {
+		t.Fatalf("Could not read catalog: %s", err)
+	}
+
+	if codes := LangCodes(catalog); len(codes) != 2 || codes[0] != "de" || codes[1] != "en" {
+		t.Fatalf("Expected languages [de en]. Got %v", codes)
+	}
+	if answer := catalog["en"].Answers.UnknownCommand; answer != "Unknown" {
+		t.Errorf("Expected English answer. Got \"%s\"", answer)
+	}
+	if answer := catalog["en"].Answers.CurrentState; answer != "Bodenfeuchte" {
+		t.Errorf("Expected fallback to German answer. Got \"%s\"", answer)
+	}
+	if answer := catalog["de"].Answers.UnknownCommand; answer != "Unbekannt" {
+		t.Errorf("Expected German answer. Got \"%s\"", answer)
+	}
+}
+
+/*
+ * The shipped language files define exactly the messages the example config needs
+ */
+func TestLintShippedLangFiles(t *testing.T) {
+	config, err := ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		t.Fatalf("Example config is invalid: %s", err)
+	}
+
+	for _, langCode := range LangCodes(config.Catalog) {
+		report, err := LintLangFile(&config, ".", langCode)
+		if err != nil {
+			t.Fatalf("Could not lint lang_%s.yaml: %s", langCode, err)
+		}
+		if !report.Ok() {
+			t.Errorf("lang_%s.yaml: Expected no findings. Got %+v", langCode, report)
+		}
+	}
+}
+
+/*
+ * Missing and extra keys and broken templates are reported
+ */
+func TestLintLangFile(t *testing.T) {
+	config, err := ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		t.Fatalf("Example config is invalid: %s", err)
+	}
+
+	langDirPath := t.TempDir()
+	langFile := "levels:\n" +
+		"  low_steady:\n    messages: [\"Dry!\"]\n" +
+		"  low_up:\n    messages: [\"Not needed\"]\n" +
+		"level_names:\n  low: \"dry\"\n  soggy: \"soggy\"\n" +
+		"answers:\n" +
+		"  current_state: \"{{.SensorValue\"\n" +
+		"  unknown_answer: \"?\"\n" +
+		"smileys: []\n"
+	if err := ioutil.WriteFile(filepath.Join(langDirPath, "lang_xx.yaml"), []byte(langFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := LintLangFile(&config, langDirPath, "xx")
+	if err != nil {
+		t.Fatalf("Could not lint language file: %s", err)
+	}
+
+	expected := map[string][]string{
+		"missing": {"levels.low_down", "levels.high_reminder", "answers.unknown_command", "warnings.sensor_offline", "event_types.reminder"},
+		"extra":   {"levels.low_up", "level_names.soggy", "answers.unknown_answer", "smileys"},
+		"invalid": {"answers.current_state"},
+	}
+	found := map[string][]string{"missing": report.Missing, "extra": report.Extra, "invalid": report.Invalid}
+
+	for kind, keys := range expected {
+		for _, key := range keys {
+			reported := false
+			for _, foundKey := range found[kind] {
+				if strings.HasPrefix(foundKey, key) {
+					reported = true
+					break
+				}
+			}
+			if !reported {
+				t.Errorf("Expected %s key %s to be reported. Got %v", kind, key, found[kind])
+			}
+		}
+	}
+}
+
+/*
+ * Durations and relative times are formatted in the language of the messages
+ */
+func TestTemplateFuncs(t *testing.T) {
+	config, err := ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		t.Fatalf("Example config is invalid: %s", err)
+	}
+	now := time.Date(2021, time.November, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		langCode string
+		template string
+		expected string
+	}{
+		{"en", "{{duration .}}", "2 days and 3 hours"},
+		{"en", "{{in .}}", "in 2 days and 3 hours"},
+		{"de", "{{in .}}", "in 2 Tagen und 3 Stunden"},
+		{"en", "{{duration 3900000000000}}", "1 hour and 5 minutes"},
+		{"en", "{{duration 20000000000}}", "0 minutes"},
+		{"de", "{{in 20000000000}}", "gleich"},
+		{"en", "{{in 20000000000}}", "in a moment"},
+	}
+
+	for _, test := range tests {
+		messages := config.Catalog[test.langCode]
+		var rendered bytes.Buffer
+		messageTemplate := template.Must(template.New("").Funcs(TemplateFuncs(messages, now)).Parse(test.template))
+		if err := messageTemplate.Execute(&rendered, 51*time.Hour); err != nil {
+			t.Fatalf("%s: Could not render: %s", test.template, err)
+		}
+		if rendered.String() != test.expected {
+			t.Errorf("%s (%s): Expected \"%s\". Got \"%s\"", test.template, test.langCode, test.expected, rendered.String())
+		}
+	}
+
+	ago := TemplateFuncs(config.Catalog["de"], now)["ago"].(func(time.Time) string)
+	if text := ago(now.Add(-90 * time.Minute)); text != "vor 1 Stunde und 30 Minuten" {
+		t.Errorf("Expected \"vor 1 Stunde und 30 Minuten\". Got \"%s\"", text)
+	}
+	if text := ago(now.Add(-20 * time.Second)); text != "gerade eben" {
+		t.Errorf("Expected \"gerade eben\". Got \"%s\"", text)
+	}
+	if text := ago(time.Time{}); text != "" {
+		t.Errorf("Expected empty text for unknown time. Got \"%s\"", text)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * Linter for language files:
+ * Checks a single lang_<code>.yaml file (without fallback to the default language)
+ * against the configured levels and the known message keys.
+ */
+
+package configmanager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Sections of the language file which consist of (template) strings only. All of them are required.
+var stringSections = []string{"answers", "warnings", "summaries", "formats", "durations"}
+
+/*
+ * Result of linting a language file. Keys are written as paths, e.g. "answers.current_state".
+ */
+type LintReport struct {
+	LangCode string
+	Missing  []string // Keys which are needed, but not defined (taken from the default language, if possible)
+	Extra    []string // Keys which are unknown or not needed by the configured levels
+	Invalid  []string // Templates which cannot be parsed, with parse error
+}
+
+func (r *LintReport) Ok() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Invalid) == 0
+}
+
+/*
+ * Lints the language file lang_<langCode>.yaml in langDirPath
+ */
+func LintLangFile(config *Config, langDirPath string, langCode string) (*LintReport, error) {
+	report := &LintReport{LangCode: langCode}
+
+	langFile, err := ioutil.ReadFile(LangFilePath(langDirPath, langCode))
+	if err != nil {
+		return nil, err
+	}
+
+	var langFileKeys map[string]interface{}
+	if err := yaml.Unmarshal(langFile, &langFileKeys); err != nil {
+		return nil, err
+	}
+
+	messages := &Messages{}
+	if err := yaml.Unmarshal(langFile, messages); err != nil {
+		return nil, err
+	}
+
+	// Unknown sections
+	knownSections := yamlKeys(reflect.TypeOf(Messages{}))
+	for section := range langFileKeys {
+		if !contains(knownSections, section) {
+			report.Extra = append(report.Extra, section)
+		}
+	}
+
+	// Answers, warnings, ...: Every string is required and needs to be a valid template
+	expectedStrings := MessageStrings(&Messages{})
+	definedStrings := MessageStrings(messages)
+	for key := range expectedStrings {
+		if definedStrings[key] == "" {
+			report.Missing = append(report.Missing, key)
+		}
+	}
+	for _, section := range stringSections {
+		sectionKeys, _ := langFileKeys[section].(map[interface{}]interface{})
+		for key := range sectionKeys {
+			if _, exists := expectedStrings[section+"."+fmt.Sprint(key)]; !exists {
+				report.Extra = append(report.Extra, section+"."+fmt.Sprint(key))
+			}
+		}
+	}
+	report.checkTemplates(messages)
+
+	// Online and offline messages
+	if len(messages.Online) == 0 {
+		report.Missing = append(report.Missing, "online")
+	}
+	if len(messages.Offline) == 0 {
+		report.Missing = append(report.Missing, "offline")
+	}
+
+	// Levels: Exactly the message types the configured levels need
+	requiredLevelMessageTypes := RequiredLevelMessageTypes(config)
+	for _, messageType := range requiredLevelMessageTypes {
+		if len(messages.Levels[messageType].Messages) == 0 {
+			report.Missing = append(report.Missing, "levels."+messageType)
+		}
+	}
+	for messageType := range messages.Levels {
+		if !contains(requiredLevelMessageTypes, messageType) {
+			report.Extra = append(report.Extra, "levels."+messageType)
+		}
+	}
+
+	// Level names: Optional, but only for configured levels
+	var configuredLevels []string
+	for _, level := range config.Levels {
+		configuredLevels = append(configuredLevels, level.Name)
+	}
+	for level := range messages.LevelNames {
+		if !contains(configuredLevels, level) {
+			report.Extra = append(report.Extra, "level_names."+level)
+		}
+	}
+
+	// Event types: Names for all known event types
+	for _, eventType := range EventTypes {
+		if messages.EventTypes[eventType].Name == "" {
+			report.Missing = append(report.Missing, "event_types."+eventType)
+		}
+	}
+	for eventType := range messages.EventTypes {
+		if !contains(EventTypes, eventType) {
+			report.Extra = append(report.Extra, "event_types."+eventType)
+		}
+	}
+
+	sort.Strings(report.Missing)
+	sort.Strings(report.Extra)
+	sort.Strings(report.Invalid)
+
+	return report, nil
+}
+
+// Checks whether all strings, level messages and online / offline messages are parseable templates
+func (r *LintReport) checkTemplates(messages *Messages) {
+	for key, text := range MessageStrings(messages) {
+		r.checkTemplate(key, text)
+	}
+	for messageType, levelMessages := range messages.Levels {
+		for i, text := range levelMessages.Messages {
+			r.checkTemplate(fmt.Sprintf("levels.%s.messages[%d]", messageType, i), text)
+		}
+	}
+	for i, text := range messages.Online {
+		r.checkTemplate(fmt.Sprintf("online[%d]", i), text)
+	}
+	for i, text := range messages.Offline {
+		r.checkTemplate(fmt.Sprintf("offline[%d]", i), text)
+	}
+	sort.Strings(r.Invalid)
+}
+
+func (r *LintReport) checkTemplate(key string, text string) {
+	if _, err := template.New("").Funcs(TemplateFuncs(&Messages{}, time.Time{})).Parse(text); err != nil {
+		r.Invalid = append(r.Invalid, key+": "+err.Error())
+	}
+}
+
+/*
+ * Returns all strings of the string sections (answers, warnings, ...) by key, e.g. "answers.current_state"
+ */
+func MessageStrings(messages *Messages) map[string]string {
+	messageStrings := make(map[string]string)
+
+	messagesValue := reflect.ValueOf(messages).Elem()
+	for i := 0; i < messagesValue.NumField(); i++ {
+		section := yamlKey(messagesValue.Type().Field(i))
+		if !contains(stringSections, section) {
+			continue
+		}
+
+		sectionValue := messagesValue.Field(i)
+		for j := 0; j < sectionValue.NumField(); j++ {
+			key := yamlKey(sectionValue.Type().Field(j))
+			messageStrings[section+"."+key] = sectionValue.Field(j).String()
+		}
+	}
+
+	return messageStrings
+}
+
+// Returns the YAML keys of all fields of a struct type
+func yamlKeys(structType reflect.Type) []string {
+	var keys []string
+	for i := 0; i < structType.NumField(); i++ {
+		keys = append(keys, yamlKey(structType.Field(i)))
+	}
+	return keys
+}
+
+func yamlKey(field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "" {
+		key = strings.ToLower(field.Name)
+	}
+	return key
+}
+
+func contains(list []string, item string) bool {
+	for _, listItem := range list {
+		if listItem == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+/*
+ * Template functions:
+ * Helpers for message templates which format durations and relative times
+ * in the language of a message set
+ */
+
+package configmanager
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+ * Returns the functions available in message templates:
+ *   duration  Formats a time.Duration, e.g. {{duration .Forecast}} => "2 days and 3 hours"
+ *   ago       Formats a time.Time relative to now, e.g. {{ago .LastWatering}} => "2 days ago"
+ *   in        Formats a time.Duration from now, e.g. {{in .Forecast}} => "in 2 days"
+ */
+func TemplateFuncs(messages *Messages, now time.Time) template.FuncMap {
+	return template.FuncMap{
+		"duration": messages.FormatDuration,
+		"ago": func(t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return messages.formatRelative(messages.Durations.Ago, messages.Durations.Now, now.Sub(t))
+		},
+		"in": func(d time.Duration) string {
+			return messages.formatRelative(messages.Durations.In, messages.Durations.Soon, d)
+		},
+	}
+}
+
+/*
+ * Formats a duration with its two largest units, rounded to minutes,
+ * e.g. "1 hour and 5 minutes" or "2 days and 3 hours"
+ */
+func (m *Messages) FormatDuration(d time.Duration) string {
+	if d < 0 {
+		d = -d
+	}
+	d = d.Round(time.Minute)
+
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	minutes := int(d % time.Hour / time.Minute)
+
+	var parts []string
+	addUnit := func(count int, singular string, plural string) {
+		if count == 0 || len(parts) == 2 {
+			return
+		}
+		unit := plural
+		if count == 1 {
+			unit = singular
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", count, unit))
+	}
+
+	addUnit(days, m.Durations.Day, m.Durations.Days)
+	addUnit(hours, m.Durations.Hour, m.Durations.Hours)
+	if days == 0 {
+		addUnit(minutes, m.Durations.Minute, m.Durations.Minutes)
+	}
+
+	if len(parts) == 0 {
+		return fmt.Sprintf("0 %s", m.Durations.Minutes)
+	}
+	return strings.Join(parts, m.Durations.And)
+}
+
+// Renders the "ago" or "in" template with the formatted duration. Durations below a minute are rendered as momentText.
+func (m *Messages) formatRelative(templateText string, momentText string, d time.Duration) string {
+	if d > -time.Minute && d < time.Minute {
+		return momentText
+	}
+
+	var relativeBuffer bytes.Buffer
+	relativeTemplate, err := template.New("").Parse(templateText)
+	if err != nil {
+		return m.FormatDuration(d)
+	}
+	if err := relativeTemplate.Execute(&relativeBuffer, m.FormatDuration(d)); err != nil {
+		return m.FormatDuration(d)
+	}
+
+	return relativeBuffer.String()
+}
@@ -0,0 +1,463 @@
+/*
+ * Validation of configuration and language file:
+ * Finds problems in the level configuration before they show up at runtime
+ */
+
+package configmanager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"thomas-leister.de/plantmonitor/quiethours"
+)
+
+// Lowest and highest normalized sensor value
+const (
+	levelValueMin = 0
+	levelValueMax = 100
+)
+
+/*
+ * ValidationError collects all problems which were found in a configuration,
+ * so they can be reported at once.
+ */
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("config validation failed with %d problem(s):\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+/*
+ * Validates the level configuration and checks whether the language file
+ * contains all messages the configured levels need.
+ * Returns a *ValidationError listing all problems or nil.
+ */
+func ValidateConfig(config *Config) error {
+	validationError := &ValidationError{}
+
+	validateLevels(config, validationError)
+	validateLevelMessages(config, validationError)
+	validateMessages(config, validationError)
+	validateQuietHours(config, validationError)
+	validateReminderSchedules(config, validationError)
+	validateEscalation(config, validationError)
+	validateWatchdog(config, validationError)
+	validateGifs(config, validationError)
+	validateRooms(config, validationError)
+	if config.Xmpp.HttpUpload.MaxSize < 0 {
+		validationError.add("xmpp: http_upload.max_size must not be negative")
+	}
+
+	if len(validationError.Problems) > 0 {
+		return validationError
+	}
+	return nil
+}
+
+func validateLevels(config *Config, validationError *ValidationError) {
+	if len(config.Levels) == 0 {
+		validationError.add("no levels are defined")
+		return
+	}
+
+	levelNames := make(map[string]bool)
+
+	for i, level := range config.Levels {
+		if level.Name == "" {
+			validationError.add("level #%d has no name", i+1)
+		} else if levelNames[level.Name] {
+			validationError.add("level name '%s' is used more than once", level.Name)
+		}
+		levelNames[level.Name] = true
+
+		if level.Start < levelValueMin || level.Start > levelValueMax {
+			validationError.add("level '%s': start %d is outside %d..%d", level.Name, level.Start, levelValueMin, levelValueMax)
+		}
+		if level.End < levelValueMin || level.End > levelValueMax {
+			validationError.add("level '%s': end %d is outside %d..%d", level.Name, level.End, levelValueMin, levelValueMax)
+		}
+		if level.Start > level.End {
+			validationError.add("level '%s': start %d is greater than end %d", level.Name, level.Start, level.End)
+		}
+		if level.NotificationInterval < 0 {
+			validationError.add("level '%s': notification_interval must not be negative", level.Name)
+		}
+		if level.MinDwellReadings < 0 || level.MinDwellTime < 0 {
+			validationError.add("level '%s': min_dwell_readings and min_dwell_time must not be negative", level.Name)
+		}
+		switch level.Presence {
+		case "", PresenceAvailable, PresenceAway, PresenceDnd:
+		default:
+			validationError.add("level '%s': unknown presence '%s' (available, away or dnd)", level.Name, level.Presence)
+		}
+	}
+
+	// Check for gaps and overlaps. Every level is compared with the level reaching furthest
+	// so far, so that a wide level does not hide gaps or overlaps behind the levels it contains.
+	sortedLevels := sortedLevelIndexes(config)
+
+	first := config.Levels[sortedLevels[0]]
+	if first.Start > levelValueMin {
+		validationError.add("gap: values %d..%d are not covered by any level", levelValueMin, first.Start-1)
+	}
+
+	furthest := first
+	for i := 1; i < len(sortedLevels); i++ {
+		current := config.Levels[sortedLevels[i]]
+
+		if current.Start > furthest.End+1 {
+			validationError.add("gap: values %d..%d between levels '%s' and '%s' are not covered by any level", furthest.End+1, current.Start-1, furthest.Name, current.Name)
+		} else if current.Start <= furthest.End {
+			validationError.add("overlap: levels '%s' (%d..%d) and '%s' (%d..%d) overlap", furthest.Name, furthest.Start, furthest.End, current.Name, current.Start, current.End)
+		}
+
+		if current.End > furthest.End {
+			furthest = current
+		}
+	}
+
+	if furthest.End < levelValueMax {
+		validationError.add("gap: values %d..%d are not covered by any level", furthest.End+1, levelValueMax)
+	}
+}
+
+/*
+ * Every level needs messages for:
+ *   - <name>_steady    (first value after startup)
+ *   - <name>_up        (unless it is the lowest level)
+ *   - <name>_down      (unless it is the highest level)
+ *   - <name>_reminder  (if reminders are enabled)
+ */
+func validateLevelMessages(config *Config, validationError *ValidationError) {
+	catalog := languages(config)
+
+	for _, langCode := range LangCodes(catalog) {
+		for _, messageType := range RequiredLevelMessageTypes(config) {
+			levelMessages, exists := catalog[langCode].Levels[messageType]
+			if !exists {
+				validationError.add("language file lang_%s.yaml: message type '%s' is missing", langCode, messageType)
+			} else if len(levelMessages.Messages) == 0 {
+				validationError.add("language file lang_%s.yaml: message type '%s' has no messages", langCode, messageType)
+			}
+		}
+	}
+}
+
+/*
+ * Answers, warnings, etc. need to be defined in the default language.
+ * Templates need to be parseable in all languages.
+ */
+func validateMessages(config *Config, validationError *ValidationError) {
+	catalog := languages(config)
+
+	if defaultMessages, exists := catalog[config.LangCode]; exists {
+		messageStrings := MessageStrings(defaultMessages)
+		for _, key := range sortedKeys(messageStrings) {
+			if messageStrings[key] == "" {
+				validationError.add("language file lang_%s.yaml: %s is missing", config.LangCode, key)
+			}
+		}
+	}
+
+	for _, langCode := range LangCodes(catalog) {
+		report := &LintReport{}
+		report.checkTemplates(catalog[langCode])
+
+		for _, invalid := range report.Invalid {
+			validationError.add("language file lang_%s.yaml: invalid template %s", langCode, invalid)
+		}
+	}
+}
+
+/*
+ * Global and per-recipient quiet hours need to be parseable.
+ * Settings need to belong to a configured recipient, subscribe to known event types
+ * and choose an existing language.
+ */
+func validateQuietHours(config *Config, validationError *ValidationError) {
+	if config.QuietHours.Enabled() {
+		if _, err := quiethours.Parse(config.QuietHours.Start, config.QuietHours.End, config.QuietHours.Timezone); err != nil {
+			validationError.add("quiet_hours: %s", err)
+		}
+	}
+
+	for recipient, recipientSettings := range config.Xmpp.RecipientSettings {
+		if !isRecipient(config, recipient) {
+			validationError.add("xmpp.recipient_settings: %s is not a recipient or admin", recipient)
+		}
+
+		quietHours := recipientSettings.QuietHours
+		if quietHours.Enabled() {
+			if _, err := quiethours.Parse(quietHours.Start, quietHours.End, quietHours.Timezone); err != nil {
+				validationError.add("xmpp.recipient_settings.%s.quiet_hours: %s", recipient, err)
+			}
+		}
+
+		if recipientSettings.Language != "" {
+			if _, exists := languages(config)[recipientSettings.Language]; !exists {
+				validationError.add("xmpp.recipient_settings.%s.language: there is no language file lang_%s.yaml", recipient, recipientSettings.Language)
+			}
+		}
+
+		for _, eventType := range recipientSettings.Events {
+			if !contains(EventTypes, eventType) {
+				validationError.add("xmpp.recipient_settings.%s.events: unknown event type '%s'. Known: %s", recipient, eventType, strings.Join(EventTypes, ", "))
+			}
+		}
+
+		if len(recipientSettings.Plants) > 0 && config.PlantName == "" {
+			validationError.add("xmpp.recipient_settings.%s.plants: plant_name needs to be set to filter by plant", recipient)
+		}
+	}
+}
+
+/*
+ * Reminder schedules need a known type and parameters which fit the type.
+ */
+func validateReminderSchedules(config *Config, validationError *ValidationError) {
+	for _, level := range config.Levels {
+		schedule := level.ReminderSchedule
+
+		if schedule.MaxCount < 0 {
+			validationError.add("level '%s': reminder_schedule.max_count must not be negative", level.Name)
+		}
+
+		switch schedule.Type {
+		case "", ReminderScheduleInterval:
+		case ReminderScheduleExponential:
+			if level.NotificationInterval == 0 {
+				validationError.add("level '%s': exponential reminder_schedule requires a notification_interval", level.Name)
+			}
+			if schedule.Factor != 0 && schedule.Factor < 1 {
+				validationError.add("level '%s': reminder_schedule.factor must be at least 1", level.Name)
+			}
+			if schedule.MaxInterval < 0 {
+				validationError.add("level '%s': reminder_schedule.max_interval must not be negative", level.Name)
+			}
+		case ReminderScheduleOffsets:
+			if len(schedule.Offsets) == 0 {
+				validationError.add("level '%s': reminder_schedule.offsets is empty", level.Name)
+			}
+			for i, offset := range schedule.Offsets {
+				if offset <= 0 {
+					validationError.add("level '%s': reminder_schedule.offsets must be positive", level.Name)
+					break
+				}
+				if i > 0 && offset <= schedule.Offsets[i-1] {
+					validationError.add("level '%s': reminder_schedule.offsets must be ascending", level.Name)
+					break
+				}
+			}
+		case ReminderScheduleTimes:
+			if len(schedule.Times) == 0 {
+				validationError.add("level '%s': reminder_schedule.times is empty", level.Name)
+			}
+			for _, timeOfDay := range schedule.Times {
+				if _, err := quiethours.ParseTimeOfDay(timeOfDay); err != nil {
+					validationError.add("level '%s': reminder_schedule.times: %s", level.Name, err)
+				}
+			}
+			if schedule.Timezone != "" {
+				if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+					validationError.add("level '%s': reminder_schedule.timezone: %s", level.Name, err)
+				}
+			}
+		default:
+			validationError.add("level '%s': unknown reminder_schedule.type '%s'", level.Name, schedule.Type)
+		}
+	}
+}
+
+/*
+ * Escalation tiers need known recipients. Every tier except the first one
+ * needs a condition (after_reminders or after).
+ */
+func validateEscalation(config *Config, validationError *ValidationError) {
+	for _, level := range config.Levels {
+		if len(level.Escalation) > 0 && !level.RemindersEnabled() {
+			validationError.add("level '%s': escalation requires reminders", level.Name)
+		}
+
+		for i, tier := range level.Escalation {
+			if len(tier.Recipients) == 0 {
+				validationError.add("level '%s': escalation tier %d has no recipients", level.Name, i+1)
+			}
+			for _, recipient := range tier.Recipients {
+				if !isRecipient(config, recipient) {
+					validationError.add("level '%s': escalation tier %d: %s is not a recipient or admin", level.Name, i+1, recipient)
+				}
+			}
+
+			if tier.AfterReminders < 0 || tier.After < 0 {
+				validationError.add("level '%s': escalation tier %d: after_reminders and after must not be negative", level.Name, i+1)
+			} else if i > 0 && tier.AfterReminders == 0 && tier.After == 0 {
+				validationError.add("level '%s': escalation tier %d needs after_reminders or after", level.Name, i+1)
+			}
+		}
+	}
+}
+
+/*
+ * Watchdog timeout is needed in adaptive mode, too (until the uplink interval has been learned)
+ */
+func validateWatchdog(config *Config, validationError *ValidationError) {
+	if config.Watchdog.Timeout <= 0 {
+		validationError.add("watchdog: timeout must be greater than 0")
+	}
+	if config.Watchdog.RepeatInterval < 0 {
+		validationError.add("watchdog: repeat_interval must not be negative")
+	}
+	if config.Watchdog.MissedUplinks < 0 {
+		validationError.add("watchdog: missed_uplinks must not be negative")
+	}
+	if config.Watchdog.FrameGapWarning < 0 {
+		validationError.add("watchdog: frame_gap_warning must not be negative")
+	}
+
+	dataQuality := config.Watchdog.DataQuality
+	if dataQuality.StuckTime < 0 || dataQuality.PinnedReadings < 0 || dataQuality.VarianceWindow < 0 {
+		validationError.add("watchdog: data_quality: stuck_time, pinned_readings and variance_window must not be negative")
+	}
+	if dataQuality.VarianceWindow == 1 {
+		validationError.add("watchdog: data_quality: variance_window needs at least 2 values")
+	}
+	if dataQuality.VarianceWindow > 0 && dataQuality.MinStdDev <= 0 {
+		validationError.add("watchdog: data_quality: min_std_dev must be greater than 0 if variance_window is set")
+	}
+}
+
+func validateGifs(config *Config, validationError *ValidationError) {
+	switch config.Gifs.Provider {
+	case "", GifProviderGiphy, GifProviderNone:
+	case GifProviderTenor:
+		if config.Gifs.Tenor.ApiKey == "" {
+			validationError.add("gifs: tenor.api_key is required for provider tenor")
+		}
+	case GifProviderLocal:
+		if config.Gifs.Local.Dir == "" && len(config.Gifs.Local.Urls) == 0 {
+			validationError.add("gifs: local.dir or local.urls is required for provider local")
+		}
+		if config.Gifs.Local.Dir != "" && config.Gifs.Local.BaseUrl == "" {
+			validationError.add("gifs: local.base_url is required if local.dir is set")
+		}
+	default:
+		validationError.add("gifs: unknown provider '%s' (giphy, tenor, local or none)", config.Gifs.Provider)
+	}
+
+	switch config.Gifs.Rating {
+	case "", GifRatingG, GifRatingPG:
+	default:
+		validationError.add("gifs: unknown rating '%s' (g or pg)", config.Gifs.Rating)
+	}
+	if config.Gifs.Timeout < 0 || config.Gifs.CacheTTL < 0 || config.Gifs.PoolSize < 0 {
+		validationError.add("gifs: timeout, cache_ttl and pool_size must not be negative")
+	}
+}
+
+func validateRooms(config *Config, validationError *ValidationError) {
+	roomJids := make(map[string]bool)
+	for i, room := range config.Xmpp.Rooms {
+		if room.Jid == "" || !strings.Contains(room.Jid, "@") || strings.Contains(room.Jid, "/") {
+			validationError.add("xmpp.rooms[%d]: jid '%s' is not a bare room JID", i, room.Jid)
+		}
+		if room.Nickname == "" {
+			validationError.add("xmpp.rooms[%d]: nickname is missing", i)
+		}
+		if roomJids[room.Jid] {
+			validationError.add("xmpp.rooms[%d]: room %s is configured twice", i, room.Jid)
+		}
+		roomJids[room.Jid] = true
+	}
+}
+
+func isRecipient(config *Config, jid string) bool {
+	for _, recipient := range append(append(append([]string{}, config.Xmpp.Recipients...), config.Xmpp.Admins...), config.RoomJids()...) {
+		if recipient == jid {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns the names of all level message types (e.g. "low_steady") which are
+ * needed for the configured levels.
+ */
+func RequiredLevelMessageTypes(config *Config) []string {
+	var messageTypes []string
+
+	if len(config.Levels) == 0 {
+		return messageTypes
+	}
+
+	sortedLevels := sortedLevelIndexes(config)
+	lowest := sortedLevels[0]
+	highest := sortedLevels[len(sortedLevels)-1]
+
+	for _, i := range sortedLevels {
+		level := config.Levels[i]
+
+		messageTypes = append(messageTypes, level.Name+"_steady")
+		if i != lowest {
+			messageTypes = append(messageTypes, level.Name+"_up")
+		}
+		if i != highest {
+			messageTypes = append(messageTypes, level.Name+"_down")
+		}
+		if level.RemindersEnabled() {
+			messageTypes = append(messageTypes, level.Name+"_reminder")
+		}
+	}
+
+	return messageTypes
+}
+
+// Returns messages of all languages. Only the default language if no catalog was loaded.
+func languages(config *Config) map[string]*Messages {
+	if config.Catalog != nil {
+		return config.Catalog
+	}
+	return map[string]*Messages{config.LangCode: &config.Messages}
+}
+
+func sortedKeys(stringMap map[string]string) []string {
+	var keys []string
+	for key := range stringMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the language codes of a catalog in alphabetical order
+func LangCodes(catalog map[string]*Messages) []string {
+	var langCodes []string
+	for langCode := range catalog {
+		langCodes = append(langCodes, langCode)
+	}
+	sort.Strings(langCodes)
+	return langCodes
+}
+
+// Returns indexes of config.Levels, sorted by level start value
+func sortedLevelIndexes(config *Config) []int {
+	indexes := make([]int, len(config.Levels))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return config.Levels[indexes[a]].Start < config.Levels[indexes[b]].Start
+	})
+
+	return indexes
+}
@@ -0,0 +1,185 @@
+/*
+ * GIF cache:
+ * Keeps a pool of prefetched GIF URLs per keyword set, so that sending a message
+ * usually does not wait for the GIF API. Used URLs are refilled in the background.
+ * Pooled URLs expire after a TTL. Until the pool has been refilled, a previously retrieved
+ * URL is reused, so that sending a message never waits for the API.
+ */
+
+package gifmanager
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"thomas-leister.de/plantmonitor/clock"
+)
+
+// Number of previously retrieved URLs per keyword set which are kept as fallback
+const maxFallbackUrls = 20
+
+type cachedGif struct {
+	Url       string
+	FetchedAt time.Time
+}
+
+type CachingProvider struct {
+	Provider GifProvider
+	Clock    clock.Clock
+	TTL      time.Duration // Pooled URLs are not used anymore after this time (except as fallback)
+	PoolSize int           // Number of prefetched URLs per keyword set
+
+	mutex     sync.Mutex
+	pools     map[string][]cachedGif // Prefetched, unused URLs by keyword set
+	fallbacks map[string][]string    // Previously retrieved URLs by keyword set
+	refilling map[string]bool        // Keyword sets which are being refilled
+	refills   sync.WaitGroup
+}
+
+func NewCachingProvider(provider GifProvider, ttl time.Duration, poolSize int) *CachingProvider {
+	return &CachingProvider{
+		Provider:  provider,
+		Clock:     clock.Real{},
+		TTL:       ttl,
+		PoolSize:  poolSize,
+		pools:     make(map[string][]cachedGif),
+		fallbacks: make(map[string][]string),
+		refilling: make(map[string]bool),
+	}
+}
+
+/*
+ * Fills the pools of all keyword sets in the background, e.g. at startup
+ */
+func (c *CachingProvider) Prefetch(keywordSets []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, keywords := range keywordSets {
+		c.refill(keywords)
+	}
+}
+
+/*
+ * Returns a prefetched URL without waiting for the API. If the pooled URLs have expired
+ * or are used up, a previously retrieved URL is used instead. The pool is refilled in
+ * the background, so that the next message gets a fresh GIF.
+ */
+func (c *CachingProvider) GetGifURL(keywords string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	defer c.refill(keywords)
+
+	if pool := c.freshPool(keywords); len(pool) > 0 {
+		c.pools[keywords] = pool[1:]
+		return pool[0].Url, nil
+	}
+
+	fallbacks := c.fallbacks[keywords]
+	if len(fallbacks) == 0 {
+		log.Printf("GifManager: No GIF for \"%s\" available yet. Sending message without GIF.\n", keywords)
+		return "", nil
+	}
+
+	log.Printf("GifManager: No fresh GIF for \"%s\" available. Using a previously retrieved one.\n", keywords)
+	return fallbacks[rand.Intn(len(fallbacks))], nil
+}
+
+// Returns the number of requests and failed requests of the wrapped provider, if it counts them
+func (c *CachingProvider) Stats() (uint64, uint64) {
+	if reporter, ok := c.Provider.(StatsReporter); ok {
+		return reporter.Stats()
+	}
+	return 0, 0
+}
+
+/*
+ * Returns the pool of keywords without expired URLs.
+ * Needs to be called with mutex held.
+ */
+func (c *CachingProvider) freshPool(keywords string) []cachedGif {
+	now := c.Clock.Now()
+
+	var pool []cachedGif
+	for _, gif := range c.pools[keywords] {
+		if c.TTL <= 0 || now.Sub(gif.FetchedAt) < c.TTL {
+			pool = append(pool, gif)
+		}
+	}
+	c.pools[keywords] = pool
+
+	return pool
+}
+
+/*
+ * Starts refilling the pool of keywords in the background, unless it is full or being refilled.
+ * Needs to be called with mutex held.
+ */
+func (c *CachingProvider) refill(keywords string) {
+	if c.refilling[keywords] || len(c.freshPool(keywords)) >= c.PoolSize {
+		return
+	}
+	c.refilling[keywords] = true
+
+	c.refills.Add(1)
+	go func() {
+		defer c.refills.Done()
+
+		// Random GIFs may repeat: Limit number of attempts
+		for attempt := 0; attempt < 2*c.PoolSize; attempt++ {
+			gifUrl, err := c.Provider.GetGifURL(keywords)
+
+			c.mutex.Lock()
+			if err != nil || gifUrl == "" || len(c.freshPool(keywords)) >= c.PoolSize {
+				c.mutex.Unlock()
+				break
+			}
+			c.add(keywords, gifUrl)
+			full := len(c.pools[keywords]) >= c.PoolSize
+			c.mutex.Unlock()
+
+			if full {
+				break
+			}
+		}
+
+		c.mutex.Lock()
+		c.refilling[keywords] = false
+		c.mutex.Unlock()
+	}()
+}
+
+/*
+ * Adds a retrieved URL to pool and fallbacks of keywords, unless it is already known.
+ * Needs to be called with mutex held.
+ */
+func (c *CachingProvider) add(keywords string, gifUrl string) {
+	for _, gif := range c.pools[keywords] {
+		if gif.Url == gifUrl {
+			return
+		}
+	}
+	c.pools[keywords] = append(c.pools[keywords], cachedGif{Url: gifUrl, FetchedAt: c.Clock.Now()})
+
+	c.remember(keywords, gifUrl)
+}
+
+/*
+ * Adds a retrieved URL to the fallbacks of keywords, unless it is already known.
+ * Needs to be called with mutex held.
+ */
+func (c *CachingProvider) remember(keywords string, gifUrl string) {
+	for _, fallback := range c.fallbacks[keywords] {
+		if fallback == gifUrl {
+			return
+		}
+	}
+	fallbacks := append(c.fallbacks[keywords], gifUrl)
+	if len(fallbacks) > maxFallbackUrls {
+		fallbacks = fallbacks[len(fallbacks)-maxFallbackUrls:]
+	}
+	c.fallbacks[keywords] = fallbacks
+}
@@ -1,35 +1,229 @@
 /*
  * GifManager:
- * Offers functions to retrieve GIF URLs from an online GIF platform, such as Giphy.
+ * Offers functions to retrieve GIF URLs for keywords from a GIF provider,
+ * such as Giphy, Tenor or a local list of GIFs. The provider is chosen in config.yaml.
  */
 
 package gifmanager
 
 import (
+	"fmt"
 	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	libgiphy "github.com/sanzaru/go-giphy"
+	"thomas-leister.de/plantmonitor/configmanager"
 )
 
-type GiphyClient struct {
-	Apiclient *libgiphy.Giphy
+/*
+ * Source of GIFs. Returns the URL of a GIF matching keywords, e.g. "dying death".
+ * An empty URL without error means that no GIF is sent.
+ */
+type GifProvider interface {
+	GetGifURL(keywords string) (string, error)
 }
 
-func (g *GiphyClient) Init(api_key string) {
+/*
+ * Providers which can prefetch GIFs
+ */
+type Prefetcher interface {
+	Prefetch(keywordSets []string)
+}
+
+/*
+ * Creates the GIF provider chosen in config (gifs.provider).
+ * The provider is wrapped, so that failures are logged and counted.
+ * GIFs of online providers are prefetched and cached.
+ */
+func NewProvider(config *configmanager.Config) (GifProvider, error) {
 	log.Println("Initializing gifmanager ...")
 
-	g.Apiclient = libgiphy.NewGiphy(api_key)
+	var provider GifProvider
+
+	name := config.Gifs.Provider
+	if name == "" {
+		name = configmanager.GifProviderGiphy
+	}
+
+	rating := config.Gifs.Rating
+	if rating == "" {
+		rating = configmanager.GifRatingG
+	}
+	timeout := time.Duration(config.Gifs.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	switch name {
+	case configmanager.GifProviderGiphy:
+		provider = NewGiphyClient(config.Giphy.ApiKey, rating, timeout)
+	case configmanager.GifProviderTenor:
+		provider = NewTenorClient(config.Gifs.Tenor.ApiKey, config.Gifs.Tenor.ClientKey, rating, timeout)
+	case configmanager.GifProviderLocal:
+		localProvider, err := NewLocalProvider(config.Gifs.Local.Dir, config.Gifs.Local.BaseUrl, config.Gifs.Local.Urls)
+		if err != nil {
+			return nil, err
+		}
+		provider = localProvider
+	case configmanager.GifProviderNone:
+		provider = NoopProvider{}
+	default:
+		return nil, fmt.Errorf("unknown GIF provider \"%s\"", name)
+	}
+
+	log.Printf("GifManager: Using GIF provider %s\n", name)
+	provider = &MeteredProvider{Provider: provider, Name: name}
+
+	// Online providers: Never wait for the API when sending a message
+	if name == configmanager.GifProviderGiphy || name == configmanager.GifProviderTenor {
+		ttl := time.Duration(config.Gifs.CacheTTL) * time.Second
+		if ttl <= 0 {
+			ttl = 24 * time.Hour
+		}
+		poolSize := config.Gifs.PoolSize
+		if poolSize <= 0 {
+			poolSize = 3
+		}
+		provider = NewCachingProvider(provider, ttl, poolSize)
+	}
+
+	return provider, nil
+}
+
+/*
+ * Passes requests to the GIF provider chosen in config. The provider is replaced
+ * on Reload() if its settings (giphy, gifs) have changed.
+ */
+type GifManager struct {
+	mutex    sync.RWMutex
+	provider GifProvider
+	config   configmanager.Config // Config the provider was created from
 }
 
-func (g *GiphyClient) GetGifURL(keywords string) (string, error) {
-	dataRandom, err := g.Apiclient.GetRandom(keywords)
+func (g *GifManager) Init(config *configmanager.Config) error {
+	provider, err := NewProvider(config)
 	if err != nil {
-		log.Println("GifManager: ", err)
-		return "", err
+		return err
+	}
+
+	g.provider = provider
+	g.config = *config
+	return nil
+}
+
+/*
+ * Creates a new provider if the GIF settings have changed. Keeps the previous provider
+ * if the new settings are broken. Prefetches GIFs for new keyword sets.
+ */
+func (g *GifManager) Reload(config *configmanager.Config) {
+	g.mutex.Lock()
+	if config.Giphy != g.config.Giphy || !reflect.DeepEqual(config.Gifs, g.config.Gifs) {
+		log.Println("GifManager: GIF settings have changed. Reloading GIF provider.")
+		provider, err := NewProvider(config)
+		if err != nil {
+			log.Println("GifManager: Could not reload GIF provider. Keeping previous provider:", err)
+		} else {
+			g.provider = provider
+			g.config = *config
+		}
+	}
+	g.mutex.Unlock()
+
+	Prefetch(g, config)
+}
+
+func (g *GifManager) current() GifProvider {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.provider
+}
+
+func (g *GifManager) GetGifURL(keywords string) (string, error) {
+	return g.current().GetGifURL(keywords)
+}
+
+func (g *GifManager) Prefetch(keywordSets []string) {
+	if prefetcher, ok := g.current().(Prefetcher); ok {
+		prefetcher.Prefetch(keywordSets)
+	}
+}
+
+// Returns the number of requests and failed requests of the current provider
+func (g *GifManager) Stats() (uint64, uint64) {
+	if reporter, ok := g.current().(StatsReporter); ok {
+		return reporter.Stats()
+	}
+	return 0, 0
+}
+
+/*
+ * Prefetches GIFs for all keyword sets of the level messages in all languages,
+ * if the provider supports it
+ */
+func Prefetch(provider GifProvider, config *configmanager.Config) {
+	prefetcher, ok := provider.(Prefetcher)
+	if !ok {
+		return
 	}
 
-	gifUrl := dataRandom.Data.Images.Original.Mp4
-	log.Printf("GifManager: GIF URL: %+v\n", gifUrl)
+	var keywordSets []string
+	known := make(map[string]bool)
+	for _, messages := range config.Catalog {
+		for _, messageType := range messages.Levels {
+			if messageType.GifKeywords != "" && !known[messageType.GifKeywords] {
+				known[messageType.GifKeywords] = true
+				keywordSets = append(keywordSets, messageType.GifKeywords)
+			}
+		}
+	}
+
+	log.Printf("GifManager: Prefetching GIFs for %d keyword sets\n", len(keywordSets))
+	prefetcher.Prefetch(keywordSets)
+}
+
+/*
+ * Provider which never returns a GIF, e.g. in replay mode or if GIFs are not wanted at all
+ */
+type NoopProvider struct{}
+
+func (NoopProvider) GetGifURL(keywords string) (string, error) {
+	return "", nil
+}
+
+/*
+ * Wraps a provider: Counts requests and failures and logs every failure
+ */
+type MeteredProvider struct {
+	Provider GifProvider
+	Name     string // Name of the provider used in log messages
+
+	requests uint64
+	failures uint64
+}
+
+func (p *MeteredProvider) GetGifURL(keywords string) (string, error) {
+	requests := atomic.AddUint64(&p.requests, 1)
+
+	gifUrl, err := p.Provider.GetGifURL(keywords)
+	if err != nil {
+		failures := atomic.AddUint64(&p.failures, 1)
+		log.Printf("GifManager: %s could not retrieve a GIF for \"%s\" (%d of %d requests failed): %s\n", p.Name, keywords, failures, requests, err)
+		return "", err
+	}
 
 	return gifUrl, nil
 }
+
+/*
+ * Provider which counts its requests, e.g. for the status command
+ */
+type StatsReporter interface {
+	Stats() (uint64, uint64) // Number of requests and failed requests so far
+}
+
+// Returns the number of requests and failed requests so far
+func (p *MeteredProvider) Stats() (uint64, uint64) {
+	return atomic.LoadUint64(&p.requests), atomic.LoadUint64(&p.failures)
+}
@@ -0,0 +1,202 @@
+package gifmanager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	clockPkg "thomas-leister.de/plantmonitor/clock"
+	"thomas-leister.de/plantmonitor/configmanager"
+)
+
+/*
+ * Local provider chooses from URL lists and from files in the served directory
+ */
+func TestLocalProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gifs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "dying_death"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dying_death", "wilted.mp4"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewLocalProvider(dir, "https://example.com/gifs/", map[string][]string{
+		"good fine": {"https://example.com/thumbs-up.mp4"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create local provider: %s", err)
+	}
+
+	if gifUrl, err := provider.GetGifURL("dying death"); err != nil || gifUrl != "https://example.com/gifs/dying_death/wilted.mp4" {
+		t.Errorf("Expected GIF from directory. Got \"%s\", %v", gifUrl, err)
+	}
+	if gifUrl, err := provider.GetGifURL("good fine"); err != nil || gifUrl != "https://example.com/thumbs-up.mp4" {
+		t.Errorf("Expected GIF from URL list. Got \"%s\", %v", gifUrl, err)
+	}
+	if _, err := provider.GetGifURL("unknown"); err == nil {
+		t.Error("Expected error for keywords without GIFs")
+	}
+}
+
+/*
+ * Tenor provider parses search results. Failures are counted.
+ */
+func TestTenorProviderAndFailureCount(t *testing.T) {
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing || r.URL.Query().Get("key") != "secret" || r.URL.Query().Get("contentfilter") != "high" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"results": [{"media_formats": {"mp4": {"url": "https://media.tenor.com/%s.mp4"}}}]}`, r.URL.Query().Get("q"))
+	}))
+	defer server.Close()
+
+	tenorClient := NewTenorClient("secret", "plantmonitor", "g", time.Second)
+	tenorClient.ApiUrl = server.URL
+	provider := &MeteredProvider{Provider: tenorClient, Name: "tenor"}
+
+	if gifUrl, err := provider.GetGifURL("relieved"); err != nil || gifUrl != "https://media.tenor.com/relieved.mp4" {
+		t.Errorf("Expected GIF from Tenor. Got \"%s\", %v", gifUrl, err)
+	}
+
+	failing = true
+	if gifUrl, err := provider.GetGifURL("relieved"); err == nil || gifUrl != "" {
+		t.Errorf("Expected error if Tenor is unavailable. Got \"%s\"", gifUrl)
+	}
+
+	if requests, failures := provider.Stats(); requests != 2 || failures != 1 {
+		t.Errorf("Expected 2 requests and 1 failure. Got %d and %d", requests, failures)
+	}
+
+	// The cache reports the stats of the wrapped provider
+	if requests, failures := NewCachingProvider(provider, time.Hour, 1).Stats(); requests != 2 || failures != 1 {
+		t.Errorf("Expected cache to report 2 requests and 1 failure. Got %d and %d", requests, failures)
+	}
+}
+
+// Provider which returns numbered URLs or fails
+type countingProvider struct {
+	mutex   sync.Mutex
+	calls   int
+	failing bool
+}
+
+func (p *countingProvider) GetGifURL(keywords string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.failing {
+		return "", fmt.Errorf("API is down")
+	}
+	p.calls++
+	return fmt.Sprintf("https://example.com/%d.mp4", p.calls), nil
+}
+
+/*
+ * Cache serves prefetched GIFs, refills them in the background and falls back to known GIFs
+ */
+func TestCachingProvider(t *testing.T) {
+	start := time.Date(2021, time.November, 1, 12, 0, 0, 0, time.UTC)
+	clock := clockPkg.NewVirtual(start)
+
+	provider := &countingProvider{}
+	cache := NewCachingProvider(provider, time.Hour, 2)
+	cache.Clock = clock
+
+	// Nothing prefetched yet: No GIF, but no waiting either
+	if gifUrl, _ := cache.GetGifURL("dying death"); gifUrl != "" {
+		t.Errorf("Expected no GIF before prefetching. Got \"%s\"", gifUrl)
+	}
+	cache.refills.Wait()
+
+	cache.Prefetch([]string{"dying death", "good fine"})
+	cache.refills.Wait()
+	if provider.calls != 4 {
+		t.Fatalf("Expected 2 prefetched GIFs per keyword set. Got %d API calls", provider.calls)
+	}
+
+	// Prefetched GIF is used and replaced
+	if gifUrl, _ := cache.GetGifURL("dying death"); gifUrl != "https://example.com/1.mp4" {
+		t.Errorf("Expected first prefetched GIF. Got \"%s\"", gifUrl)
+	}
+	cache.refills.Wait()
+	if provider.calls != 5 {
+		t.Errorf("Expected pool to be refilled. Got %d API calls", provider.calls)
+	}
+
+	// Pooled GIFs have expired: A known GIF is used without waiting, the pool is refilled in the background
+	clock.AdvanceTo(start.Add(2 * time.Hour))
+	calls := provider.calls
+	known := strings.Join(cache.fallbacks["good fine"], " ")
+	if gifUrl, _ := cache.GetGifURL("good fine"); gifUrl == "" || !strings.Contains(known, gifUrl) {
+		t.Errorf("Expected one of the known GIFs %s after expiry. Got \"%s\"", known, gifUrl)
+	}
+	cache.refills.Wait()
+	if gifUrl, _ := cache.GetGifURL("good fine"); gifUrl != fmt.Sprintf("https://example.com/%d.mp4", calls+1) {
+		t.Errorf("Expected a newly retrieved GIF after refill. Got \"%s\"", gifUrl)
+	}
+	cache.refills.Wait()
+
+	// API is down and pooled GIFs have expired: Known GIFs are reused
+	provider.failing = true
+	clock.AdvanceTo(start.Add(4 * time.Hour))
+	known = strings.Join(cache.fallbacks["dying death"], " ")
+	if gifUrl, _ := cache.GetGifURL("dying death"); gifUrl == "" || !strings.Contains(known, gifUrl) {
+		t.Errorf("Expected fallback to one of the known GIFs %s. Got \"%s\"", known, gifUrl)
+	}
+	cache.refills.Wait()
+}
+
+/*
+ * On reload, the provider is replaced if its settings have changed. Broken settings keep the previous provider.
+ */
+func TestGifManagerReload(t *testing.T) {
+	config := configmanager.Config{}
+	config.Gifs.Provider = configmanager.GifProviderLocal
+	config.Gifs.Local.Urls = map[string][]string{"dying death": {"https://example.com/old.gif"}}
+
+	gifManager := GifManager{}
+	if err := gifManager.Init(&config); err != nil {
+		t.Fatalf("Could not init GIF manager: %s", err)
+	}
+
+	expectGif := func(expected string) {
+		t.Helper()
+		if gifUrl, err := gifManager.GetGifURL("dying death"); err != nil || gifUrl != expected {
+			t.Errorf("Expected GIF %s. Got \"%s\", %v", expected, gifUrl, err)
+		}
+	}
+	expectGif("https://example.com/old.gif")
+
+	// Unchanged settings: Provider is kept
+	provider := gifManager.current()
+	gifManager.Reload(&config)
+	if gifManager.current() != provider {
+		t.Error("Expected provider to be kept if settings are unchanged")
+	}
+
+	newConfig := configmanager.Config{}
+	newConfig.Gifs.Provider = configmanager.GifProviderLocal
+	newConfig.Gifs.Local.Urls = map[string][]string{"dying death": {"https://example.com/new.gif"}}
+	gifManager.Reload(&newConfig)
+	expectGif("https://example.com/new.gif")
+
+	brokenConfig := configmanager.Config{}
+	brokenConfig.Gifs.Provider = "unknown"
+	gifManager.Reload(&brokenConfig)
+	expectGif("https://example.com/new.gif")
+}
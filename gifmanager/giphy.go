@@ -0,0 +1,85 @@
+/*
+ * Giphy provider:
+ * Retrieves random GIFs for keywords via the Giphy API
+ */
+
+package gifmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const giphyApiUrl = "https://api.giphy.com/v1/gifs/random"
+
+type GiphyClient struct {
+	ApiKey     string
+	Rating     string // Content rating, e.g. "g" or "pg"
+	ApiUrl     string
+	HttpClient *http.Client
+}
+
+type giphyRandomResponse struct {
+	Data struct {
+		Images struct {
+			Original struct {
+				Mp4 string `json:"mp4"`
+			} `json:"original"`
+		} `json:"images"`
+	} `json:"data"`
+}
+
+func NewGiphyClient(apiKey string, rating string, timeout time.Duration) *GiphyClient {
+	log.Println("Initializing Giphy client ...")
+
+	if apiKey == "" {
+		log.Println("GifManager: Giphy API key is missing. No GIFs will be sent.")
+	}
+
+	return &GiphyClient{
+		ApiKey:     apiKey,
+		Rating:     rating,
+		ApiUrl:     giphyApiUrl,
+		HttpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+func (g *GiphyClient) GetGifURL(keywords string) (string, error) {
+	if g.ApiKey == "" {
+		return "", fmt.Errorf("giphy API key is missing")
+	}
+
+	query := url.Values{}
+	query.Set("api_key", g.ApiKey)
+	query.Set("tag", keywords)
+	if g.Rating != "" {
+		query.Set("rating", g.Rating)
+	}
+
+	response, err := g.HttpClient.Get(g.ApiUrl + "?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("giphy API returned %s", response.Status)
+	}
+
+	var randomResponse giphyRandomResponse
+	if err := json.NewDecoder(response.Body).Decode(&randomResponse); err != nil {
+		return "", fmt.Errorf("could not parse giphy API response: %s", err)
+	}
+
+	gifUrl := randomResponse.Data.Images.Original.Mp4
+	if gifUrl == "" {
+		return "", fmt.Errorf("giphy returned no GIF for \"%s\"", keywords)
+	}
+	log.Printf("GifManager: GIF URL: %+v\n", gifUrl)
+
+	return gifUrl, nil
+}
@@ -0,0 +1,66 @@
+/*
+ * Local provider:
+ * Chooses GIFs from a list of URLs per keyword set and / or from a local directory
+ * which is served by a web server, e.g. for offline or self-hosted setups.
+ * Directory layout: <dir>/<keywords with "_" instead of spaces>/<file>, e.g. gifs/dying_death/1.mp4
+ * is sent as <base_url>/dying_death/1.mp4
+ */
+
+package gifmanager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type LocalProvider struct {
+	Dir     string              // Directory containing one subdirectory per keyword set. Optional.
+	BaseUrl string              // URL under which Dir is served
+	Urls    map[string][]string // GIF URLs by keyword set
+}
+
+func NewLocalProvider(dir string, baseUrl string, urls map[string][]string) (*LocalProvider, error) {
+	if dir != "" {
+		if baseUrl == "" {
+			return nil, fmt.Errorf("base URL is missing for local GIF directory %s", dir)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("local GIF directory %s does not exist", dir)
+		}
+	}
+
+	return &LocalProvider{
+		Dir:     dir,
+		BaseUrl: strings.TrimSuffix(baseUrl, "/"),
+		Urls:    urls,
+	}, nil
+}
+
+func (l *LocalProvider) GetGifURL(keywords string) (string, error) {
+	gifUrls := append([]string{}, l.Urls[keywords]...)
+
+	// Directory is read on every request, so GIFs can be added without restart
+	if l.Dir != "" {
+		subdir := strings.ReplaceAll(keywords, " ", "_")
+		files, err := ioutil.ReadDir(filepath.Join(l.Dir, subdir))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		for _, file := range files {
+			if file.Mode().IsRegular() && !strings.HasPrefix(file.Name(), ".") {
+				gifUrls = append(gifUrls, l.BaseUrl+"/"+url.PathEscape(subdir)+"/"+url.PathEscape(file.Name()))
+			}
+		}
+	}
+
+	if len(gifUrls) == 0 {
+		return "", fmt.Errorf("no local GIF for \"%s\"", keywords)
+	}
+
+	return gifUrls[rand.Intn(len(gifUrls))], nil
+}
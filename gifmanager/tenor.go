@@ -0,0 +1,100 @@
+/*
+ * Tenor provider:
+ * Retrieves random GIFs for keywords via the Tenor API (v2)
+ */
+
+package gifmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"thomas-leister.de/plantmonitor/configmanager"
+)
+
+const tenorApiUrl = "https://tenor.googleapis.com/v2/search"
+
+// Number of search results a GIF is chosen from
+const tenorResultLimit = 20
+
+// Tenor content filters by rating
+var tenorContentFilters = map[string]string{
+	configmanager.GifRatingG:  "high",
+	configmanager.GifRatingPG: "medium",
+}
+
+type TenorClient struct {
+	ApiKey     string
+	ClientKey  string // Identifies this application towards Tenor. Optional.
+	Rating     string // Content rating, e.g. "g" or "pg"
+	ApiUrl     string
+	HttpClient *http.Client
+}
+
+type tenorSearchResponse struct {
+	Results []struct {
+		MediaFormats map[string]struct {
+			Url string `json:"url"`
+		} `json:"media_formats"`
+	} `json:"results"`
+}
+
+func NewTenorClient(apiKey string, clientKey string, rating string, timeout time.Duration) *TenorClient {
+	return &TenorClient{
+		ApiKey:     apiKey,
+		ClientKey:  clientKey,
+		Rating:     rating,
+		ApiUrl:     tenorApiUrl,
+		HttpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+func (t *TenorClient) GetGifURL(keywords string) (string, error) {
+	if t.ApiKey == "" {
+		return "", fmt.Errorf("tenor API key is missing")
+	}
+
+	query := url.Values{}
+	query.Set("q", keywords)
+	query.Set("key", t.ApiKey)
+	if t.ClientKey != "" {
+		query.Set("client_key", t.ClientKey)
+	}
+	if contentFilter, exists := tenorContentFilters[t.Rating]; exists {
+		query.Set("contentfilter", contentFilter)
+	}
+	query.Set("media_filter", "mp4")
+	query.Set("random", "true")
+	query.Set("limit", fmt.Sprint(tenorResultLimit))
+
+	response, err := t.HttpClient.Get(t.ApiUrl + "?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("tenor API returned %s", response.Status)
+	}
+
+	var searchResponse tenorSearchResponse
+	if err := json.NewDecoder(response.Body).Decode(&searchResponse); err != nil {
+		return "", fmt.Errorf("could not parse tenor API response: %s", err)
+	}
+
+	var gifUrls []string
+	for _, result := range searchResponse.Results {
+		if mp4, exists := result.MediaFormats["mp4"]; exists && mp4.Url != "" {
+			gifUrls = append(gifUrls, mp4.Url)
+		}
+	}
+	if len(gifUrls) == 0 {
+		return "", fmt.Errorf("tenor returned no GIF for \"%s\"", keywords)
+	}
+
+	return gifUrls[rand.Intn(len(gifUrls))], nil
+}
@@ -5,7 +5,6 @@ go 1.16
 require (
 	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/olekukonko/tablewriter v0.0.5
-	github.com/sanzaru/go-giphy v0.0.0-20211118160211-e9e78e55bc7a
 	gopkg.in/yaml.v2 v2.4.0
 	gosrc.io/xmpp v0.5.1
 )
@@ -6,11 +6,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
 	gifManagerPkg "thomas-leister.de/plantmonitor/gifmanager"
@@ -19,6 +21,7 @@ import (
 	quantifierPkg "thomas-leister.de/plantmonitor/quantifier"
 	reminderPkg "thomas-leister.de/plantmonitor/reminder"
 	sensorPkg "thomas-leister.de/plantmonitor/sensor"
+	statePkg "thomas-leister.de/plantmonitor/state"
 	watchdogPkg "thomas-leister.de/plantmonitor/watchdog"
 	xmppManagerPkg "thomas-leister.de/plantmonitor/xmppmanager"
 )
@@ -29,19 +32,27 @@ var versionString string = "0.0.0"
 /* Global var for config*/
 var config configManagerPkg.Config
 
-func main() {
+/* Max. time to wait for pending messages to be sent on shutdown */
+const shutdownTimeout = 10 * time.Second
+
+/* Number of outgoing messages which can be queued before senders block */
+const xmppOutQueueLen = 100
+
+/*
+ * Runs the plant monitor: Receives sensor values via MQTT and sends notifications via XMPP
+ */
+func runPlantmonitor(configFilePath string, langDirPath string) {
 	var err error
-	var quantifierHistoryExists = false
 
-	mqttMessageChannel := make(chan mqttManagerPkg.MqttDecodedPayload)
-	xmppMessageOutChannel := make(chan interface{})
+	mqttMessageChannel := make(chan mqttManagerPkg.MqttUplinkMessage)
+	xmppMessageOutChannel := make(chan interface{}, xmppOutQueueLen)
 	xmppMessageInChannel := make(chan xmppManagerPkg.XmppInMessage)
 
 	// Welcome message and version
 	log.Printf("Starting Plantmonitor %s ...", versionString)
 
 	// Read config
-	config, err = configManagerPkg.ReadConfig("config.yaml")
+	config, err = configManagerPkg.ReadConfig(configFilePath, langDirPath)
 	if err != nil {
 		log.Fatal("Could not parse config:", err)
 	} else {
@@ -60,9 +71,12 @@ func main() {
 	mqttclient := mqttManagerPkg.MqttClient{}
 	mqttclient.Init(&config)
 
-	// Init Giphy
-	giphyclient := gifManagerPkg.GiphyClient{}
-	giphyclient.Init(config.Giphy.ApiKey)
+	// Init GIF provider (Giphy, Tenor, local GIFs or none)
+	gifManager := gifManagerPkg.GifManager{}
+	if err := gifManager.Init(&config); err != nil {
+		log.Fatal("Could not initialize GIF provider:", err)
+	}
+	gifManagerPkg.Prefetch(&gifManager, &config)
 
 	// Init quantifier
 	quantifier := quantifierPkg.Quantifier{}
@@ -70,19 +84,24 @@ func main() {
 
 	// Init messenger
 	messenger := messengerPkg.Messenger{}
-	err = messenger.Init(&config, xmppMessageOutChannel, xmppMessageInChannel, giphyclient, &sensor)
+	err = messenger.Init(&config, xmppMessageOutChannel, xmppMessageInChannel, &gifManager, &sensor)
 	if err != nil {
 		log.Fatal("Could not initialize messenger:", err)
 	}
+	messenger.PresenceOutChannel = xmppMessageOutChannel
 
 	// Init reminder engine
 	reminder := reminderPkg.Reminder{}
-	reminder.Init(&messenger, &sensor)
+	reminder.Init(&config, &messenger, &sensor)
 
 	// Init watchdog
 	watchdog := watchdogPkg.Watchdog{}
 	watchdog.Init(&config, &messenger)
 
+	// Init data quality checks
+	dataQuality := watchdogPkg.DataQuality{}
+	dataQuality.Init(&config, &messenger)
+
 	/*
 	 * Start signal handler routine
 	 */
@@ -92,77 +111,158 @@ func main() {
 		for range signalChan {
 			fmt.Println("Got a HUP signal! Reloading configuration ...")
 
-			// Read config
-			config, err = configManagerPkg.ReadConfig("config.yaml")
+			// Read and validate new config. Keep old config if new config is broken.
+			newConfig, err := configManagerPkg.ReadConfig(configFilePath, langDirPath)
 			if err != nil {
-				log.Fatal("Could not parse config:", err)
-			} else {
-				log.Println("Config was read and parsed!")
-
-				// Reload parts of other services
-				quantifier.Reload(&config)
-				messenger.Reload(&config)
+				log.Println("Could not reload config. Keeping previous config:", err)
+				continue
 			}
+			config = newConfig
+			log.Println("Config was read and parsed!")
+
+			// Reload parts of other services
+			quantifier.Reload(&config)
+			messenger.Reload(&config)
+			gifManager.Reload(&config)
+			reminder.Reload(&config)
+			watchdog.Reload(&config)
+			dataQuality.Reload(&config)
 		}
 	}()
 
-	// Start a new Goroutine which listens for new messages and sents them over the mqttMessageChannel
-	go mqttclient.RunMQTTListener(mqttMessageChannel)
+	// Shut down on SIGTERM / SIGINT (e.g. "systemctl stop")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// Restore sensor history and level from previous run
+	restoredLevel, levelRestored := restoreState(config.StateFile, &sensor, &quantifier, &messenger)
+
+	// Greet recipients as soon as we are online
+	xmppclient.OnSessionEstablished = func(reconnect bool) {
+		if !reconnect || config.Xmpp.GreetOnReconnect {
+			messenger.SendOnlineMessage()
+		}
+
+		// Summaries of notifications held back before the restart can be sent now
+		if !reconnect {
+			messenger.ScheduleSummaries()
+		}
+	}
 
-	// Start another Goroutine which sends XMPP messages when receiving new XmppTextMessage or XmppGifMessage strings
-	go xmppclient.RunXMPPClient(xmppMessageOutChannel, xmppMessageInChannel)
+	// Start sending XMPP messages when receiving new XmppTextMessage or XmppGifMessage structs
+	err = xmppclient.Start(ctx, xmppMessageOutChannel, xmppMessageInChannel)
+	if err != nil {
+		log.Fatal("Could not start XMPP client:", err)
+	}
 
 	// Start Messenger responder: Responds to incoming XMPP messages
-	go messenger.ResponderLoop()
+	messenger.Start(ctx)
+	reminder.Start(ctx)
+	watchdog.Start(ctx, sensor.LastUpdated)
+
+	// Continue reminding of the restored level
+	if levelRestored {
+		reminder.Set(restoredLevel)
+		messenger.RestoreLevel(restoredLevel)
+	}
+
+	// Start listening for new messages and send them over the mqttMessageChannel
+	err = mqttclient.Start(ctx, mqttMessageChannel)
+	if err != nil {
+		log.Fatal("Could not start MQTT client:", err)
+	}
+
+	// Connect components which process sensor readings
+	monitor := Monitor{
+		Sensor:      &sensor,
+		Quantifier:  &quantifier,
+		Messenger:   &messenger,
+		Reminder:    &reminder,
+		Watchdog:    &watchdog,
+		DataQuality: &dataQuality,
+	}
 
 	/*
-	 * Watch the MQTT channel and receive new messages
+	 * Watch the MQTT channel and receive new messages until a shutdown signal is received
 	 */
-	for mqttMessage := range mqttMessageChannel {
-		log.Println("Received new sensor value via MQTT!")
+	for ctx.Err() == nil {
+		select {
+		case mqttMessage := <-mqttMessageChannel:
+			log.Println("Received new sensor value via MQTT!")
+
+			// Get moistureRaw and frame counter from mqttMessage
+			monitor.ProcessReading(int(mqttMessage.DecodedPayload.MoistureRaw), mqttMessage.DeviceId, mqttMessage.FCnt)
+		case <-ctx.Done():
+		}
+	}
 
-		// Satisfy watchdog
-		watchdog.Reset()
+	log.Println("Got a shutdown signal! Shutting down ...")
 
-		// Decode MQTT message
-		/*mqttDecodedPayload := mqttclient.ParseMqttMessage(mqttMessage)
-		moistureRaw := mqttDecodedPayload.UplinkMessage.DecodedPayload.MoistureRaw*/
+	// Restore default signal behavior: A second signal kills plantmonitor immediately
+	stop()
 
-		// Get moistureRaw from mqttMessage
-		moistureRaw := mqttMessage.MoistureRaw
+	// Stop receiving sensor values and stop timers
+	mqttclient.Stop()
+	watchdog.Stop()
+	reminder.Stop()
+	messenger.Stop()
 
-		// Update current sensor value
-		sensor.UpdateCurrentValue(int(moistureRaw))
-		log.Printf("Raw sensor value: %d  |  Current normalized and filtered value: %d %% \n", moistureRaw, sensor.Normalized.Current.Value)
+	// Say goodbye and send all pending messages
+	messenger.SendOfflineMessage()
+	if err := xmppclient.Stop(shutdownTimeout); err != nil {
+		log.Println("Could not send all pending messages:", err)
+	} else {
+		log.Println("Disconnected from XMPP server")
+	}
 
-		// Save state before first value is evaluated, because then history will exist for sure ;)
-		quantifierHistoryExists = quantifier.HistoryExists()
+	saveState(config.StateFile, &sensor, &quantifier, &messenger)
 
-		// Put current sensor value into quantifier
-		levelDirection, currentLevel, err := quantifier.EvaluateValue(sensor.Normalized.Current.Value)
-		if err != nil {
-			log.Panicf("Error happended during evaluation: %s", err)
-			continue
-		}
+	log.Println("Plantmonitor stopped.")
+}
 
-		/*
-		 * Check if level has changed. Only notify
-		 *     - on level change or
-		 *     - if no history exists (first sensor value was read / quantified)
-		 */
-		if (levelDirection != 0) || (!quantifierHistoryExists) {
-			// Send message via messenger
-			messenger.ResolveLevelToMessage(sensor.Normalized.Current.Value, levelDirection, currentLevel)
-
-			// Stop all reminders for the old level
-			reminder.Stop()
-
-			// If new level demands a reminder, set it:
-			if currentLevel.NotificationInterval != 0 {
-				reminder.Set(currentLevel)
-			}
-		}
+/*
+ * Restores sensor, quantifier and held back notifications from the state file (if configured and existing).
+ * Returns the restored level.
+ */
+func restoreState(stateFilePath string, sensor *sensorPkg.Sensor, quantifier *quantifierPkg.Quantifier, messenger *messengerPkg.Messenger) (quantifierPkg.QuantificationLevel, bool) {
+	if stateFilePath == "" {
+		return quantifierPkg.QuantificationLevel{}, false
+	}
+
+	savedState, err := statePkg.Load(stateFilePath)
+	if err != nil {
+		log.Printf("Could not read state file %s. Starting without history: %s", stateFilePath, err)
+		return quantifierPkg.QuantificationLevel{}, false
+	}
+	if savedState == nil {
+		log.Printf("No state file %s, yet. Starting without history.", stateFilePath)
+		return quantifierPkg.QuantificationLevel{}, false
 	}
 
-	log.Fatal("Plantmonitor failed. Exiting ...")
+	log.Printf("Restoring state saved at %s", savedState.SavedAt.Format(time.RFC3339))
+	sensor.Restore(savedState.Sensor)
+	messenger.Restore(savedState.Messenger)
+	return quantifier.Restore(savedState.Quantifier)
+}
+
+/*
+ * Saves sensor and quantifier state and held back notifications to the state file (if configured)
+ */
+func saveState(stateFilePath string, sensor *sensorPkg.Sensor, quantifier *quantifierPkg.Quantifier, messenger *messengerPkg.Messenger) {
+	if stateFilePath == "" {
+		return
+	}
+
+	currentState := statePkg.State{
+		SavedAt:    time.Now(),
+		Sensor:     sensor.State(),
+		Quantifier: quantifier.State(),
+		Messenger:  messenger.State(),
+	}
+
+	if err := statePkg.Save(stateFilePath, currentState); err != nil {
+		log.Printf("Could not save state to %s: %s", stateFilePath, err)
+		return
+	}
+	log.Printf("Saved state to %s", stateFilePath)
 }
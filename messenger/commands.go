@@ -0,0 +1,232 @@
+/*
+ * Chat commands:
+ * Registry of commands which users can send to the plant via XMPP.
+ * Trigger phrases and descriptions are defined in the language file.
+ */
+
+package messenger
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/gifmanager"
+	"thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+/*
+ * A chat command, e.g. "status".
+ * The command name is always accepted as trigger. Further (localized) triggers
+ * are read from the language file (messages.commands.<name>.triggers).
+ */
+type Command struct {
+	Name    string         // Name of the command. Key in language file.
+	Aliases []string       // Additional triggers, independent of language
+	Handler CommandHandler // Function which is called if command was triggered
+}
+
+type CommandHandler func(request CommandRequest)
+
+/*
+ * A command which was received from a user
+ */
+type CommandRequest struct {
+	Sender  string   // JID of sender
+	Trigger string   // Trigger phrase which matched
+	Args    []string // Whitespace-separated arguments following the trigger phrase
+}
+
+/*
+ * Registers a new command. Commands registered later override commands
+ * with the same name. Needs to be called before Start().
+ */
+func (m *Messenger) RegisterCommand(command Command) {
+	for i, registeredCommand := range m.commands {
+		if registeredCommand.Name == command.Name {
+			m.commands[i] = command
+			return
+		}
+	}
+	m.commands = append(m.commands, command)
+}
+
+/*
+ * Registers commands which are handled by messenger itself
+ */
+func (m *Messenger) registerDefaultCommands() {
+	m.RegisterCommand(Command{Name: "help", Aliases: []string{"?"}, Handler: m.handleHelpCommand})
+	m.RegisterCommand(Command{Name: "status", Handler: m.handleStatusCommand})
+}
+
+/*
+ * Returns all triggers of a command in lower case: name, aliases and triggers from the language files
+ * of the sender's language and the default language
+ */
+func (m *Messenger) commandTriggers(command Command, sender string) []string {
+	triggers := []string{command.Name}
+	triggers = append(triggers, command.Aliases...)
+	triggers = append(triggers, m.MessagesFor(sender).Commands[command.Name].Triggers...)
+	triggers = append(triggers, m.Messages.Commands[command.Name].Triggers...)
+
+	for i := range triggers {
+		triggers[i] = strings.TrimSpace(strings.ToLower(triggers[i]))
+	}
+	return triggers
+}
+
+/*
+ * Finds the command for a message body.
+ * A command matches if the body equals one of its triggers or starts with a trigger
+ * followed by arguments. Longer triggers win, so "snooze all" beats "snooze".
+ */
+func (m *Messenger) matchCommand(body string, sender string) (Command, CommandRequest, bool) {
+	var bestCommand Command
+	var bestRequest CommandRequest
+	var found bool
+
+	simpleBodyString := strings.TrimSpace(strings.ToLower(body))
+
+	for _, command := range m.commands {
+		for _, trigger := range m.commandTriggers(command, sender) {
+			if trigger == "" || (found && len(trigger) <= len(bestRequest.Trigger)) {
+				continue
+			}
+
+			if simpleBodyString == trigger || strings.HasPrefix(simpleBodyString, trigger+" ") {
+				bestCommand = command
+				bestRequest = CommandRequest{
+					Sender:  sender,
+					Trigger: trigger,
+					Args:    strings.Fields(strings.TrimPrefix(simpleBodyString, trigger)),
+				}
+				found = true
+			}
+		}
+	}
+
+	return bestCommand, bestRequest, found
+}
+
+/*
+ * Resolves a message body to a command and runs the command's handler
+ */
+func (m *Messenger) handleCommand(body string, sender string) {
+	command, request, found := m.matchCommand(body, sender)
+	if !found {
+		log.Println("Messenger: Unknown command. Sending help info")
+		m.Reply(sender, m.MessagesFor(sender).Answers.UnknownCommand)
+		return
+	}
+
+	log.Printf("Messenger: Running command '%s' with args %v\n", command.Name, request.Args)
+	command.Handler(request)
+}
+
+/*
+ * Sends a text message to a single recipient
+ */
+func (m *Messenger) Reply(recipient string, text string) {
+	m.XmppMessageOutChannel <- xmppmanager.XmppTextMessage{Recipients: []string{recipient}, Text: text}
+}
+
+/*
+ * Renders a text in one language
+ */
+type TextRenderer func(messages *configmanager.Messages) (string, error)
+
+/*
+ * Sends an informational text message to some recipients in their language. No recipients = all recipients.
+ * Unlike Reply(), the message is held back during the recipients' quiet hours.
+ */
+func (m *Messenger) SendText(recipients []string, render TextRenderer) {
+	m.notify(NotificationInfo, recipients, func(messages *configmanager.Messages) (string, string) {
+		text, err := render(messages)
+		if err != nil {
+			log.Println("Messenger: Could not render text:", err)
+		}
+		return text, ""
+	})
+}
+
+/*
+ * Returns all recipients except the given one, e.g. to let others know about an answer
+ */
+func (m *Messenger) OtherRecipients(recipient string) []string {
+	var otherRecipients []string
+
+	for _, permittedSender := range m.PermittedSenders {
+		if permittedSender != recipient {
+			otherRecipients = append(otherRecipients, permittedSender)
+		}
+	}
+	return otherRecipients
+}
+
+/*
+ * Help: Lists all registered commands with their first trigger and description
+ */
+func (m *Messenger) handleHelpCommand(request CommandRequest) {
+	log.Println("Messenger: Sending help menu")
+	m.Reply(request.Sender, m.helpText(request.Sender))
+}
+
+// Renders the help in the language of the recipient
+func (m *Messenger) helpText(recipient string) string {
+	var lines []string
+	messages := m.MessagesFor(recipient)
+
+	for _, command := range m.commands {
+		commandMessages := messages.Commands[command.Name]
+
+		// Show first localized trigger, fall back to command name
+		trigger := command.Name
+		if len(commandMessages.Triggers) > 0 {
+			trigger = commandMessages.Triggers[0]
+		}
+		if commandMessages.Usage != "" {
+			trigger += " " + commandMessages.Usage
+		}
+
+		line := "- \"" + trigger + "\""
+		if commandMessages.Description != "" {
+			line += ": " + commandMessages.Description
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+
+	return strings.TrimSpace(messages.Answers.AvailableCommands) + "\n" + strings.Join(lines, "\n")
+}
+
+/*
+ * Status: Sends current sensor value (if there is any) and how many GIF requests failed
+ */
+func (m *Messenger) handleStatusCommand(request CommandRequest) {
+	log.Println("Messenger: Sending health info")
+
+	messages := m.MessagesFor(request.Sender)
+
+	// If we have valid data, send them
+	if !m.Sensor.Normalized.History.Valid {
+		m.Reply(request.Sender, messages.Answers.SensorDataUnavailable)
+		return
+	}
+
+	answerParams := CurrentStateAnswerParams{
+		SensorValue: m.Sensor.Normalized.Current.Value,
+		LastUpdated: m.Sensor.LastUpdated,
+	}
+	if reporter, ok := m.GifProvider.(gifmanager.StatsReporter); ok {
+		answerParams.GifRequests, answerParams.GifFailures = reporter.Stats()
+	}
+
+	answerText, err := m.RenderText(messages, messages.Answers.CurrentState, answerParams)
+	if err != nil {
+		log.Println("Messenger: Could not render answer:", err)
+		return
+	}
+
+	m.Reply(request.Sender, answerText)
+}
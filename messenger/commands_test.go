@@ -0,0 +1,368 @@
+package messenger
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	clockPkg "thomas-leister.de/plantmonitor/clock"
+	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/gifmanager"
+	quantifierPkg "thomas-leister.de/plantmonitor/quantifier"
+	sensorPkg "thomas-leister.de/plantmonitor/sensor"
+	testingInit "thomas-leister.de/plantmonitor/testing_init"
+	"thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+const TEST_SENDER = "recipient1@my.xmpp.host"
+
+type testFixture struct {
+	Config     *configManagerPkg.Config
+	Sensor     *sensorPkg.Sensor
+	Messenger  *Messenger
+	Clock      *clockPkg.Virtual // Starts at testing_init.StartTime
+	OutChannel chan interface{}  // Messages sent by the messenger
+}
+
+/*
+ * Creates a messenger from config.example.yaml. configure may adjust the config before (optional).
+ * Same as messengertest.New, which cannot be used here without an import cycle.
+ */
+func newTestMessenger(t *testing.T, configure func(config *configManagerPkg.Config)) *testFixture {
+	t.Helper()
+
+	config, err := configManagerPkg.ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		t.Fatalf("Could not parse config: %s", err)
+	}
+	if configure != nil {
+		configure(&config)
+	}
+
+	sensor := sensorPkg.Sensor{}
+	sensor.Init(&config)
+
+	outChannel := make(chan interface{}, 100)
+	messenger := Messenger{}
+	if err := messenger.Init(&config, outChannel, nil, gifmanager.NoopProvider{}, &sensor); err != nil {
+		t.Fatalf("Could not init messenger: %s", err)
+	}
+	clock := clockPkg.NewVirtual(testingInit.StartTime)
+	messenger.Clock = clock
+
+	return &testFixture{
+		Config:     &config,
+		Sensor:     &sensor,
+		Messenger:  &messenger,
+		Clock:      clock,
+		OutChannel: outChannel,
+	}
+}
+
+/*
+ * Commands are matched by name, aliases and localized triggers. Arguments are passed to the handler.
+ */
+func TestHandleCommand(t *testing.T) {
+	fixture := newTestMessenger(t, nil)
+	config, messenger, xmppMessageOutChannel := fixture.Config, fixture.Messenger, fixture.OutChannel
+
+	// Register a command with arguments
+	var echoArgs []string
+	messenger.RegisterCommand(Command{Name: "echo", Handler: func(request CommandRequest) {
+		echoArgs = request.Args
+		messenger.Reply(request.Sender, "echoed")
+	}})
+
+	testcases := map[string]string{
+		"Wie geht's dir?": config.Messages.Answers.SensorDataUnavailable, // Localized trigger, case-insensitive
+		" status ":        config.Messages.Answers.SensorDataUnavailable, // Command name
+		"hilfe":           config.Messages.Answers.AvailableCommands,     // Help starts with list header
+		"echo hello 2h":   "echoed",
+		"do something":    config.Messages.Answers.UnknownCommand,
+	}
+
+	for body, expectedAnswer := range testcases {
+		messenger.handleCommand(body, TEST_SENDER)
+
+		answer := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage)
+		if !strings.HasPrefix(answer.Text, expectedAnswer) {
+			t.Errorf("Message \"%s\": Expected answer \"%s\". Got \"%s\"", body, expectedAnswer, answer.Text)
+		}
+		if len(answer.Recipients) != 1 || answer.Recipients[0] != TEST_SENDER {
+			t.Errorf("Message \"%s\": Expected answer to be sent to %s. Got %v", body, TEST_SENDER, answer.Recipients)
+		}
+	}
+
+	if len(echoArgs) != 2 || echoArgs[0] != "hello" || echoArgs[1] != "2h" {
+		t.Errorf("Expected echo args [hello 2h]. Got %v", echoArgs)
+	}
+
+	// Help lists all commands with their first localized trigger
+	helpText := messenger.helpText(TEST_SENDER)
+	for _, expectedLine := range []string{"- \"wie geht's dir?\"", "- \"hilfe\"", "- \"echo\""} {
+		if !strings.Contains(helpText, expectedLine) {
+			t.Errorf("Expected help to contain %s. Got:\n%s", expectedLine, helpText)
+		}
+	}
+}
+
+/*
+ * Recipients can unsubscribe from event types and turn off GIFs via chat. Preferences survive a restart.
+ */
+func TestPreferencesCommands(t *testing.T) {
+	preferencesFile := filepath.Join(t.TempDir(), "preferences.json")
+	usePreferencesFile := func(config *configManagerPkg.Config) {
+		config.PreferencesFile = preferencesFile
+		useQuietHours(config)
+	}
+
+	fixture := newTestMessenger(t, usePreferencesFile)
+	messenger, xmppMessageOutChannel := fixture.Messenger, fixture.OutChannel
+
+	for _, body := range []string{"unsubscribe reminders", "gifs aus", "ruhezeit 21:00-06:00", "abbestellen foo"} {
+		messenger.handleCommand(body, TEST_SENDER)
+		<-xmppMessageOutChannel
+	}
+
+	// Reminders are not sent to recipient1 anymore
+	messenger.notify(NotificationReminder, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return "reminder", ""
+	})
+	reminder := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage)
+	if strings.Join(reminder.Recipients, ",") != "recipient2@my.xmpp.host" {
+		t.Errorf("Expected reminder to be sent to recipient2 only. Got %v", reminder.Recipients)
+	}
+
+	// Level changes are sent to all recipients, GIFs only to recipients who want them (nobody)
+	messenger.notify(NotificationLevelChange, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return "level change", "https://example.org/plant.gif"
+	})
+	if levelChange := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage); len(levelChange.Recipients) != 0 {
+		t.Errorf("Expected level change to be sent to all recipients. Got %v", levelChange.Recipients)
+	}
+	if len(xmppMessageOutChannel) != 0 {
+		t.Errorf("Expected no GIF to be sent. Got %v", <-xmppMessageOutChannel)
+	}
+
+	// Preferences are loaded from file after restart
+	restarted := newTestMessenger(t, usePreferencesFile).Messenger
+	if restarted.Preferences.Subscribed(TEST_SENDER, configManagerPkg.EventReminder) {
+		t.Error("Expected recipient1 to be unsubscribed from reminders after restart")
+	}
+	if restarted.Preferences.Gifs(TEST_SENDER) {
+		t.Error("Expected GIFs to be off for recipient1 after restart")
+	}
+	if quietHours := restarted.Preferences.QuietHours(TEST_SENDER); quietHours.Start != "21:00" || quietHours.End != "06:00" || quietHours.Timezone != "Europe/Berlin" {
+		t.Errorf("Expected quiet hours 21:00-06:00 Europe/Berlin after restart. Got %+v", quietHours)
+	}
+}
+
+// GIF provider which only reports request stats
+type statsProvider struct {
+	gifmanager.NoopProvider
+	requests uint64
+	failures uint64
+}
+
+func (p statsProvider) Stats() (uint64, uint64) {
+	return p.requests, p.failures
+}
+
+/*
+ * The status shows the current sensor value and failed GIF requests, if the GIF provider counts them
+ */
+func TestStatusCommand(t *testing.T) {
+	fixture := newTestMessenger(t, nil)
+	messenger, xmppMessageOutChannel := fixture.Messenger, fixture.OutChannel
+	fixture.Sensor.Normalized.History.Valid = true
+	fixture.Sensor.Normalized.Current.Value = 42
+
+	expectedStatus := map[gifmanager.GifProvider]string{
+		gifmanager.NoopProvider{}:                "Bodenfeuchte: 42 %\nZeit: ",
+		statsProvider{requests: 10, failures: 3}: "\nGIFs: 3 von 10 Abrufen fehlgeschlagen",
+	}
+	for provider, expected := range expectedStatus {
+		messenger.GifProvider = provider
+		messenger.handleCommand("status", TEST_SENDER)
+
+		status := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage).Text
+		if !strings.Contains(status, expected) {
+			t.Errorf("Provider %T: Expected status containing \"%s\". Got \"%s\"", provider, expected, status)
+		}
+		if _, counts := provider.(gifmanager.StatsReporter); !counts && strings.Contains(status, "GIFs") {
+			t.Errorf("Expected no GIF stats without counting provider. Got \"%s\"", status)
+		}
+	}
+}
+
+/*
+ * Recipients who listed plants in their settings or via chat are only notified about these plants
+ */
+func TestPlantFilter(t *testing.T) {
+	fixture := newTestMessenger(t, func(config *configManagerPkg.Config) {
+		config.PlantName = "Monstera"
+		recipientSettings := config.Xmpp.RecipientSettings["recipient2@my.xmpp.host"]
+		recipientSettings.Plants = []string{"Ficus"}
+		config.Xmpp.RecipientSettings["recipient2@my.xmpp.host"] = recipientSettings
+	})
+	config, messenger, xmppMessageOutChannel := fixture.Config, fixture.Messenger, fixture.OutChannel
+
+	messenger.notify(NotificationLevelChange, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return "level change", ""
+	})
+	levelChange := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage)
+	for _, recipient := range levelChange.Recipients {
+		if recipient == "recipient2@my.xmpp.host" {
+			t.Errorf("Expected recipient2 not to be notified about Monstera. Got %v", levelChange.Recipients)
+		}
+	}
+	if len(levelChange.Recipients) == 0 {
+		t.Error("Expected level change to be sent to some recipients only")
+	}
+
+	// Plants chosen via chat replace the configured ones
+	expectLevelChangeTo := func(expected string) {
+		t.Helper()
+		messenger.notify(NotificationLevelChange, nil, func(messages *configManagerPkg.Messages) (string, string) {
+			return "level change", ""
+		})
+		if recipients := strings.Join((<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage).Recipients, ","); recipients != expected {
+			t.Errorf("Expected level change to %s. Got %s", expected, recipients)
+		}
+	}
+	for _, command := range []struct{ body, sender string }{
+		{"pflanzen Ficus, monstera", "recipient2@my.xmpp.host"},
+		{"pflanzen Ficus", TEST_SENDER},
+	} {
+		messenger.handleCommand(command.body, command.sender)
+		if answer := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage).Text; !strings.Contains(strings.ToLower(answer), "pflanzen: ficus") {
+			t.Errorf("Expected chosen plants in answer. Got \"%s\"", answer)
+		}
+	}
+	expectLevelChangeTo("recipient2@my.xmpp.host")
+
+	messenger.handleCommand("pflanzen alle", TEST_SENDER)
+	<-xmppMessageOutChannel
+	messenger.handleCommand("pflanzen standard", "recipient2@my.xmpp.host")
+	<-xmppMessageOutChannel
+	expectLevelChangeTo(TEST_SENDER)
+
+	// plant_name is needed to filter by plant
+	config.PlantName = ""
+	if err := configManagerPkg.ValidateConfig(config); err == nil || !strings.Contains(err.Error(), "plant_name") {
+		t.Errorf("Expected validation error about plant_name. Got %v", err)
+	}
+}
+
+/*
+ * Notifications are rendered in the language of each recipient
+ */
+func TestLanguages(t *testing.T) {
+	fixture := newTestMessenger(t, func(config *configManagerPkg.Config) {
+		// Language which only differs in the moisture suffix
+		english := *config.Catalog[config.LangCode]
+		english.Formats.MoistureSuffix = " \nMoisture: {{.SensorValue}} %"
+		config.Catalog["en"] = &english
+	})
+	config, messenger, xmppMessageOutChannel := fixture.Config, fixture.Messenger, fixture.OutChannel
+
+	// Unknown language is rejected
+	messenger.handleCommand("sprache xx", TEST_SENDER)
+	<-xmppMessageOutChannel
+	if language := messenger.Preferences.Language(TEST_SENDER); language != config.LangCode {
+		t.Errorf("Expected language %s after choosing unknown language. Got %s", config.LangCode, language)
+	}
+
+	messenger.handleCommand("language en", TEST_SENDER)
+	<-xmppMessageOutChannel
+
+	messenger.notify(NotificationLevelChange, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return messenger.renderLevelMessage(messages, "", MessageParams{SensorValue: 42}), ""
+	})
+
+	expectedTexts := map[string]string{
+		TEST_SENDER:               " \nMoisture: 42 %",
+		"recipient2@my.xmpp.host": " \nBodenfeuchte: 42 %",
+	}
+	for i := 0; i < len(expectedTexts); i++ {
+		textMessage := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage)
+		if len(textMessage.Recipients) != 1 {
+			t.Fatalf("Expected one recipient per language. Got %v", textMessage.Recipients)
+		}
+		if expectedText := expectedTexts[textMessage.Recipients[0]]; textMessage.Text != expectedText {
+			t.Errorf("%s: Expected \"%s\". Got \"%s\"", textMessage.Recipients[0], expectedText, textMessage.Text)
+		}
+	}
+}
+
+/*
+ * Level messages and reminders are templates with a common data model
+ */
+func TestLevelMessageTemplates(t *testing.T) {
+	fixture := newTestMessenger(t, func(config *configManagerPkg.Config) {
+		config.PlantName = "Monstera"
+
+		messages := *config.Catalog[config.LangCode]
+		messages.Levels = map[string]configManagerPkg.MessageType{
+			"normal_down":  {Messages: []string{"{{.PlantName}}: {{if .PreviousLevel}}{{.PreviousLevel}} => {{end}}{{.Level}} ({{.Direction}})"}},
+			"low_down":     {Messages: []string{"{{.PlantName}}: {{if .PreviousLevel}}{{.PreviousLevel}} => {{end}}{{.Level}} ({{.Direction}})"}},
+			"low_reminder": {Messages: []string{"#{{.ReminderCount}}: {{.SensorValue}} %, watered {{ago .LastWatering}}"}},
+		}
+		messages.Formats.MoistureSuffix = ""
+		messages.Durations.Ago = "{{.}} ago"
+		messages.Durations.Hours = "hours"
+		config.Catalog[config.LangCode] = &messages
+	})
+	messenger, xmppMessageOutChannel := fixture.Messenger, fixture.OutChannel
+	fixture.Sensor.Watering.LastWatering = testingInit.StartTime.Add(-5 * time.Hour)
+
+	levels := map[string]quantifierPkg.QuantificationLevel{}
+	for _, level := range quantifierPkg.LevelsFromConfig(fixture.Config) {
+		levels[level.Name] = level
+	}
+
+	messenger.ResolveLevelToMessage(50, -1, levels["normal"])
+	messenger.ResolveLevelToMessage(25, -1, levels["low"])
+	messenger.SendReminder(levels["low"], 25, nil, 2)
+
+	expectedTexts := []string{
+		"Monstera: normal (down)", // No previous level yet
+		"Monstera: normal => low (down)",
+		"#2: 25 %, watered 5 hours ago",
+	}
+	for _, expectedText := range expectedTexts {
+		textMessage := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage)
+		if textMessage.Text != expectedText {
+			t.Errorf("Expected \"%s\". Got \"%s\"", expectedText, textMessage.Text)
+		}
+	}
+}
+
+/*
+ * Online and offline messages are rendered templates
+ */
+func TestOnlineOfflineMessages(t *testing.T) {
+	fixture := newTestMessenger(t, func(config *configManagerPkg.Config) {
+		config.PlantName = "Monstera"
+
+		messages := *config.Catalog[config.LangCode]
+		messages.Online = []string{"{{.PlantName}} is online"}
+		messages.Offline = []string{"{{.PlantName}} is going offline"}
+		config.Catalog[config.LangCode] = &messages
+	})
+	messenger, xmppMessageOutChannel := fixture.Messenger, fixture.OutChannel
+
+	messenger.SendOnlineMessage()
+	messenger.SendOfflineMessage()
+
+	for _, expectedText := range []string{"Monstera is online", "Monstera is going offline"} {
+		textMessage := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage)
+		if textMessage.Text != expectedText {
+			t.Errorf("Expected \"%s\". Got \"%s\"", expectedText, textMessage.Text)
+		}
+		if len(textMessage.Recipients) != 0 {
+			t.Errorf("Expected broadcast. Got %v", textMessage.Recipients)
+		}
+	}
+}
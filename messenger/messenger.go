@@ -5,17 +5,18 @@
 package messenger
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
-	"strconv"
 	"strings"
-	"text/template"
+	"sync"
 	"time"
 
+	"thomas-leister.de/plantmonitor/clock"
 	"thomas-leister.de/plantmonitor/configmanager"
 	"thomas-leister.de/plantmonitor/gifmanager"
+	"thomas-leister.de/plantmonitor/preferences"
 	"thomas-leister.de/plantmonitor/quantifier"
 	"thomas-leister.de/plantmonitor/sensor"
 	"thomas-leister.de/plantmonitor/xmppmanager"
@@ -24,28 +25,125 @@ import (
 type Messenger struct {
 	XmppMessageOutChannel chan interface{}
 	XmppMessageInChannel  chan xmppmanager.XmppInMessage // XMPP channel for incoming messages
-	GiphyClient           gifmanager.GiphyClient
-	Messages              *configmanager.Messages
+	PresenceOutChannel    chan interface{}               // Receives XmppPresence updates. Optional, nil = no presence.
+	GifProvider           gifmanager.GifProvider
+	Clock                 clock.Clock                        // Clock for quiet hours
+	Messages              *configmanager.Messages            // Messages of the default language
+	Catalog               map[string]*configmanager.Messages // Messages of all languages by language code
 	Sensor                *sensor.Sensor
 	PermittedSenders      []string
+	Admins                []string           // Recipients of technical warnings
+	Preferences           *preferences.Store // Subscriptions, GIFs and quiet hours per recipient
+	PlantName             string
 
-	Templates struct {
-		CurrentStateAnswer   *template.Template
-		WarningSensorOffline *template.Template
-	}
+	commands []Command // Registered chat commands
+
+	quietHoursMutex  sync.Mutex
+	quietHours       map[string]recipientQuietHours // Quiet hours per recipient JID
+	quietHoursQueues map[string]*quietHoursQueue    // Notifications held back per recipient JID
+
+	levelMutex     sync.Mutex
+	currentLevel   quantifier.QuantificationLevel // Level of the last level message
+	previousLevel  quantifier.QuantificationLevel // Level before that
+	offlineDevices map[string]bool                // Devices for which the watchdog has fired
 }
 
 type CurrentStateAnswerParams struct {
 	SensorValue int
 	LastUpdated time.Time
+	GifRequests uint64 // Requests to the GIF provider so far. 0 if the provider does not count them.
+	GifFailures uint64 // Failed requests to the GIF provider so far
 }
 
 type WarningSensorOfflineParams struct {
-	Timeout time.Duration
+	Device        string        // ID of the sensor device. Empty if unknown.
+	Timeout       time.Duration // Time since the last sensor reading
+	MissedUplinks int           // Number of missed uplinks. 0 if the uplink interval is unknown.
+}
+
+type WarningSensorOnlineParams struct {
+	Device string        // ID of the sensor device. Empty if unknown.
+	Outage time.Duration // Time between the last reading before the outage and the first reading after it
+}
+
+type WarningFrameCounterGapParams struct {
+	LostUplinks int // Number of uplinks which got lost according to the frame counter
+}
+
+type WarningSensorStuckParams struct {
+	RawValue int           // Raw value the sensor keeps sending
+	Duration time.Duration // Time since the raw value last changed
+}
+
+type WarningSensorPinnedParams struct {
+	RawValue int // Raw value at or beyond the bound of the calibrated range
+	Readings int // Number of consecutive readings at the bound
+}
+
+type WarningVarianceCollapseParams struct {
+	StdDev   string // Standard deviation of the recent raw values, formatted
+	Readings int    // Number of recent raw values
+}
+
+type WarningValueUnquantifiableParams struct {
+	SensorValue int
+	Reason      string
+}
+
+/*
+ * Data available in level messages, reminders, online messages and the moisture suffix
+ */
+type MessageParams struct {
+	PlantName           string
+	SensorValue         int           // Current moisture (%)
+	PreviousSensorValue int           // Moisture (%) of the previous reading
+	Level               string        // Current level name
+	LevelName           string        // Name of the current level in the recipient's language (level_names)
+	PreviousLevel       string        // Level before the last level change. Empty if unknown.
+	PreviousLevelName   string        // Name of the previous level in the recipient's language. Empty if unknown.
+	Direction           string        // up | steady | down | reminder. Empty for online messages.
+	LastWatering        time.Time     // Time of last detected watering. Zero if unknown.
+	SinceLastWatering   time.Duration // Time since last detected watering. Zero if unknown.
+	ReminderCount       int           // Number of this reminder since the level was reached. Zero if no reminder.
+	Forecast            time.Duration // Estimated time until the moisture falls below the current level. Zero if unknown.
+	Now                 time.Time
+}
+
+/*
+ * Starts responding to incoming messages until ctx is done
+ */
+func (m *Messenger) Start(ctx context.Context) {
+	go m.responderLoop(ctx)
+}
+
+/*
+ * Stops the quiet hours timers. Notifications which are held back are kept,
+ * so that they can be saved via State().
+ * Messages can still be sent afterwards, e.g. the offline message.
+ */
+func (m *Messenger) Stop() {
+	m.quietHoursMutex.Lock()
+	defer m.quietHoursMutex.Unlock()
+
+	for recipient, queue := range m.quietHoursQueues {
+		if queue.timer != nil {
+			queue.timer.Stop()
+			queue.timer = nil
+		}
+		log.Printf("Messenger: Keeping %d notification(s) held back for %s\n", len(queue.events)+queue.suppressedReminders, recipient)
+	}
 }
 
-func (m *Messenger) ResponderLoop() {
-	for xmppMessage := range m.XmppMessageInChannel {
+func (m *Messenger) responderLoop(ctx context.Context) {
+	for {
+		var xmppMessage xmppmanager.XmppInMessage
+
+		select {
+		case <-ctx.Done():
+			return
+		case xmppMessage = <-m.XmppMessageInChannel:
+		}
+
 		var senderFrom = xmppMessage.From
 		var permitted bool = false
 
@@ -70,140 +168,152 @@ func (m *Messenger) ResponderLoop() {
 			continue
 		}
 
-		// Set recipient(s) of the response (= sender of this message)
-		recipients := []string{senderJID}
-
-		// Cimplify body message to be able to understand intention
-		simpleBodyString := strings.TrimSpace(strings.ToLower(xmppMessage.Body))
-
-		if simpleBodyString != "" {
-			if simpleBodyString == "help" {
-				log.Println("Messenger: Sending help menu")
-				m.XmppMessageOutChannel <- xmppmanager.XmppTextMessage{Recipients: recipients, Text: m.Messages.Answers.AvailableCommands}
-			} else if simpleBodyString == "wie geht's dir?" {
-				// If we have valid data, send them
-				log.Println("Messenger: Sending health info")
-				if m.Sensor.Normalized.History.Valid {
-					var messageStringBuffer bytes.Buffer
-
-					answerParams := CurrentStateAnswerParams{
-						SensorValue: m.Sensor.Normalized.Current.Value,
-						LastUpdated: m.Sensor.LastUpdated,
-					}
-
-					err := m.Templates.CurrentStateAnswer.Execute(&messageStringBuffer, answerParams)
-					if err != nil {
-						panic(err)
-					}
-
-					// Respond via out channel
-					m.XmppMessageOutChannel <- xmppmanager.XmppTextMessage{
-						Recipients: recipients,
-						Text:       messageStringBuffer.String(),
-					}
-				} else {
-					m.XmppMessageOutChannel <- xmppmanager.XmppTextMessage{Recipients: recipients, Text: m.Messages.Answers.SensorDataUnavailable}
-				}
-			} else {
-				log.Println("Messenger: Sending help info")
-				m.XmppMessageOutChannel <- xmppmanager.XmppTextMessage{Recipients: recipients, Text: m.Messages.Answers.UnknownCommand}
-			}
-		} else {
+		if strings.TrimSpace(xmppMessage.Body) == "" {
 			log.Println("Messenger: [Dropped message because it does not contain body]")
+			continue
 		}
+
+		// Find and run command. Answer goes to the sender of this message.
+		m.handleCommand(xmppMessage.Body, senderJID)
 	}
 }
 
 /*
  * Init messenger and set
  * - xmppMessageChannel to use
- * - Giphy client to use
+ * - GIF provider to use
  */
-func (m *Messenger) Init(config *configmanager.Config, xmppMessageOutChannel chan interface{}, xmppMessageInChannel chan xmppmanager.XmppInMessage, giphyClient gifmanager.GiphyClient, sensor *sensor.Sensor) error {
+func (m *Messenger) Init(config *configmanager.Config, xmppMessageOutChannel chan interface{}, xmppMessageInChannel chan xmppmanager.XmppInMessage, gifProvider gifmanager.GifProvider, sensor *sensor.Sensor) error {
 	var err error
 
 	log.Println("Initializing messenger ...")
 
 	m.XmppMessageOutChannel = xmppMessageOutChannel
 	m.XmppMessageInChannel = xmppMessageInChannel
-	m.GiphyClient = giphyClient
+	m.GifProvider = gifProvider
 	m.Sensor = sensor
-	m.PermittedSenders = config.Xmpp.Recipients
+	m.PermittedSenders = append(append([]string{}, config.Xmpp.Recipients...), config.RoomJids()...)
+	m.Clock = clock.Real{}
+	m.loadAdmins(config)
+	m.quietHoursQueues = make(map[string]*quietHoursQueue)
+
+	m.Preferences = &preferences.Store{}
+	err = m.Preferences.Init(config)
+	if err != nil {
+		return fmt.Errorf("could not load preferences: %s", err)
+	}
 
-	err = m.loadMessages(config)
+	err = m.loadQuietHours()
 	if err != nil {
 		return err
 	}
 
+	m.loadMessages(config)
+
+	m.registerDefaultCommands()
+	m.registerPreferencesCommands()
+
 	return nil
 }
 
-func (m *Messenger) loadMessages(config *configmanager.Config) error {
-	var err error
-	m.Messages = &config.Messages
-
-	// Load message strings and parse templates
-	m.Templates.CurrentStateAnswer, err = template.New("").Parse(config.Messages.Answers.CurrentState)
-	if err != nil {
-		return fmt.Errorf("failed to parse template for messages.answers.current_state: %s", err)
+// Technical warnings go to admins. If no admins are configured, all recipients are admins.
+func (m *Messenger) loadAdmins(config *configmanager.Config) {
+	m.Admins = config.Xmpp.Admins
+	if len(m.Admins) == 0 {
+		m.Admins = config.Xmpp.Recipients
 	}
+}
 
-	m.Templates.WarningSensorOffline, err = template.New("").Parse(config.Messages.Warnings.SensorOffline)
-	if err != nil {
-		return fmt.Errorf("failed to parse template for messages.warnings.sensor_offline: %s", err)
+/*
+ * Loads messages of all languages.
+ * Templates have been checked by configmanager.ValidateConfig() already.
+ */
+func (m *Messenger) loadMessages(config *configmanager.Config) {
+	catalog := config.Catalog
+	if catalog == nil {
+		catalog = map[string]*configmanager.Messages{config.LangCode: &config.Messages}
 	}
 
-	return nil
+	m.Messages = catalog[config.LangCode]
+	m.Catalog = catalog
+	m.PlantName = config.PlantName
+}
+
+/*
+ * Returns the messages in the language of a recipient.
+ * Falls back to the default language if the recipient's language is unavailable.
+ */
+func (m *Messenger) MessagesFor(recipient string) *configmanager.Messages {
+	return m.messagesForLanguage(m.Preferences.Language(recipient))
+}
+
+func (m *Messenger) messagesForLanguage(langCode string) *configmanager.Messages {
+	if messages, exists := m.Catalog[langCode]; exists {
+		return messages
+	}
+	return m.Messages
 }
 
 func (m *Messenger) Reload(config *configmanager.Config) {
 	log.Println("Messenger: Reloading messages")
+	m.loadAdmins(config)
+	m.Preferences.Reload(config)
+	if err := m.loadQuietHours(); err != nil {
+		log.Println("Messenger: Could not reload quiet hours:", err)
+	}
 	m.loadMessages(config)
 }
 
+/*
+ * Returns the message type identifier for a level and direction,
+ * e.g. normal_steady, normal_up, normal_down, high_reminder, ... (just as in YAML config)
+ */
+func messageType(levelName string, levelDirection int, reminder bool) string {
+	if reminder {
+		return levelName + "_reminder"
+	}
+	return levelName + "_" + directionName(levelDirection)
+}
+
+func directionName(levelDirection int) string {
+	switch levelDirection {
+	case 1:
+		return "up"
+	case -1:
+		return "down"
+	default:
+		return "steady"
+	}
+}
+
 /*
  * Input:
+ *  - Messages of the language to use
  * 	- A level name
  *  - Level direction (+1, 0 , -1)
  *  - Whether this is a reminder (bool)
+ * Returns a random message template for the level and a GIF URL
  */
-func (m *Messenger) GetMessage(levelName string, levelDirection int, reminder bool) (string, string, error) {
-	var levelDirectionString string = "steady"
+func (m *Messenger) GetMessage(messages *configmanager.Messages, levelName string, levelDirection int, reminder bool) (string, string, error) {
 	var responseMessage string
 	var gifUrl string
-	var err error
 
-	if !reminder {
-		if levelDirection == 1 {
-			levelDirectionString = "up"
-		} else if levelDirection == 0 {
-			levelDirectionString = "steady"
-		} else if levelDirection == -1 {
-			levelDirectionString = "down"
-		}
-	} else {
-		levelDirectionString = "reminder"
-	}
-
-	// Build message type identifier, e.g. normal_steady, normal_up, normal_down, high_reminder, ... (just as in YAML config)
-	messageTypeString := levelName + "_" + levelDirectionString
+	messageTypeString := messageType(levelName, levelDirection, reminder)
 	log.Printf("Messenger: Getting message for type %s\n", messageTypeString)
 
 	// Get messages array
-	if messageType, exists := m.Messages.Levels[messageTypeString]; exists {
-		messages := messageType.Messages
+	if messageType, exists := messages.Levels[messageTypeString]; exists {
+		levelMessages := messageType.Messages
 
 		// Choose one random message from the messages array if array is not empty
-		if messagesNum := len(messages); messagesNum > 0 {
-			responseMessage = messages[rand.Intn(messagesNum)]
+		if messagesNum := len(levelMessages); messagesNum > 0 {
+			responseMessage = levelMessages[rand.Intn(messagesNum)]
 
 			// Choose a GIF
 			gifKeywords := messageType.GifKeywords
-			if gifKeywords != "" {
-				gifUrl, err = m.GiphyClient.GetGifURL(gifKeywords)
-				if err != nil {
-					fmt.Errorf("Messenger: Could not retrieve GIF URL from gifmanager: %s", err)
-				}
+			if gifKeywords != "" && m.GifProvider != nil {
+				// Failures are logged by gifmanager. The message is sent without GIF.
+				gifUrl, _ = m.GifProvider.GetGifURL(gifKeywords)
 			}
 		} else {
 			responseMessage = fmt.Sprintf("[ERROR: No messages are defined for message type %s!]\n", messageTypeString)
@@ -217,6 +327,64 @@ func (m *Messenger) GetMessage(levelName string, levelDirection int, reminder bo
 	return responseMessage, gifUrl, nil
 }
 
+/*
+ * Collects the data for level messages, reminders and online messages
+ */
+func (m *Messenger) messageParams(level quantifier.QuantificationLevel, direction string) MessageParams {
+	m.levelMutex.Lock()
+	previousLevel := m.previousLevel.Name
+	m.levelMutex.Unlock()
+
+	params := MessageParams{
+		PlantName:           m.PlantName,
+		SensorValue:         m.Sensor.Normalized.Current.Value,
+		PreviousSensorValue: m.Sensor.Normalized.History.LastValue,
+		Level:               level.Name,
+		PreviousLevel:       previousLevel,
+		Direction:           direction,
+		LastWatering:        m.Sensor.Watering.LastWatering,
+		Now:                 m.Clock.Now(),
+	}
+
+	if !params.LastWatering.IsZero() {
+		params.SinceLastWatering = params.Now.Sub(params.LastWatering)
+	}
+	if forecast, ok := m.Sensor.TimeUntilBelow(level.Start); ok {
+		params.Forecast = forecast
+	}
+
+	return params
+}
+
+// Returns params with the level names in the language of messages
+func (p MessageParams) localized(messages *configmanager.Messages) MessageParams {
+	p.LevelName = messages.LevelName(p.Level)
+	if p.PreviousLevel != "" {
+		p.PreviousLevelName = messages.LevelName(p.PreviousLevel)
+	}
+	return p
+}
+
+/*
+ * Renders a level message template and appends the moisture suffix
+ */
+func (m *Messenger) renderLevelMessage(messages *configmanager.Messages, templateText string, params MessageParams) string {
+	params = params.localized(messages)
+
+	text, err := m.RenderText(messages, templateText, params)
+	if err != nil {
+		log.Printf("Messenger: Could not render message \"%s\": %s", templateText, err)
+		text = templateText
+	}
+
+	suffix, err := m.RenderText(messages, messages.Formats.MoistureSuffix, params)
+	if err != nil {
+		log.Println("Messenger: Could not render moisture suffix:", err)
+	}
+
+	return text + suffix
+}
+
 /*
  * Inputs:
  * - Direction of levels (up, stead, down +1, 0, -1)
@@ -226,20 +394,29 @@ func (m *Messenger) GetMessage(levelName string, levelDirection int, reminder bo
 func (m *Messenger) ResolveLevelToMessage(normalizedMoistureValue int, levelDirection int, currentLevel quantifier.QuantificationLevel) error {
 	log.Println("Messenger: Resolving level and direction to message...")
 
-	// Send a text message and GIF (if any GIF keywords are defined)
-	textMessage, gifUrl, err := m.GetMessage(currentLevel.Name, levelDirection, false)
-	if err != nil {
-		fmt.Errorf("Could not get and suitable message from config for level %s and direction %d: %s", currentLevel.Name, levelDirection, err)
-	}
-	log.Printf("Messenger: Sending message: \"%s\" \n", textMessage)
+	// Remember level changes for previous level in messages
+	m.levelMutex.Lock()
+	m.previousLevel = m.currentLevel
+	m.currentLevel = currentLevel
+	m.levelMutex.Unlock()
 
-	// Send text message
-	m.XmppMessageOutChannel <- xmppmanager.XmppTextMessage{Text: textMessage + " \nBodenfeuchte: " + strconv.Itoa(normalizedMoistureValue) + " %"}
+	m.UpdatePresence()
 
-	// Send GIF (if set in config)
-	if gifUrl != "" {
-		m.XmppMessageOutChannel <- xmppmanager.XmppGifMessage{Url: gifUrl}
-	}
+	params := m.messageParams(currentLevel, directionName(levelDirection))
+	params.SensorValue = normalizedMoistureValue
+
+	// Send text message and GIF (if set in config) in every recipient's language
+	m.notify(NotificationLevelChange, nil, func(messages *configmanager.Messages) (string, string) {
+		templateText, gifUrl, err := m.GetMessage(messages, currentLevel.Name, levelDirection, false)
+		if err != nil {
+			log.Printf("Messenger: Could not get a suitable message from config for level %s and direction %d: %s", currentLevel.Name, levelDirection, err)
+		}
+
+		textMessage := m.renderLevelMessage(messages, templateText, params)
+		log.Printf("Messenger: Sending message: \"%s\" \n", textMessage)
+
+		return textMessage, gifUrl
+	})
 
 	return nil
 }
@@ -248,43 +425,211 @@ func (m *Messenger) ResolveLevelToMessage(normalizedMoistureValue int, levelDire
  * Inputs:
  * - Level to remind of
  * - Current Moisture level
+ * - Recipients to remind (nil = all recipients)
+ * - Number of this reminder since the level was reached
+ * Returns false if nobody received the reminder now, e.g. because of quiet hours.
  */
-func (m *Messenger) SendReminder(currentLevel quantifier.QuantificationLevel, normalizedMoistureValue int) error {
+func (m *Messenger) SendReminder(currentLevel quantifier.QuantificationLevel, normalizedMoistureValue int, recipients []string, reminderCount int) bool {
 	log.Println("Messenger: Resolving level and direction to message...")
 
-	// Send a text message and GIF (if any GIF keywords are defined)
-	textMessage, gifUrl, err := m.GetMessage(currentLevel.Name, 0, true)
-	if err != nil {
-		fmt.Errorf("Could not get and suitable reminder message from config for level %s: %s", currentLevel.Name, err)
-	}
-	log.Printf("Messenger: Sending message: \"%s\" \n", textMessage)
+	params := m.messageParams(currentLevel, "reminder")
+	params.SensorValue = normalizedMoistureValue
+	params.ReminderCount = reminderCount
 
-	// Send text message
-	m.XmppMessageOutChannel <- xmppmanager.XmppTextMessage{Text: textMessage + " \nBodenfeuchte: " + strconv.Itoa(normalizedMoistureValue) + " %"}
+	// Send text message and GIF (if set in config) in every recipient's language
+	delivered := m.notify(NotificationReminder, recipients, func(messages *configmanager.Messages) (string, string) {
+		templateText, gifUrl, err := m.GetMessage(messages, currentLevel.Name, 0, true)
+		if err != nil {
+			log.Printf("Messenger: Could not get a suitable reminder message from config for level %s: %s", currentLevel.Name, err)
+		}
 
-	// Send GIF (if set in config)
-	if gifUrl != "" {
-		m.XmppMessageOutChannel <- xmppmanager.XmppGifMessage{Url: gifUrl}
-	}
+		textMessage := m.renderLevelMessage(messages, templateText, params)
+		log.Printf("Messenger: Sending message: \"%s\" \n", textMessage)
 
-	return nil
+		return textMessage, gifUrl
+	})
+
+	return delivered > 0
+}
+
+/*
+ * Sends a random online message to all recipients, e.g. after startup
+ */
+func (m *Messenger) SendOnlineMessage() {
+	log.Println("Messenger: Sending online message")
+	m.sendStatusMessage(func(messages *configmanager.Messages) []string { return messages.Online })
 }
 
-func (m *Messenger) SendSensorWarning(interval time.Duration) {
-	var messageStringBuffer bytes.Buffer
+/*
+ * Sends a random offline message to all recipients before shutting down
+ */
+func (m *Messenger) SendOfflineMessage() {
+	log.Println("Messenger: Sending offline message")
+	m.sendStatusMessage(func(messages *configmanager.Messages) []string { return messages.Offline })
+}
+
+// Sends a random message out of a list of online / offline messages in every recipient's language
+func (m *Messenger) sendStatusMessage(statusMessages func(messages *configmanager.Messages) []string) {
+	m.levelMutex.Lock()
+	currentLevel := m.currentLevel
+	m.levelMutex.Unlock()
+
+	params := m.messageParams(currentLevel, "")
+
+	m.SendText(nil, func(messages *configmanager.Messages) (string, error) {
+		templates := statusMessages(messages)
+		if len(templates) == 0 {
+			return "", nil
+		}
+		return m.RenderText(messages, templates[rand.Intn(len(templates))], params.localized(messages))
+	})
+}
+
+/*
+ * Warns users that a sensor device has not sent a reading for a while
+ */
+func (m *Messenger) SendSensorWarning(device string, interval time.Duration, missedUplinks int) {
 	log.Println("Sending sensor availability warning")
 
 	warningParams := WarningSensorOfflineParams{
-		Timeout: interval,
+		Device:        device,
+		Timeout:       interval,
+		MissedUplinks: missedUplinks,
 	}
 
-	err := m.Templates.WarningSensorOffline.Execute(&messageStringBuffer, warningParams)
-	if err != nil {
-		panic(err)
+	m.notify(NotificationWatchdog, nil, func(messages *configmanager.Messages) (string, string) {
+		warningText, err := m.RenderText(messages, messages.Warnings.SensorOffline, warningParams)
+		if err != nil {
+			log.Println("Messenger: Could not render warning:", err)
+		}
+		return warningText, ""
+	})
+
+	m.setSensorOffline(device, true)
+}
+
+/*
+ * Tells users that the sensor is back online after a watchdog warning
+ */
+func (m *Messenger) SendSensorRecovered(device string, outage time.Duration) {
+	log.Println("Sending sensor recovery notification")
+
+	recoveryParams := WarningSensorOnlineParams{
+		Device: device,
+		Outage: outage,
 	}
 
-	// Respond via out channel
-	m.XmppMessageOutChannel <- xmppmanager.XmppTextMessage{
-		Text: messageStringBuffer.String(),
+	m.notify(NotificationWatchdog, nil, func(messages *configmanager.Messages) (string, string) {
+		recoveryText, err := m.RenderText(messages, messages.Warnings.SensorOnline, recoveryParams)
+		if err != nil {
+			log.Println("Messenger: Could not render recovery notification:", err)
+		}
+		return recoveryText, ""
+	})
+
+	m.setSensorOffline(device, false)
+}
+
+/*
+ * Warns admins about uplinks which got lost on the way (gap in the frame counter)
+ */
+func (m *Messenger) SendFrameCounterGapWarning(lostUplinks int) {
+	log.Println("Sending warning about lost uplinks")
+
+	warningParams := WarningFrameCounterGapParams{
+		LostUplinks: lostUplinks,
+	}
+
+	m.notify(NotificationWarning, m.Admins, func(messages *configmanager.Messages) (string, string) {
+		warningText, err := m.RenderText(messages, messages.Warnings.FrameCounterGap, warningParams)
+		if err != nil {
+			log.Println("Messenger: Could not render warning:", err)
+		}
+		return warningText, ""
+	})
+}
+
+/*
+ * Warns users about a sensor which keeps sending the same raw value
+ */
+func (m *Messenger) SendSensorStuckWarning(rawValue int, duration time.Duration) {
+	log.Println("Sending warning about stuck sensor")
+
+	warningParams := WarningSensorStuckParams{
+		RawValue: rawValue,
+		Duration: duration,
+	}
+
+	m.notify(NotificationWatchdog, nil, func(messages *configmanager.Messages) (string, string) {
+		warningText, err := m.RenderText(messages, messages.Warnings.SensorStuck, warningParams)
+		if err != nil {
+			log.Println("Messenger: Could not render warning:", err)
+		}
+		return warningText, ""
+	})
+}
+
+/*
+ * Warns users about a sensor which keeps sending values at the bound of the calibrated range.
+ * dry: Values are at the upper (dry) bound, e.g. probe pulled out of the soil. Otherwise at the lower (wet) bound.
+ */
+func (m *Messenger) SendSensorPinnedWarning(rawValue int, dry bool, readings int) {
+	log.Println("Sending warning about sensor values at the bound of the calibrated range")
+
+	warningParams := WarningSensorPinnedParams{
+		RawValue: rawValue,
+		Readings: readings,
 	}
+
+	m.notify(NotificationWatchdog, nil, func(messages *configmanager.Messages) (string, string) {
+		templateText := messages.Warnings.SensorPinnedWet
+		if dry {
+			templateText = messages.Warnings.SensorPinnedDry
+		}
+		warningText, err := m.RenderText(messages, templateText, warningParams)
+		if err != nil {
+			log.Println("Messenger: Could not render warning:", err)
+		}
+		return warningText, ""
+	})
+}
+
+/*
+ * Warns users about sensor values which (almost) do not vary anymore
+ */
+func (m *Messenger) SendVarianceCollapseWarning(stdDev float64, readings int) {
+	log.Println("Sending warning about collapsed sensor value variance")
+
+	warningParams := WarningVarianceCollapseParams{
+		StdDev:   fmt.Sprintf("%.1f", stdDev),
+		Readings: readings,
+	}
+
+	m.notify(NotificationWatchdog, nil, func(messages *configmanager.Messages) (string, string) {
+		warningText, err := m.RenderText(messages, messages.Warnings.VarianceCollapse, warningParams)
+		if err != nil {
+			log.Println("Messenger: Could not render warning:", err)
+		}
+		return warningText, ""
+	})
+}
+
+/*
+ * Warns admins about a sensor value which could not be assigned to any level
+ */
+func (m *Messenger) SendUnquantifiableWarning(normalizedMoistureValue int, reason string) {
+	log.Println("Sending warning about unquantifiable sensor value")
+
+	warningParams := WarningValueUnquantifiableParams{
+		SensorValue: normalizedMoistureValue,
+		Reason:      reason,
+	}
+
+	m.notify(NotificationWarning, m.Admins, func(messages *configmanager.Messages) (string, string) {
+		warningText, err := m.RenderText(messages, messages.Warnings.ValueUnquantifiable, warningParams)
+		if err != nil {
+			log.Println("Messenger: Could not render warning:", err)
+		}
+		return warningText, ""
+	})
 }
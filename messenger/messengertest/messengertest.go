@@ -0,0 +1,58 @@
+/*
+ * Messengertest:
+ * Messenger fixture for tests of packages which send notifications
+ */
+package messengertest
+
+import (
+	"testing"
+
+	clockPkg "thomas-leister.de/plantmonitor/clock"
+	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/gifmanager"
+	messengerPkg "thomas-leister.de/plantmonitor/messenger"
+	sensorPkg "thomas-leister.de/plantmonitor/sensor"
+	testingInit "thomas-leister.de/plantmonitor/testing_init"
+)
+
+type Fixture struct {
+	Config     *configManagerPkg.Config
+	Sensor     *sensorPkg.Sensor
+	Messenger  *messengerPkg.Messenger
+	Clock      *clockPkg.Virtual // Starts at testing_init.StartTime
+	OutChannel chan interface{}  // Messages sent by the messenger
+}
+
+/*
+ * Creates a messenger from config.example.yaml. configure may adjust the config before (optional).
+ */
+func New(t *testing.T, configure func(config *configManagerPkg.Config)) *Fixture {
+	t.Helper()
+
+	config, err := configManagerPkg.ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		t.Fatalf("Could not parse config: %s", err)
+	}
+	if configure != nil {
+		configure(&config)
+	}
+
+	sensor := sensorPkg.Sensor{}
+	sensor.Init(&config)
+
+	outChannel := make(chan interface{}, 100)
+	messenger := messengerPkg.Messenger{}
+	if err := messenger.Init(&config, outChannel, nil, gifmanager.NoopProvider{}, &sensor); err != nil {
+		t.Fatalf("Could not init messenger: %s", err)
+	}
+	clock := clockPkg.NewVirtual(testingInit.StartTime)
+	messenger.Clock = clock
+
+	return &Fixture{
+		Config:     &config,
+		Sensor:     &sensor,
+		Messenger:  &messenger,
+		Clock:      clock,
+		OutChannel: outChannel,
+	}
+}
@@ -0,0 +1,324 @@
+/*
+ * Chat commands for per-recipient preferences:
+ * "preferences", "subscribe [event types]", "unsubscribe [event types]",
+ * "plants <names>|all|default", "gifs on|off", "quiethours <HH:MM-HH:MM>|off|default"
+ * and "language [code]"
+ */
+
+package messenger
+
+import (
+	"log"
+	"strings"
+
+	"thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/quiethours"
+)
+
+type PreferencesParams struct {
+	Subscribed   string // Names of subscribed event types, comma-separated
+	Unsubscribed string // Names of unsubscribed event types, comma-separated
+	Plants       string // Names of plants the recipient is notified about, comma-separated. Empty = all
+	Gifs         bool
+	QuietHours   string // e.g. "22:00-07:00". Empty = no quiet hours
+	Language     string // Name of the language
+}
+
+type UnknownEventTypeParams struct {
+	EventType string // Event type as sent by the user
+	Available string // Names of all event types, comma-separated
+}
+
+type LanguagesParams struct {
+	Language  string // Name of the current language
+	Available string // "<code> (<name>)" of all languages, comma-separated
+}
+
+func (m *Messenger) registerPreferencesCommands() {
+	m.RegisterCommand(Command{Name: "preferences", Aliases: []string{"settings"}, Handler: m.handlePreferencesCommand})
+	m.RegisterCommand(Command{Name: "subscribe", Handler: m.handleSubscribeCommand})
+	m.RegisterCommand(Command{Name: "unsubscribe", Handler: m.handleUnsubscribeCommand})
+	m.RegisterCommand(Command{Name: "plants", Handler: m.handlePlantsCommand})
+	m.RegisterCommand(Command{Name: "gifs", Handler: m.handleGifsCommand})
+	m.RegisterCommand(Command{Name: "quiethours", Handler: m.handleQuietHoursCommand})
+	m.RegisterCommand(Command{Name: "language", Handler: m.handleLanguageCommand})
+}
+
+/*
+ * preferences: Show the sender's preferences
+ */
+func (m *Messenger) handlePreferencesCommand(request CommandRequest) {
+	m.Reply(request.Sender, m.preferencesText(request.Sender))
+}
+
+/*
+ * subscribe [event types]: Subscribe to event types (all if none are given)
+ */
+func (m *Messenger) handleSubscribeCommand(request CommandRequest) {
+	m.setSubscribed(request, true)
+}
+
+/*
+ * unsubscribe [event types]: Unsubscribe from event types (all if none are given)
+ */
+func (m *Messenger) handleUnsubscribeCommand(request CommandRequest) {
+	m.setSubscribed(request, false)
+}
+
+func (m *Messenger) setSubscribed(request CommandRequest, subscribed bool) {
+	eventTypes := configmanager.EventTypes
+
+	if len(request.Args) > 0 {
+		eventTypes = nil
+		for _, arg := range request.Args {
+			eventType, ok := matchEventType(m.MessagesFor(request.Sender), arg)
+			if !ok {
+				m.replyUnknownEventType(request.Sender, arg)
+				return
+			}
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+
+	m.replyPreferencesSaved(request.Sender, m.Preferences.SetSubscribed(request.Sender, eventTypes, subscribed))
+}
+
+/*
+ * plants <names>|all|default: Choose the plants (plant_name, comma-separated) to be notified about,
+ * all plants or go back to the configured plants
+ */
+func (m *Messenger) handlePlantsCommand(request CommandRequest) {
+	messages := m.MessagesFor(request.Sender)
+	keywords := &messages.Keywords
+
+	if len(request.Args) == 0 {
+		m.Reply(request.Sender, messages.Answers.InvalidPlants)
+		return
+	}
+	arg := strings.Join(request.Args, " ")
+
+	switch {
+	case matchKeyword(arg, "all", keywords.All):
+		m.replyPreferencesSaved(request.Sender, m.Preferences.SetPlants(request.Sender, []string{}))
+	case matchKeyword(arg, "default", keywords.Default):
+		m.replyPreferencesSaved(request.Sender, m.Preferences.ResetPlants(request.Sender))
+	default:
+		var plants []string
+		for _, plant := range strings.Split(arg, ",") {
+			if plant = strings.TrimSpace(plant); plant != "" {
+				plants = append(plants, plant)
+			}
+		}
+		if len(plants) == 0 {
+			m.Reply(request.Sender, messages.Answers.InvalidPlants)
+			return
+		}
+		m.replyPreferencesSaved(request.Sender, m.Preferences.SetPlants(request.Sender, plants))
+	}
+}
+
+/*
+ * gifs on|off: Turn GIFs on or off
+ */
+func (m *Messenger) handleGifsCommand(request CommandRequest) {
+	messages := m.MessagesFor(request.Sender)
+	keywords := &messages.Keywords
+
+	if len(request.Args) != 1 {
+		m.Reply(request.Sender, messages.Answers.InvalidGifsArgument)
+		return
+	}
+
+	switch {
+	case matchKeyword(request.Args[0], "on", keywords.On):
+		m.replyPreferencesSaved(request.Sender, m.Preferences.SetGifs(request.Sender, true))
+	case matchKeyword(request.Args[0], "off", keywords.Off):
+		m.replyPreferencesSaved(request.Sender, m.Preferences.SetGifs(request.Sender, false))
+	default:
+		m.Reply(request.Sender, messages.Answers.InvalidGifsArgument)
+	}
+}
+
+/*
+ * quiethours <HH:MM-HH:MM>|off|default: Set own quiet hours, turn them off
+ * or go back to the configured quiet hours
+ */
+func (m *Messenger) handleQuietHoursCommand(request CommandRequest) {
+	var err error
+	messages := m.MessagesFor(request.Sender)
+	keywords := &messages.Keywords
+
+	if len(request.Args) != 1 {
+		m.Reply(request.Sender, messages.Answers.InvalidQuietHours)
+		return
+	}
+	arg := request.Args[0]
+
+	switch {
+	case matchKeyword(arg, "off", keywords.Off):
+		err = m.Preferences.SetQuietHours(request.Sender, "", "")
+	case matchKeyword(arg, "default", keywords.Default):
+		err = m.Preferences.ResetQuietHours(request.Sender)
+	default:
+		times := strings.Split(arg, "-")
+		if len(times) != 2 {
+			m.Reply(request.Sender, messages.Answers.InvalidQuietHours)
+			return
+		}
+		if _, parseErr := quiethours.Parse(times[0], times[1], ""); parseErr != nil {
+			m.Reply(request.Sender, messages.Answers.InvalidQuietHours)
+			return
+		}
+		err = m.Preferences.SetQuietHours(request.Sender, strings.TrimSpace(times[0]), strings.TrimSpace(times[1]))
+	}
+
+	if loadErr := m.loadQuietHours(); loadErr != nil {
+		log.Println("Messenger: Could not reload quiet hours:", loadErr)
+	}
+	m.replyPreferencesSaved(request.Sender, err)
+}
+
+/*
+ * language [code]: Show available languages or choose a language
+ */
+func (m *Messenger) handleLanguageCommand(request CommandRequest) {
+	messages := m.MessagesFor(request.Sender)
+
+	if len(request.Args) != 1 {
+		m.replyLanguages(request.Sender, messages.Answers.Languages)
+		return
+	}
+
+	langCode := strings.ToLower(request.Args[0])
+	if _, exists := m.Catalog[langCode]; !exists {
+		m.replyLanguages(request.Sender, messages.Answers.UnknownLanguage)
+		return
+	}
+
+	// Confirm in the new language
+	m.replyPreferencesSaved(request.Sender, m.Preferences.SetLanguage(request.Sender, langCode))
+}
+
+func (m *Messenger) replyLanguages(recipient string, templateText string) {
+	var languages []string
+	for _, langCode := range configmanager.LangCodes(m.Catalog) {
+		languages = append(languages, langCode+" ("+languageName(m.Catalog[langCode], langCode)+")")
+	}
+
+	languagesParams := LanguagesParams{
+		Language:  languageName(m.MessagesFor(recipient), m.Preferences.Language(recipient)),
+		Available: strings.Join(languages, ", "),
+	}
+
+	answerText, err := m.RenderText(m.MessagesFor(recipient), templateText, languagesParams)
+	if err != nil {
+		log.Println("Messenger: Could not render answer:", err)
+		return
+	}
+	m.Reply(recipient, answerText)
+}
+
+/*
+ * Confirms a change of preferences and shows the new preferences.
+ * saveErr: Error while saving preferences to file
+ */
+func (m *Messenger) replyPreferencesSaved(recipient string, saveErr error) {
+	messages := m.MessagesFor(recipient)
+
+	answer := messages.Answers.PreferencesSaved
+	if saveErr != nil {
+		log.Println("Messenger: Could not save preferences:", saveErr)
+		answer = messages.Answers.PreferencesNotSaved
+	}
+
+	m.Reply(recipient, answer+"\n\n"+m.preferencesText(recipient))
+}
+
+func (m *Messenger) replyUnknownEventType(recipient string, eventType string) {
+	var names []string
+	messages := m.MessagesFor(recipient)
+
+	for _, knownEventType := range configmanager.EventTypes {
+		names = append(names, eventTypeName(messages, knownEventType))
+	}
+
+	answerText, err := m.RenderText(messages, messages.Answers.UnknownEventType, UnknownEventTypeParams{EventType: eventType, Available: strings.Join(names, ", ")})
+	if err != nil {
+		log.Println("Messenger: Could not render answer:", err)
+		return
+	}
+	m.Reply(recipient, answerText)
+}
+
+// Renders the preferences of a recipient
+func (m *Messenger) preferencesText(recipient string) string {
+	var subscribed []string
+	var unsubscribed []string
+	messages := m.MessagesFor(recipient)
+
+	for _, eventType := range configmanager.EventTypes {
+		if m.Preferences.Subscribed(recipient, eventType) {
+			subscribed = append(subscribed, eventTypeName(messages, eventType))
+		} else {
+			unsubscribed = append(unsubscribed, eventTypeName(messages, eventType))
+		}
+	}
+
+	preferencesParams := PreferencesParams{
+		Subscribed:   strings.Join(subscribed, ", "),
+		Unsubscribed: strings.Join(unsubscribed, ", "),
+		Plants:       strings.Join(m.Preferences.Plants(recipient), ", "),
+		Gifs:         m.Preferences.Gifs(recipient),
+		Language:     languageName(messages, m.Preferences.Language(recipient)),
+	}
+	if quietHours := m.Preferences.QuietHours(recipient); quietHours.Enabled() {
+		preferencesParams.QuietHours = quietHours.Start + "-" + quietHours.End
+	}
+
+	preferencesText, err := m.RenderText(messages, messages.Answers.Preferences, preferencesParams)
+	if err != nil {
+		log.Println("Messenger: Could not render preferences:", err)
+	}
+	return preferencesText
+}
+
+// Returns the localized name of an event type
+func eventTypeName(messages *configmanager.Messages, eventType string) string {
+	if name := messages.EventTypes[eventType].Name; name != "" {
+		return name
+	}
+	return eventType
+}
+
+// Returns the name of a language, falls back to its code
+func languageName(messages *configmanager.Messages, langCode string) string {
+	if messages.LanguageName != "" {
+		return messages.LanguageName
+	}
+	return langCode
+}
+
+/*
+ * Finds the event type for a word sent by a user:
+ * Either the event type itself (e.g. "reminder") or one of its triggers from the language file
+ */
+func matchEventType(messages *configmanager.Messages, word string) (string, bool) {
+	for _, eventType := range configmanager.EventTypes {
+		if matchKeyword(word, eventType, messages.EventTypes[eventType].Triggers) {
+			return eventType, true
+		}
+	}
+	return "", false
+}
+
+// Whether word equals keyword or one of its localized variants (case-insensitive)
+func matchKeyword(word string, keyword string, localized []string) bool {
+	word = strings.TrimSpace(word)
+
+	for _, candidate := range append([]string{keyword}, localized...) {
+		if strings.EqualFold(word, strings.TrimSpace(candidate)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+/*
+ * Presence:
+ * Mirrors the state of the plant in the XMPP presence of plantmonitor, so that
+ * contacts see it in their roster: available, away or dnd depending on the
+ * current level (see "presence" of a level) and xa after the watchdog has fired.
+ */
+
+package messenger
+
+import (
+	"log"
+
+	"thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/quantifier"
+	"thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+// Presence while the sensor is offline ("extended away")
+const presenceSensorOffline = "xa"
+
+/*
+ * Sets the current level without sending a level message, e.g. after restoring
+ * the state on startup, and publishes the presence
+ */
+func (m *Messenger) RestoreLevel(level quantifier.QuantificationLevel) {
+	m.levelMutex.Lock()
+	m.currentLevel = level
+	m.levelMutex.Unlock()
+
+	m.UpdatePresence()
+}
+
+/*
+ * Remembers whether a sensor device is offline. Updates the presence if
+ * this changes whether any device is offline.
+ */
+func (m *Messenger) setSensorOffline(device string, offline bool) {
+	m.levelMutex.Lock()
+	wasOffline := len(m.offlineDevices) > 0
+	if offline {
+		if m.offlineDevices == nil {
+			m.offlineDevices = make(map[string]bool)
+		}
+		m.offlineDevices[device] = true
+	} else {
+		delete(m.offlineDevices, device)
+	}
+	changed := wasOffline != (len(m.offlineDevices) > 0)
+	m.levelMutex.Unlock()
+
+	if changed {
+		m.UpdatePresence()
+	}
+}
+
+/*
+ * Publishes the presence for the current level and sensor state.
+ * The status text is rendered in the default language.
+ */
+func (m *Messenger) UpdatePresence() {
+	m.levelMutex.Lock()
+	level := m.currentLevel
+	sensorOffline := len(m.offlineDevices) > 0
+	m.levelMutex.Unlock()
+
+	// Nothing to show before the first level is known
+	if m.PresenceOutChannel == nil || (level.Name == "" && !sensorOffline) {
+		return
+	}
+
+	presence := xmppmanager.XmppPresence{Show: level.Presence}
+	templateText := m.Messages.Formats.PresenceStatus
+	if sensorOffline {
+		presence.Show = presenceSensorOffline
+		templateText = m.Messages.Formats.PresenceSensorOffline
+	}
+	if presence.Show == configmanager.PresenceAvailable {
+		presence.Show = ""
+	}
+
+	status, err := m.RenderText(m.Messages, templateText, m.messageParams(level, "").localized(m.Messages))
+	if err != nil {
+		log.Println("Messenger: Could not render presence status:", err)
+	}
+	presence.Status = status
+
+	m.PresenceOutChannel <- presence
+}
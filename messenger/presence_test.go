@@ -0,0 +1,57 @@
+package messenger
+
+import (
+	"testing"
+	"time"
+
+	quantifierPkg "thomas-leister.de/plantmonitor/quantifier"
+	"thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+/*
+ * The presence follows level changes and shows "xa" while the sensor is offline
+ */
+func TestPresence(t *testing.T) {
+	fixture := newTestMessenger(t, nil)
+	messenger, sensor := fixture.Messenger, fixture.Sensor
+
+	presenceChannel := make(chan interface{}, 10)
+	messenger.PresenceOutChannel = presenceChannel
+
+	levels := map[string]quantifierPkg.QuantificationLevel{}
+	for _, level := range quantifierPkg.LevelsFromConfig(fixture.Config) {
+		levels[level.Name] = level
+	}
+
+	expectPresence := func(show string, status string) {
+		t.Helper()
+		select {
+		case message := <-presenceChannel:
+			presence := message.(xmppmanager.XmppPresence)
+			if presence.Show != show || presence.Status != status {
+				t.Errorf("Expected presence \"%s\" / \"%s\". Got \"%s\" / \"%s\"", show, status, presence.Show, presence.Status)
+			}
+		default:
+			t.Errorf("Expected presence \"%s\" / \"%s\". Got none", show, status)
+		}
+	}
+
+	sensor.Normalized.Current.Value = 54
+	messenger.ResolveLevelToMessage(54, -1, levels["normal"])
+	expectPresence("", "Bodenfeuchte 54 % (gut)")
+
+	sensor.Normalized.Current.Value = 25
+	messenger.ResolveLevelToMessage(25, -1, levels["low"])
+	expectPresence("dnd", "Bodenfeuchte 25 % (trocken)")
+
+	// Only the first warning changes the presence
+	messenger.SendSensorWarning("", time.Hour, 0)
+	messenger.SendSensorWarning("", 2*time.Hour, 0)
+	expectPresence("xa", "Sensor offline – letzter Wert 25 %")
+	if len(presenceChannel) != 0 {
+		t.Errorf("Expected no presence for repeated warning. Got %v", <-presenceChannel)
+	}
+
+	messenger.SendSensorRecovered("", 2*time.Hour)
+	expectPresence("dnd", "Bodenfeuchte 25 % (trocken)")
+}
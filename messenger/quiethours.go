@@ -0,0 +1,336 @@
+/*
+ * Quiet hours:
+ * Holds back notifications during the recipients' quiet hours
+ * and sends a summary when quiet hours are over.
+ */
+
+package messenger
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"thomas-leister.de/plantmonitor/clock"
+	"thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/quiethours"
+	"thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+// Type of a notification. Decides how it is treated during quiet hours.
+type NotificationKind int
+
+const (
+	NotificationLevelChange NotificationKind = iota // Level has changed. Held back and summarized.
+	NotificationReminder                            // Reminder of a critical level. Dropped, but counted in summary.
+	NotificationWatchdog                            // Sensor is offline. Delivered if watchdog_bypass is set.
+	NotificationWarning                             // Technical warning. Held back and summarized.
+	NotificationInfo                                // Other information, e.g. acknowledgements. Held back and summarized.
+)
+
+type recipientQuietHours struct {
+	Schedule       quiethours.Schedule
+	WatchdogBypass bool
+}
+
+// Notifications which have been held back for a recipient
+type quietHoursQueue struct {
+	events              []QuietHoursEvent
+	suppressedReminders int
+	timer               clock.Timer // Fires at the end of quiet hours
+}
+
+type QuietHoursEvent struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+/*
+ * Notifications held back for a recipient, saved in the state file across restarts
+ */
+type HeldBackState struct {
+	Events              []QuietHoursEvent `json:"events"`
+	SuppressedReminders int               `json:"suppressed_reminders"`
+}
+
+/*
+ * Persistent state of the messenger
+ */
+type State struct {
+	HeldBack map[string]HeldBackState `json:"held_back,omitempty"` // Held back notifications by recipient JID
+}
+
+type QuietHoursSummaryParams struct {
+	Events              []QuietHoursEvent
+	SuppressedReminders int
+}
+
+/*
+ * Resolves quiet hours for every recipient and admin:
+ * Quiet hours set via chat override recipient-specific quiet hours, which override the global quiet hours.
+ */
+func (m *Messenger) loadQuietHours() error {
+	quietHours := make(map[string]recipientQuietHours)
+
+	recipients := append(append([]string{}, m.PermittedSenders...), m.Admins...)
+	for _, recipient := range recipients {
+		quietHoursConfig := m.Preferences.QuietHours(recipient)
+		if !quietHoursConfig.Enabled() {
+			continue
+		}
+
+		schedule, err := quiethours.Parse(quietHoursConfig.Start, quietHoursConfig.End, quietHoursConfig.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid quiet hours for %s: %s", recipient, err)
+		}
+		quietHours[recipient] = recipientQuietHours{Schedule: schedule, WatchdogBypass: quietHoursConfig.WatchdogBypass}
+	}
+
+	m.quietHoursMutex.Lock()
+	m.quietHours = quietHours
+	m.quietHoursMutex.Unlock()
+
+	return nil
+}
+
+/*
+ * Returns the event type recipients subscribe to for this kind of notification.
+ * Empty for notifications which cannot be unsubscribed.
+ */
+func (kind NotificationKind) eventType() string {
+	switch kind {
+	case NotificationLevelChange:
+		return configmanager.EventLevelChange
+	case NotificationReminder:
+		return configmanager.EventReminder
+	case NotificationWatchdog:
+		return configmanager.EventWatchdog
+	default:
+		return ""
+	}
+}
+
+/*
+ * Renders a notification in one language. Returns text and GIF URL (empty = no GIF).
+ */
+type notificationRenderer func(messages *configmanager.Messages) (string, string)
+
+// Recipients of a notification who share a language
+type notificationGroup struct {
+	messages      *configmanager.Messages
+	text          string
+	gifUrl        string
+	deliverTo     []string
+	gifRecipients []string
+}
+
+/*
+ * Sends a notification to recipients (no recipients = all recipients) in their language.
+ * Recipients who have unsubscribed from this kind of notification do not receive it.
+ * Recipients who are in their quiet hours do not receive it now, but get a summary later.
+ * The GIF is only sent to recipients who want GIFs.
+ * Returns the number of recipients the notification was delivered to now.
+ */
+func (m *Messenger) notify(kind NotificationKind, recipients []string, render notificationRenderer) int {
+	var groups []*notificationGroup
+	delivered := 0
+
+	broadcast := len(recipients) == 0
+	if broadcast {
+		recipients = m.PermittedSenders
+	}
+
+	now := m.Clock.Now()
+	eventType := kind.eventType()
+	for _, recipient := range recipients {
+		if eventType != "" && !m.Preferences.Subscribed(recipient, eventType) {
+			continue
+		}
+		if !m.Preferences.SubscribedToPlant(recipient, m.PlantName) {
+			continue
+		}
+
+		// Render notification once per language
+		messages := m.MessagesFor(recipient)
+		var group *notificationGroup
+		for _, existingGroup := range groups {
+			if existingGroup.messages == messages {
+				group = existingGroup
+				break
+			}
+		}
+		if group == nil {
+			group = &notificationGroup{messages: messages}
+			group.text, group.gifUrl = render(messages)
+			groups = append(groups, group)
+		}
+
+		if group.text == "" || m.holdBack(recipient, kind, group.text, now) {
+			continue
+		}
+
+		group.deliverTo = append(group.deliverTo, recipient)
+		if m.Preferences.Gifs(recipient) {
+			group.gifRecipients = append(group.gifRecipients, recipient)
+		}
+		delivered++
+	}
+
+	if delivered == 0 {
+		log.Println("Messenger: No recipient wants this notification now. Not sending it.")
+		return 0
+	}
+
+	for _, group := range groups {
+		if len(group.deliverTo) == 0 {
+			continue
+		}
+		sendGif := group.gifUrl != "" && len(group.gifRecipients) > 0
+
+		// Everybody gets the notification in the same language: Keep broadcasting to all recipients
+		if broadcast && len(group.deliverTo) == len(recipients) {
+			if len(group.gifRecipients) == len(group.deliverTo) {
+				group.gifRecipients = nil
+			}
+			group.deliverTo = nil
+		}
+
+		m.XmppMessageOutChannel <- xmppmanager.XmppTextMessage{Recipients: group.deliverTo, Text: group.text}
+		if sendGif {
+			m.XmppMessageOutChannel <- xmppmanager.XmppGifMessage{Recipients: group.gifRecipients, Url: group.gifUrl}
+		}
+	}
+	return delivered
+}
+
+/*
+ * Queues a notification if recipient is in quiet hours.
+ * Returns false if the notification should be delivered now.
+ */
+func (m *Messenger) holdBack(recipient string, kind NotificationKind, text string, now time.Time) bool {
+	m.quietHoursMutex.Lock()
+	defer m.quietHoursMutex.Unlock()
+
+	quietHours, exists := m.quietHours[recipient]
+	if !exists || !quietHours.Schedule.Contains(now) {
+		return false
+	}
+	if kind == NotificationWatchdog && quietHours.WatchdogBypass {
+		return false
+	}
+
+	queue, exists := m.quietHoursQueues[recipient]
+	if !exists {
+		queue = &quietHoursQueue{}
+		m.quietHoursQueues[recipient] = queue
+	}
+	if queue.timer == nil {
+		m.scheduleSummary(recipient, queue, now)
+	}
+
+	if kind == NotificationReminder {
+		queue.suppressedReminders++
+	} else {
+		queue.events = append(queue.events, QuietHoursEvent{Time: now.In(quietHours.Schedule.Location), Text: text})
+	}
+	log.Printf("Messenger: %s is in quiet hours. Holding back notification.\n", recipient)
+
+	return true
+}
+
+/*
+ * Sends the summary when the recipient's quiet hours are over, right away if they are over already.
+ * Needs to be called with quietHoursMutex held.
+ */
+func (m *Messenger) scheduleSummary(recipient string, queue *quietHoursQueue, now time.Time) {
+	delay := time.Duration(0)
+	if quietHours, exists := m.quietHours[recipient]; exists && quietHours.Schedule.Contains(now) {
+		delay = quietHours.Schedule.NextEnd(now).Sub(now)
+	}
+
+	queue.timer = m.Clock.AfterFunc(delay, func() {
+		m.sendQuietHoursSummary(recipient)
+	})
+}
+
+/*
+ * Returns the notifications which are held back, e.g. to save them on shutdown
+ */
+func (m *Messenger) State() State {
+	m.quietHoursMutex.Lock()
+	defer m.quietHoursMutex.Unlock()
+
+	state := State{HeldBack: make(map[string]HeldBackState)}
+	for recipient, queue := range m.quietHoursQueues {
+		state.HeldBack[recipient] = HeldBackState{Events: queue.events, SuppressedReminders: queue.suppressedReminders}
+	}
+	return state
+}
+
+/*
+ * Restores notifications which were held back before a restart. Their summaries
+ * are not scheduled before ScheduleSummaries() is called, e.g. once messages can be sent.
+ */
+func (m *Messenger) Restore(state State) {
+	m.quietHoursMutex.Lock()
+	defer m.quietHoursMutex.Unlock()
+
+	for recipient, heldBack := range state.HeldBack {
+		queue, exists := m.quietHoursQueues[recipient]
+		if !exists {
+			queue = &quietHoursQueue{}
+			m.quietHoursQueues[recipient] = queue
+		}
+		queue.events = append(append([]QuietHoursEvent{}, heldBack.Events...), queue.events...)
+		queue.suppressedReminders += heldBack.SuppressedReminders
+	}
+
+	if len(state.HeldBack) > 0 {
+		log.Printf("Messenger: Restored notifications held back for %d recipient(s)\n", len(state.HeldBack))
+	}
+}
+
+/*
+ * Schedules the summaries of restored notifications. Summaries of recipients whose
+ * quiet hours ended in the meantime are sent right away.
+ */
+func (m *Messenger) ScheduleSummaries() {
+	m.quietHoursMutex.Lock()
+	defer m.quietHoursMutex.Unlock()
+
+	now := m.Clock.Now()
+	for recipient, queue := range m.quietHoursQueues {
+		if queue.timer == nil {
+			m.scheduleSummary(recipient, queue, now)
+		}
+	}
+}
+
+/*
+ * Sends a summary of all notifications which were held back during quiet hours
+ */
+func (m *Messenger) sendQuietHoursSummary(recipient string) {
+	m.quietHoursMutex.Lock()
+	queue, exists := m.quietHoursQueues[recipient]
+	delete(m.quietHoursQueues, recipient)
+	m.quietHoursMutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	summaryParams := QuietHoursSummaryParams{
+		Events:              queue.events,
+		SuppressedReminders: queue.suppressedReminders,
+	}
+
+	messages := m.MessagesFor(recipient)
+	summaryText, err := m.RenderText(messages, messages.Summaries.QuietHours, summaryParams)
+	if err != nil {
+		log.Println("Messenger: Could not render quiet hours summary:", err)
+		return
+	}
+
+	log.Printf("Messenger: Quiet hours are over. Sending summary to %s\n", recipient)
+	m.Reply(recipient, summaryText)
+}
@@ -0,0 +1,179 @@
+package messenger
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+/*
+ * Enables quiet hours 22:00-07:00 for all recipients and 23:30-08:00 for recipient2.
+ * config.example.yaml has none.
+ */
+func useQuietHours(config *configManagerPkg.Config) {
+	config.QuietHours = configManagerPkg.QuietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Berlin", WatchdogBypass: true}
+
+	settings := config.Xmpp.RecipientSettings["recipient2@my.xmpp.host"]
+	settings.QuietHours = configManagerPkg.QuietHours{Start: "23:30", End: "08:00", Timezone: "Europe/Berlin"}
+	config.Xmpp.RecipientSettings["recipient2@my.xmpp.host"] = settings
+}
+
+/*
+ * Notifications are held back during quiet hours (22:00-07:00 for recipient1, 23:30-08:00 for recipient2)
+ * and summarized when quiet hours are over. Reminders are only counted, watchdog warnings bypass quiet hours.
+ */
+func TestHoldBackAndSummary(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Could not load time zone: %s", err)
+	}
+	start := time.Date(2021, time.November, 1, 23, 0, 0, 0, berlin)
+
+	fixture := newTestMessenger(t, useQuietHours)
+	messenger, clock, xmppMessageOutChannel := fixture.Messenger, fixture.Clock, fixture.OutChannel
+	clock.AdvanceTo(start)
+
+	expectRecipients := func(expected string) {
+		t.Helper()
+		select {
+		case message := <-xmppMessageOutChannel:
+			if recipients := strings.Join(message.(xmppmanager.XmppTextMessage).Recipients, ","); recipients != expected {
+				t.Errorf("Expected message to %s. Got %s", expected, recipients)
+			}
+		default:
+			t.Errorf("Expected message to %s", expected)
+		}
+	}
+
+	// 23:00: recipient1 is in quiet hours, recipient2 is not
+	messenger.notify(NotificationLevelChange, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return "level change", ""
+	})
+	expectRecipients("recipient2@my.xmpp.host")
+
+	messenger.notify(NotificationReminder, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return "reminder", ""
+	})
+	expectRecipients("recipient2@my.xmpp.host")
+
+	// 23:45: Both are in quiet hours. Watchdog warnings bypass the global quiet hours only.
+	clock.AdvanceTo(start.Add(45 * time.Minute))
+	messenger.notify(NotificationWatchdog, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return "sensor offline", ""
+	})
+	expectRecipients("recipient1@my.xmpp.host")
+
+	messenger.notify(NotificationReminder, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return "reminder", ""
+	})
+	if len(xmppMessageOutChannel) != 0 {
+		t.Fatalf("Expected all notifications to be held back. Got %v", <-xmppMessageOutChannel)
+	}
+
+	// Summaries at the end of the respective quiet hours
+	expectedSummaries := []struct {
+		end       time.Time
+		recipient string
+		text      string
+	}{
+		{time.Date(2021, time.November, 2, 7, 0, 0, 0, berlin), "recipient1@my.xmpp.host", "Guten Morgen! Während der Ruhezeit ist Folgendes passiert:\n23:00 Uhr: level change\nAußerdem habe ich 2 Erinnerung(en) zurückgehalten."},
+		{time.Date(2021, time.November, 2, 8, 0, 0, 0, berlin), "recipient2@my.xmpp.host", "Guten Morgen! Während der Ruhezeit ist Folgendes passiert:\n23:45 Uhr: sensor offline\nAußerdem habe ich 1 Erinnerung(en) zurückgehalten."},
+	}
+	for _, expected := range expectedSummaries {
+		clock.AdvanceTo(expected.end.Add(-time.Minute))
+		if len(xmppMessageOutChannel) != 0 {
+			t.Fatalf("Expected no summary before %s. Got %v", expected.end, <-xmppMessageOutChannel)
+		}
+
+		clock.AdvanceTo(expected.end)
+		select {
+		case message := <-xmppMessageOutChannel:
+			summary := message.(xmppmanager.XmppTextMessage)
+			if strings.Join(summary.Recipients, ",") != expected.recipient || summary.Text != expected.text {
+				t.Errorf("Expected summary \"%s\" to %s. Got \"%s\" to %v", expected.text, expected.recipient, summary.Text, summary.Recipients)
+			}
+		default:
+			t.Fatalf("Expected summary to %s at %s", expected.recipient, expected.end)
+		}
+	}
+
+	// After quiet hours, notifications are delivered right away
+	messenger.notify(NotificationLevelChange, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return "level change", ""
+	})
+	if message := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage); len(message.Recipients) != 0 {
+		t.Errorf("Expected level change to be broadcast. Got %v", message.Recipients)
+	}
+}
+
+/*
+ * Notifications held back during quiet hours survive a restart. Their summary is sent
+ * when quiet hours are over, right away if they ended during the restart.
+ */
+func TestHeldBackAcrossRestart(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Could not load time zone: %s", err)
+	}
+	start := time.Date(2021, time.November, 1, 23, 0, 0, 0, berlin)
+
+	fixture := newTestMessenger(t, useQuietHours)
+	messenger, xmppMessageOutChannel := fixture.Messenger, fixture.OutChannel
+	fixture.Clock.AdvanceTo(start)
+
+	// Held back for recipient1, delivered to recipient2
+	messenger.notify(NotificationLevelChange, nil, func(messages *configManagerPkg.Messages) (string, string) {
+		return "level change", ""
+	})
+	<-xmppMessageOutChannel
+	messenger.Stop()
+
+	stateJSON, err := json.Marshal(messenger.State())
+	if err != nil {
+		t.Fatalf("Could not save state: %s", err)
+	}
+
+	expectedSummary := "Guten Morgen! Während der Ruhezeit ist Folgendes passiert:\n23:00 Uhr: level change"
+	quietHoursEnd := time.Date(2021, time.November, 2, 7, 0, 0, 0, berlin)
+	restarts := []struct {
+		restart time.Time
+		summary time.Time
+	}{
+		{start.Add(7 * time.Hour), quietHoursEnd},                                          // 06:00: Summary at the end of quiet hours
+		{start.Add(8*time.Hour + 30*time.Minute), start.Add(8*time.Hour + 30*time.Minute)}, // 07:30: Summary right away
+	}
+	for _, restart := range restarts {
+		var state State
+		if err := json.Unmarshal(stateJSON, &state); err != nil {
+			t.Fatalf("Could not load state: %s", err)
+		}
+
+		restartedFixture := newTestMessenger(t, useQuietHours)
+		restarted, clock, xmppMessageOutChannel := restartedFixture.Messenger, restartedFixture.Clock, restartedFixture.OutChannel
+		clock.AdvanceTo(restart.restart)
+		restarted.Restore(state)
+		restarted.ScheduleSummaries()
+
+		if restart.summary.After(restart.restart) {
+			clock.AdvanceTo(restart.summary.Add(-time.Minute))
+			if len(xmppMessageOutChannel) != 0 {
+				t.Errorf("Restart at %s: Expected no summary during quiet hours. Got %v", restart.restart, <-xmppMessageOutChannel)
+			}
+		}
+
+		clock.AdvanceTo(restart.summary)
+		select {
+		case message := <-xmppMessageOutChannel:
+			summary := message.(xmppmanager.XmppTextMessage)
+			if summary.Text != expectedSummary || strings.Join(summary.Recipients, ",") != "recipient1@my.xmpp.host" {
+				t.Errorf("Restart at %s: Expected summary \"%s\" to recipient1. Got \"%s\" to %v", restart.restart, expectedSummary, summary.Text, summary.Recipients)
+			}
+		default:
+			t.Errorf("Restart at %s: Expected summary after quiet hours", restart.restart)
+		}
+	}
+}
@@ -5,9 +5,13 @@
 package messenger
 
 import (
+	"bytes"
 	"fmt"
 	"net/mail"
 	"strings"
+	"text/template"
+
+	"thomas-leister.de/plantmonitor/configmanager"
 )
 
 /*
@@ -30,3 +34,23 @@ func senderFromToJID(senderFrom string) (string, error) {
 
 	return senderJID, nil
 }
+
+/*
+ * Renders a message string from the language file as text/template with the given params.
+ * The template functions (duration, ago, in) format in the language of messages.
+ */
+func (m *Messenger) RenderText(messages *configmanager.Messages, templateText string, params interface{}) (string, error) {
+	var messageStringBuffer bytes.Buffer
+
+	messageTemplate, err := template.New("").Funcs(configmanager.TemplateFuncs(messages, m.Clock.Now())).Parse(templateText)
+	if err != nil {
+		return "", err
+	}
+
+	err = messageTemplate.Execute(&messageStringBuffer, params)
+	if err != nil {
+		return "", err
+	}
+
+	return messageStringBuffer.String(), nil
+}
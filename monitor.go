@@ -0,0 +1,77 @@
+/*
+ * Monitor:
+ * Connects the components which process a sensor reading
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+
+	messengerPkg "thomas-leister.de/plantmonitor/messenger"
+	quantifierPkg "thomas-leister.de/plantmonitor/quantifier"
+	reminderPkg "thomas-leister.de/plantmonitor/reminder"
+	sensorPkg "thomas-leister.de/plantmonitor/sensor"
+	watchdogPkg "thomas-leister.de/plantmonitor/watchdog"
+)
+
+type Monitor struct {
+	Sensor      *sensorPkg.Sensor
+	Quantifier  *quantifierPkg.Quantifier
+	Messenger   *messengerPkg.Messenger
+	Reminder    *reminderPkg.Reminder
+	Watchdog    *watchdogPkg.Watchdog
+	DataQuality *watchdogPkg.DataQuality
+}
+
+/*
+ * Processes a new raw sensor value:
+ * Feeds it into sensor and quantifier and sends messages / sets reminders on level changes
+ * deviceId: ID of the device which sent the reading. Empty if unknown.
+ * frameCounter: Frame counter (f_cnt) of the uplink. nil if unknown.
+ */
+func (mon *Monitor) ProcessReading(moistureRaw int, deviceId string, frameCounter *uint32) {
+	// Satisfy watchdog
+	mon.Watchdog.Reset(deviceId, frameCounter)
+
+	// Check for stuck or flatlined sensor
+	mon.DataQuality.Check(moistureRaw)
+
+	// Update current sensor value
+	mon.Sensor.UpdateCurrentValue(moistureRaw)
+	log.Printf("Raw sensor value: %d  |  Current normalized and filtered value: %d %% \n", moistureRaw, mon.Sensor.Normalized.Current.Value)
+
+	// Save state before first value is evaluated, because then history will exist for sure ;)
+	quantifierHistoryExists := mon.Quantifier.HistoryExists()
+
+	// Put current sensor value into quantifier
+	levelDirection, currentLevel, err := mon.Quantifier.EvaluateValue(mon.Sensor.Normalized.Current.Value)
+	if err != nil {
+		var unquantifiableErr *quantifierPkg.UnquantifiableError
+		if errors.As(err, &unquantifiableErr) {
+			log.Printf("Reading is unquantifiable. Keeping level '%s': %s", currentLevel.Name, err)
+
+			// Notify admins only once per series of unquantifiable readings
+			if mon.Quantifier.Unquantifiable.Count == 1 {
+				mon.Messenger.SendUnquantifiableWarning(unquantifiableErr.Value, unquantifiableErr.Reason)
+			}
+		} else {
+			log.Printf("Error happened during evaluation: %s", err)
+		}
+		return
+	}
+
+	/*
+	 * Check if level has changed. Only notify
+	 *     - on level change or
+	 *     - if no history exists (first sensor value was read / quantified)
+	 */
+	if (levelDirection != 0) || (!quantifierHistoryExists) {
+		// Send message via messenger
+		mon.Messenger.ResolveLevelToMessage(mon.Sensor.Normalized.Current.Value, levelDirection, currentLevel)
+
+		// Stop all reminders for the old level. If new level demands reminders, set them.
+		mon.Reminder.Set(currentLevel)
+	}
+}
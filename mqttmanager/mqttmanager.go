@@ -1,15 +1,20 @@
 package mqttmanager
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
 	"thomas-leister.de/plantmonitor/configmanager"
 )
 
+// Max. time to wait for unsubscribing and disconnecting
+const disconnectTimeout = time.Second
+
 type MqttClient struct {
 	Host               string
 	Port               int
@@ -19,6 +24,7 @@ type MqttClient struct {
 	ClientId           string
 	connectHandler     mqtt.OnConnectHandler
 	connectLostHandler mqtt.OnConnectHandler
+	client             mqtt.Client
 }
 
 type MqttDecodedPayload struct {
@@ -26,14 +32,21 @@ type MqttDecodedPayload struct {
 }
 
 type MqttUplinkMessage struct {
+	DeviceId       string             `json:"-"`               // ID of the end device which sent the uplink. Empty if not provided.
+	FCnt           *uint32            `json:"f_cnt"`           // Frame counter of the uplink. nil if not provided.
 	DecodedPayload MqttDecodedPayload `json:"decoded_payload"` //decoded_payload stores the already-decoded payload from TTN
 }
 
+type MqttEndDeviceIds struct {
+	DeviceId string `json:"device_id"`
+}
+
 type MqttPayload struct {
+	EndDeviceIds  MqttEndDeviceIds  `json:"end_device_ids"`
 	UplinkMessage MqttUplinkMessage `json:"uplink_message"`
 }
 
-func (m *MqttClient) ParseMqttMessage(mqttMessage mqtt.Message) MqttDecodedPayload {
+func (m *MqttClient) ParseMqttMessage(mqttMessage mqtt.Message) MqttUplinkMessage {
 	var mqttPayload MqttPayload
 
 	err := json.Unmarshal(mqttMessage.Payload(), &mqttPayload)
@@ -41,7 +54,9 @@ func (m *MqttClient) ParseMqttMessage(mqttMessage mqtt.Message) MqttDecodedPaylo
 		panic(err)
 	}
 
-	return mqttPayload.UplinkMessage.DecodedPayload
+	uplinkMessage := mqttPayload.UplinkMessage
+	uplinkMessage.DeviceId = mqttPayload.EndDeviceIds.DeviceId
+	return uplinkMessage
 }
 
 func (m *MqttClient) ConnectHandler(client mqtt.Client) {
@@ -63,7 +78,11 @@ func (m *MqttClient) Init(config *configmanager.Config) {
 	m.ClientId = config.Mqtt.ClientId
 }
 
-func (m *MqttClient) RunMQTTListener(mqttMessageChannel chan MqttDecodedPayload) {
+/*
+ * Connects to the MQTT broker and subscribes to the topic.
+ * Received payloads are sent to mqttMessageChannel until ctx is done.
+ */
+func (m *MqttClient) Start(ctx context.Context, mqttMessageChannel chan MqttUplinkMessage) error {
 	opts := mqtt.NewClientOptions()
 
 	// Set options for connection
@@ -73,21 +92,48 @@ func (m *MqttClient) RunMQTTListener(mqttMessageChannel chan MqttDecodedPayload)
 	opts.SetPassword(m.Password)
 
 	// Set callback functions
-	opts.SetDefaultPublishHandler(func(c mqtt.Client, message mqtt.Message) {
-		mqttDecodedPayload := m.ParseMqttMessage(message)
-		mqttMessageChannel <- mqttDecodedPayload
-	})
+	opts.SetDefaultPublishHandler(m.publishHandler(ctx, mqttMessageChannel))
 	opts.OnConnect = m.ConnectHandler
 	opts.OnConnectionLost = m.ConnectLostHandler
 
 	// Create client
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	m.client = mqtt.NewClient(opts)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not connect to %s: %s", m.Host, token.Error())
 	}
 
 	// Subscribe to topic
-	token := client.Subscribe(m.Topic, 1, nil)
-	token.Wait()
+	if token := m.client.Subscribe(m.Topic, 1, nil); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not subscribe to topic %s: %s", m.Topic, token.Error())
+	}
 	log.Printf("MQTT: Subscribed to topic %s \n", m.Topic)
+
+	return nil
+}
+
+/*
+ * Returns a handler which sends received payloads to mqttMessageChannel until ctx is done
+ */
+func (m *MqttClient) publishHandler(ctx context.Context, mqttMessageChannel chan MqttUplinkMessage) mqtt.MessageHandler {
+	return func(c mqtt.Client, message mqtt.Message) {
+		mqttUplinkMessage := m.ParseMqttMessage(message)
+		select {
+		case mqttMessageChannel <- mqttUplinkMessage:
+		case <-ctx.Done():
+			log.Println("MQTT: Shutting down. Dropping received message.")
+		}
+	}
+}
+
+/*
+ * Unsubscribes from the topic and disconnects from the MQTT broker
+ */
+func (m *MqttClient) Stop() {
+	if m.client == nil || !m.client.IsConnected() {
+		return
+	}
+
+	m.client.Unsubscribe(m.Topic).WaitTimeout(disconnectTimeout)
+	m.client.Disconnect(uint(disconnectTimeout.Milliseconds()))
+	log.Println("MQTT: Disconnected")
 }
@@ -0,0 +1,73 @@
+package mqttmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Received MQTT message with a fixed payload
+type fakeMessage struct {
+	payload []byte
+}
+
+func (f fakeMessage) Duplicate() bool   { return false }
+func (f fakeMessage) Qos() byte         { return 1 }
+func (f fakeMessage) Retained() bool    { return false }
+func (f fakeMessage) Topic() string     { return "v3/plantmonitor/devices/plant-a/up" }
+func (f fakeMessage) MessageID() uint16 { return 1 }
+func (f fakeMessage) Payload() []byte   { return f.payload }
+func (f fakeMessage) Ack()              {}
+
+var uplinkPayload = []byte(`{"end_device_ids": {"device_id": "plant-a"}, "uplink_message": {"f_cnt": 42, "decoded_payload": {"moisture_raw": 2557}}}`)
+
+/*
+ * Received payloads are parsed and forwarded while the context is running
+ */
+func TestPublishHandlerForwards(t *testing.T) {
+	m := MqttClient{}
+	mqttMessageChannel := make(chan MqttUplinkMessage, 1)
+	handler := m.publishHandler(context.Background(), mqttMessageChannel)
+
+	handler(nil, fakeMessage{payload: uplinkPayload})
+
+	select {
+	case message := <-mqttMessageChannel:
+		if message.DeviceId != "plant-a" || message.FCnt == nil || *message.FCnt != 42 || message.DecodedPayload.MoistureRaw != 2557 {
+			t.Errorf("Unexpected uplink message %+v", message)
+		}
+	default:
+		t.Error("Expected uplink message to be forwarded")
+	}
+}
+
+/*
+ * After the context is done, received payloads are dropped instead of blocking the MQTT client
+ */
+func TestPublishHandlerDropsAfterShutdown(t *testing.T) {
+	m := MqttClient{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mqttMessageChannel := make(chan MqttUplinkMessage) // Nobody receives anymore
+	handler := m.publishHandler(ctx, mqttMessageChannel)
+
+	done := make(chan struct{})
+	go func() {
+		handler(nil, fakeMessage{payload: uplinkPayload})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected handler to return after shutdown")
+	}
+}
+
+/*
+ * Stopping a client which never connected does nothing
+ */
+func TestStopWithoutStart(t *testing.T) {
+	m := MqttClient{}
+	m.Stop()
+}
@@ -0,0 +1,336 @@
+/*
+ * Preferences:
+ * Per-recipient settings: subscribed event types and plants, GIFs, quiet hours and language.
+ * Defaults come from config (quiet_hours, lang_code, xmpp.recipient_settings).
+ * Recipients can override them via chat. Overrides are stored in a JSON file.
+ */
+
+package preferences
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"thomas-leister.de/plantmonitor/configmanager"
+)
+
+/*
+ * Quiet hours set via chat, "HH:MM". Start and End empty = no quiet hours.
+ */
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+/*
+ * Settings a recipient has changed via chat. nil / missing entries fall back to config.
+ */
+type Preferences struct {
+	Events     map[string]bool `json:"events,omitempty"`      // Event type => subscribed
+	Plants     *[]string       `json:"plants,omitempty"`      // Plant names to be notified about. Empty = all
+	Gifs       *bool           `json:"gifs,omitempty"`        // Whether GIFs are sent
+	QuietHours *QuietHours     `json:"quiet_hours,omitempty"` // Replaces configured quiet hours
+	Language   string          `json:"language,omitempty"`    // Language code
+}
+
+type Store struct {
+	FilePath string // JSON file the preferences are stored in. Empty = not persisted.
+
+	mutex       sync.Mutex
+	defaults    map[string]configmanager.RecipientSettings // Settings from config per recipient JID
+	quietHours  configmanager.QuietHours                   // Global quiet hours from config
+	langCode    string                                     // Default language from config
+	preferences map[string]*Preferences                    // Preferences changed via chat per recipient JID
+}
+
+func (s *Store) Init(config *configmanager.Config) error {
+	log.Println("Preferences: Initializing preferences ...")
+
+	s.FilePath = config.PreferencesFile
+	s.preferences = make(map[string]*Preferences)
+	s.loadDefaults(config)
+
+	return s.load()
+}
+
+func (s *Store) Reload(config *configmanager.Config) {
+	log.Println("Preferences: Reloading recipient settings")
+	s.loadDefaults(config)
+}
+
+func (s *Store) loadDefaults(config *configmanager.Config) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.defaults = config.Xmpp.RecipientSettings
+	s.quietHours = config.QuietHours
+	s.langCode = config.LangCode
+}
+
+/*
+ * Reads preferences from file. A missing file is not an error (nothing has been changed yet).
+ */
+func (s *Store) load() error {
+	if s.FilePath == "" {
+		return nil
+	}
+
+	preferencesJSON, err := ioutil.ReadFile(s.FilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	preferences := make(map[string]*Preferences)
+	if err := json.Unmarshal(preferencesJSON, &preferences); err != nil {
+		return err
+	}
+	if preferences == nil {
+		preferences = make(map[string]*Preferences)
+	}
+
+	s.mutex.Lock()
+	s.preferences = preferences
+	s.mutex.Unlock()
+
+	log.Printf("Preferences: Loaded preferences of %d recipient(s) from %s\n", len(preferences), s.FilePath)
+	return nil
+}
+
+/*
+ * Writes preferences to file. The file is replaced atomically, so it does not
+ * get corrupted if plantmonitor is stopped while writing.
+ * Needs to be called with mutex held.
+ */
+func (s *Store) save() error {
+	if s.FilePath == "" {
+		return nil
+	}
+
+	preferencesJSON, err := json.MarshalIndent(s.preferences, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(s.FilePath), filepath.Base(s.FilePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(preferencesJSON); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), s.FilePath)
+}
+
+/*
+ * Changes the preferences of a recipient and saves them.
+ * If saving fails, the change is still in effect until restart.
+ */
+func (s *Store) update(jid string, change func(preferences *Preferences)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	preferences, exists := s.preferences[jid]
+	if !exists {
+		preferences = &Preferences{}
+		s.preferences[jid] = preferences
+	}
+	change(preferences)
+
+	return s.save()
+}
+
+/*
+ * Whether a recipient receives notifications of an event type
+ */
+func (s *Store) Subscribed(jid string, eventType string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if preferences, exists := s.preferences[jid]; exists {
+		if subscribed, exists := preferences.Events[eventType]; exists {
+			return subscribed
+		}
+	}
+
+	defaultEvents := s.defaults[jid].Events
+	if len(defaultEvents) == 0 {
+		return true
+	}
+	for _, defaultEventType := range defaultEvents {
+		if defaultEventType == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Whether a recipient receives notifications about a plant (plant_name, case-insensitive)
+ */
+func (s *Store) SubscribedToPlant(jid string, plantName string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Without plant_name, there is nothing to filter by
+	if plantName == "" {
+		return true
+	}
+
+	plants := s.defaults[jid].Plants
+	if preferences, exists := s.preferences[jid]; exists && preferences.Plants != nil {
+		plants = *preferences.Plants
+	}
+	if len(plants) == 0 {
+		return true
+	}
+	for _, plant := range plants {
+		if strings.EqualFold(strings.TrimSpace(plant), plantName) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns the plant names a recipient is notified about: Chosen via chat or from recipient settings.
+ * Empty = all plants.
+ */
+func (s *Store) Plants(jid string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if preferences, exists := s.preferences[jid]; exists && preferences.Plants != nil {
+		return *preferences.Plants
+	}
+	return s.defaults[jid].Plants
+}
+
+/*
+ * Whether a recipient receives GIFs
+ */
+func (s *Store) Gifs(jid string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if preferences, exists := s.preferences[jid]; exists && preferences.Gifs != nil {
+		return *preferences.Gifs
+	}
+	if defaultGifs := s.defaults[jid].Gifs; defaultGifs != nil {
+		return *defaultGifs
+	}
+	return true
+}
+
+/*
+ * Returns the quiet hours of a recipient: Changed via chat, from recipient settings or global (in that order).
+ * Quiet hours changed via chat keep time zone and watchdog bypass of the configured quiet hours.
+ */
+func (s *Store) QuietHours(jid string) configmanager.QuietHours {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	quietHours := s.quietHours
+	if recipientQuietHours := s.defaults[jid].QuietHours; recipientQuietHours.Enabled() {
+		quietHours = recipientQuietHours
+	}
+
+	if preferences, exists := s.preferences[jid]; exists && preferences.QuietHours != nil {
+		quietHours.Start = preferences.QuietHours.Start
+		quietHours.End = preferences.QuietHours.End
+	}
+
+	return quietHours
+}
+
+/*
+ * Returns the language code of a recipient: Chosen via chat, from recipient settings or default (in that order)
+ */
+func (s *Store) Language(jid string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if preferences, exists := s.preferences[jid]; exists && preferences.Language != "" {
+		return preferences.Language
+	}
+	if language := s.defaults[jid].Language; language != "" {
+		return language
+	}
+	return s.langCode
+}
+
+/*
+ * Subscribes or unsubscribes a recipient to / from event types
+ */
+func (s *Store) SetSubscribed(jid string, eventTypes []string, subscribed bool) error {
+	return s.update(jid, func(preferences *Preferences) {
+		if preferences.Events == nil {
+			preferences.Events = make(map[string]bool)
+		}
+		for _, eventType := range eventTypes {
+			preferences.Events[eventType] = subscribed
+		}
+	})
+}
+
+/*
+ * Sets the plants a recipient is notified about. Empty = all plants.
+ */
+func (s *Store) SetPlants(jid string, plants []string) error {
+	return s.update(jid, func(preferences *Preferences) {
+		preferences.Plants = &plants
+	})
+}
+
+/*
+ * Removes plants which were chosen via chat, so configured plants apply again
+ */
+func (s *Store) ResetPlants(jid string) error {
+	return s.update(jid, func(preferences *Preferences) {
+		preferences.Plants = nil
+	})
+}
+
+func (s *Store) SetGifs(jid string, gifs bool) error {
+	return s.update(jid, func(preferences *Preferences) {
+		preferences.Gifs = &gifs
+	})
+}
+
+/*
+ * Sets quiet hours of a recipient. Empty start and end = no quiet hours.
+ */
+func (s *Store) SetQuietHours(jid string, start string, end string) error {
+	return s.update(jid, func(preferences *Preferences) {
+		preferences.QuietHours = &QuietHours{Start: start, End: end}
+	})
+}
+
+/*
+ * Removes quiet hours which were set via chat, so configured quiet hours apply again
+ */
+func (s *Store) ResetQuietHours(jid string) error {
+	return s.update(jid, func(preferences *Preferences) {
+		preferences.QuietHours = nil
+	})
+}
+
+func (s *Store) SetLanguage(jid string, langCode string) error {
+	return s.update(jid, func(preferences *Preferences) {
+		preferences.Language = langCode
+	})
+}
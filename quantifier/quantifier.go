@@ -20,6 +20,9 @@ type QuantificationLevel struct {
 	End                  int           // ""
 	Name                 string        // Level name, such as "low", "normal", "high"
 	NotificationInterval time.Duration // Notification interval in seconds
+	MinDwellReadings     int           // Consecutive readings on this level before a change to it is reported (0 = disabled)
+	MinDwellTime         time.Duration // Time this level must be observed before a change to it is reported (0 = disabled)
+	Presence             string        // XMPP presence while on this level, e.g. "away"
 }
 
 type QuantificationResult struct {
@@ -27,11 +30,46 @@ type QuantificationResult struct {
 	QuantificationLevel QuantificationLevel // Old quantification level
 }
 
+/*
+ * A level which has been matched by recent readings,
+ * but which has not been observed long enough to be reported, yet.
+ */
+type PendingLevelChange struct {
+	QuantificationLevel QuantificationLevel // Newly observed level
+	Since               time.Time           // Time of the first reading on that level
+	Readings            int                 // Number of consecutive readings on that level
+}
+
+/*
+ * Returned if a value cannot be assigned to exactly one level,
+ * e.g. because it falls into a gap between levels.
+ */
+type UnquantifiableError struct {
+	Value  int    // Normalized sensor value which could not be quantified
+	Reason string // Why the value could not be quantified
+}
+
+func (e *UnquantifiableError) Error() string {
+	return fmt.Sprintf("cannot assign quantification level to value %d: %s", e.Value, e.Reason)
+}
+
+/*
+ * Series of consecutive readings which could not be quantified.
+ * Reset as soon as a reading can be quantified again.
+ */
+type UnquantifiableReadings struct {
+	Count     int       // Number of consecutive unquantifiable readings
+	LastValue int       // Last unquantifiable value
+	Since     time.Time // Time of the first unquantifiable reading in this series
+}
+
 type Quantifier struct {
-	Current              QuantificationResult  // the current quantification result
-	History              QuantificationResult  // old value and level for comparison / history
-	QuantificationLevels []QuantificationLevel // All available quantification levels.
-	Sensor               *sensor.Sensor        // Sensor for which to quantify (use for hysteresis)
+	Current              QuantificationResult   // the current quantification result
+	History              QuantificationResult   // old value and level for comparison / history
+	Pending              PendingLevelChange     // level change waiting for its dwell time to pass
+	Unquantifiable       UnquantifiableReadings // readings which could not be assigned to a level
+	QuantificationLevels []QuantificationLevel  // All available quantification levels.
+	Sensor               *sensor.Sensor         // Sensor for which to quantify (use for hysteresis)
 }
 
 func (q *Quantifier) Init(config *configmanager.Config, sensor *sensor.Sensor) {
@@ -47,9 +85,11 @@ func (q *Quantifier) Init(config *configmanager.Config, sensor *sensor.Sensor) {
 	q.loadLevels(config)
 }
 
-func (q *Quantifier) loadLevels(config *configmanager.Config) {
-	// Read all quantification levels from config and copy them into q.QuantificationLevels
-	q.QuantificationLevels = make([]QuantificationLevel, 0)
+/*
+ * Reads all quantification levels from config
+ */
+func LevelsFromConfig(config *configmanager.Config) []QuantificationLevel {
+	levels := make([]QuantificationLevel, 0)
 
 	for _, level := range config.Levels {
 		// Map values from config to QuantificationLevel attributes. Most attributes match 1:1, but some need extra care.
@@ -58,15 +98,32 @@ func (q *Quantifier) loadLevels(config *configmanager.Config) {
 		newLevel.End = level.End
 		newLevel.Name = level.Name
 		newLevel.NotificationInterval = time.Duration(level.NotificationInterval) * time.Second
+		newLevel.MinDwellReadings = level.MinDwellReadings
+		newLevel.MinDwellTime = time.Duration(level.MinDwellTime) * time.Second
+
+		// Levels which need attention (reminders) are shown as "away" by default
+		newLevel.Presence = level.Presence
+		if newLevel.Presence == "" {
+			newLevel.Presence = configmanager.PresenceAvailable
+			if level.RemindersEnabled() {
+				newLevel.Presence = configmanager.PresenceAway
+			}
+		}
 
 		// Append new item to levels
-		q.QuantificationLevels = append(q.QuantificationLevels, newLevel)
+		levels = append(levels, newLevel)
 	}
 
+	return levels
+}
+
+func (q *Quantifier) loadLevels(config *configmanager.Config) {
+	// Read all quantification levels from config and copy them into q.QuantificationLevels
+	q.QuantificationLevels = LevelsFromConfig(config)
+
 	// Output table showing quantification levels and thresholds
-	fmt.Printf("\nAvailable quantification levels:\n\n")
-	printLevelTable(&q.QuantificationLevels)
-	fmt.Printf("\n")
+	log.Printf("Available quantification levels:\n\n")
+	PrintLevelTable(log.Writer(), q.QuantificationLevels)
 }
 
 func (q *Quantifier) Reload(config *configmanager.Config) {
@@ -90,7 +147,7 @@ func (q *Quantifier) Quantify(value int, hysteresisMargin int) (QuantificationLe
 		}
 	}
 
-	return QuantificationLevel{}, fmt.Errorf("cannot asign quantification level - Value out of range")
+	return QuantificationLevel{}, &UnquantifiableError{Value: value, Reason: "value out of range"}
 }
 
 /*
@@ -130,7 +187,7 @@ func (q *Quantifier) QuantifyNew(value int, hysteresisMargin int) (Quantificatio
 	switch len(matchedLevels) {
 	case 0:
 		// No level could be matched. Value out or range
-		return QuantificationLevel{}, fmt.Errorf("cannot assign quantification level. Value out of range")
+		return QuantificationLevel{}, &UnquantifiableError{Value: value, Reason: "value out of range"}
 	case 1:
 		// Clear situation: This value can only be on this single level
 		return matchedLevels[0], nil
@@ -155,10 +212,10 @@ func (q *Quantifier) QuantifyNew(value int, hysteresisMargin int) (Quantificatio
 			// We expect only one level to be returned
 			if len(matchedLevels) == 0 {
 				// no level could be identified
-				return QuantificationLevel{}, fmt.Errorf("cannot assign quantification level. Value out of range")
+				return QuantificationLevel{}, &UnquantifiableError{Value: value, Reason: "value out of range"}
 			} else if len(matchedLevels) > 1 {
 				// Multiple levels could be identified. Overlap detected without blurry match! Something must be wrong in config.
-				return QuantificationLevel{}, fmt.Errorf("multiple levels are matching. Overlap in level configuration?")
+				return QuantificationLevel{}, &UnquantifiableError{Value: value, Reason: "multiple levels are matching. Overlap in level configuration?"}
 			} else {
 				// A single suitable level was found. Return it.
 				return matchedLevels[0], nil
@@ -174,6 +231,9 @@ func (q *Quantifier) QuantifyNew(value int, hysteresisMargin int) (Quantificatio
  * - Return suitable message for the current level, depending on history, e.g. ChatMessageUp or ChatMessageDown
  *
  * levelDirection: -1 = decreasing | 0 = stable | +1 = increasing
+ *
+ * If the value cannot be quantified, the previous level is returned together
+ * with an error wrapping *UnquantifiableError.
  */
 func (q *Quantifier) EvaluateValue(moistureValue int) (int, QuantificationLevel, error) {
 	var levelDirection int = 0
@@ -183,8 +243,29 @@ func (q *Quantifier) EvaluateValue(moistureValue int) (int, QuantificationLevel,
 	hysteresisMargin := (q.Sensor.Normalized.NoiseMargin / 2)
 	currentLevel, err := q.QuantifyNew(moistureValue, hysteresisMargin)
 	if err != nil {
-		return levelDirection, QuantificationLevel{}, fmt.Errorf("could not evaluate new moisture value: %s", err)
+		// Record unquantifiable reading and keep the previous level
+		if q.Unquantifiable.Count == 0 {
+			q.Unquantifiable.Since = q.Sensor.LastUpdated
+		}
+		q.Unquantifiable.Count++
+		q.Unquantifiable.LastValue = moistureValue
+
+		return levelDirection, q.History.QuantificationLevel, fmt.Errorf("could not evaluate new moisture value: %w", err)
+	}
+	q.Unquantifiable = UnquantifiableReadings{}
+
+	// Time-based hysteresis: A new level is only reported after it has been observed for a while
+	if q.HistoryExists() && currentLevel.Name != q.History.QuantificationLevel.Name {
+		if !q.dwellSatisfied(currentLevel) {
+			log.Printf("Quantifier: Level %s observed for %d reading(s) since %s. Keeping level %s for now.",
+				currentLevel.Name, q.Pending.Readings, q.Pending.Since.Format(time.RFC3339), q.History.QuantificationLevel.Name)
+
+			// Keep previous level and do not touch history, so the level change can still be detected later
+			q.Current = QuantificationResult{Value: moistureValue, QuantificationLevel: q.History.QuantificationLevel}
+			return levelDirection, q.History.QuantificationLevel, nil
+		}
 	}
+	q.Pending = PendingLevelChange{}
 
 	// Save current value and level
 	q.Current = QuantificationResult{Value: moistureValue, QuantificationLevel: currentLevel}
@@ -213,6 +294,37 @@ func (q *Quantifier) EvaluateValue(moistureValue int) (int, QuantificationLevel,
 	return levelDirection, currentLevel, err
 }
 
+/*
+ * Checks whether a newly observed level has been seen for long enough
+ * (MinDwellReadings consecutive readings or MinDwellTime, whichever is
+ * reached first) to be reported.
+ * The time of the current reading is taken from the sensor.
+ */
+func (q *Quantifier) dwellSatisfied(level QuantificationLevel) bool {
+	readingTime := q.Sensor.LastUpdated
+
+	// Start counting if this level has not been pending before
+	if q.Pending.QuantificationLevel.Name != level.Name {
+		q.Pending = PendingLevelChange{QuantificationLevel: level, Since: readingTime}
+	}
+	q.Pending.Readings++
+
+	// No dwell condition configured: Report change immediately
+	if level.MinDwellReadings <= 0 && level.MinDwellTime <= 0 {
+		return true
+	}
+
+	// Either of the configured conditions is sufficient
+	if level.MinDwellReadings > 0 && q.Pending.Readings >= level.MinDwellReadings {
+		return true
+	}
+	if level.MinDwellTime > 0 && readingTime.Sub(q.Pending.Since) >= level.MinDwellTime {
+		return true
+	}
+
+	return false
+}
+
 func (q *Quantifier) HistoryExists() bool {
 	if (q.History != QuantificationResult{}) {
 		return true
@@ -220,3 +332,32 @@ func (q *Quantifier) HistoryExists() bool {
 		return false
 	}
 }
+
+/*
+ * Quantifier state which is persisted across restarts: The last reported level
+ */
+type State struct {
+	Level string `json:"level"` // Level name. Empty if there is no history.
+	Value int    `json:"value"`
+}
+
+func (q *Quantifier) State() State {
+	return State{Level: q.History.QuantificationLevel.Name, Value: q.History.Value}
+}
+
+/*
+ * Restores a persisted state. Returns the restored level.
+ * ok is false if there is no state or the level does not exist anymore.
+ */
+func (q *Quantifier) Restore(state State) (QuantificationLevel, bool) {
+	for _, level := range q.QuantificationLevels {
+		if state.Level != "" && level.Name == state.Level {
+			q.History = QuantificationResult{Value: state.Value, QuantificationLevel: level}
+			q.Current = q.History
+			log.Printf("Quantifier: Restored level %s\n", level.Name)
+			return level, true
+		}
+	}
+
+	return QuantificationLevel{}, false
+}
@@ -1,8 +1,10 @@
 package quantifier
 
 import (
+	"errors"
 	"log"
 	"testing"
+	"time"
 
 	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
 	sensorPkg "thomas-leister.de/plantmonitor/sensor"
@@ -44,7 +46,7 @@ func TestEvaluateValue(t *testing.T) {
 	var previousSensorDir int
 
 	// Read config
-	config, err = configManagerPkg.ReadConfig("config.example.yaml")
+	config, err = configManagerPkg.ReadConfig("config.example.yaml", ".")
 	if err != nil {
 		log.Fatal("Could not parse config:", err)
 	} else {
@@ -126,3 +128,129 @@ func TestEvaluateValue(t *testing.T) {
 	}
 
 }
+
+/*
+ * Test time-based hysteresis: a new level needs to be observed for a number
+ * of readings / a certain time before a level change is reported.
+ */
+func TestEvaluateValueDwell(t *testing.T) {
+	var err error
+	var testcases []TestCase
+
+	// Read config
+	config, err = configManagerPkg.ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		log.Fatal("Could not parse config:", err)
+	}
+
+	// Init sensor
+	sensor := sensorPkg.Sensor{}
+	sensor.Init(&config)
+
+	// Init quantifier
+	quantifier := Quantifier{}
+	quantifier.Init(&config, &sensor)
+
+	// "high" level requires 3 consecutive readings or at least 10 minutes
+	for i := range quantifier.QuantificationLevels {
+		if quantifier.QuantificationLevels[i].Name == "high" {
+			quantifier.QuantificationLevels[i].MinDwellReadings = 3
+			quantifier.QuantificationLevels[i].MinDwellTime = 10 * time.Minute
+		}
+	}
+
+	// Minutes since start at which each sensor value is read
+	minutes := []int{0, 5, 10, 11, 12, 13, 14, 20, 30, 31}
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_NORMAL, 0, "normal"})  // TC 0: Start with normal level
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_HIGH, 0, "normal"})    // TC 1: High level observed once. Keep normal level.
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_NORMAL, 0, "normal"})  // TC 2: Back to normal. Resets pending level.
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_HIGH, 0, "normal"})    // TC 3: High level observed once (0 min)
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_HIGH, 0, "normal"})    // TC 4: High level observed twice (1 min)
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_HIGH, +1, "high"})     // TC 5: High level observed three times (2 min). Readings suffice, report change.
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_NORMAL, -1, "normal"}) // TC 6: Normal level has no dwell time. Report change immediately.
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_HIGH, 0, "normal"})    // TC 7: High level observed once (0 min)
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_HIGH, +1, "high"})     // TC 8: High level observed twice (10 min). Time suffices, report change.
+	testcases = append(testcases, TestCase{SENSOR_NORMALIZED_VALUE_HIGH, 0, "high"})      // TC 9: Stay high
+
+	start := time.Date(2021, time.November, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, testcase := range testcases {
+		log.Printf("Running TC %d", i)
+
+		// Mock reading time. This is usually set by Sensor.UpdateCurrentValue()
+		sensor.LastUpdated = start.Add(time.Duration(minutes[i]) * time.Minute)
+
+		levelDirection, currentLevel, err := quantifier.EvaluateValue(testcase.SensorNormalizedValue)
+		if err != nil {
+			t.Errorf("\tFailed to run testcase %d: %s", i, err)
+			continue
+		}
+
+		if levelDirection != testcase.ExpectedLevelDirection {
+			t.Errorf("\tTestcase %d failed: Expected level direction: %d. Got level direction %d\n", i, testcase.ExpectedLevelDirection, levelDirection)
+			continue
+		}
+
+		if currentLevel.Name != testcase.ExpectedLevelName {
+			t.Errorf("\tTestcase %d failed: Expected level: %s. Got level %s\n", i, testcase.ExpectedLevelName, currentLevel.Name)
+			continue
+		}
+
+		log.Printf("\tTC %d successful!\n", i)
+	}
+}
+
+/*
+ * Values which fall into a gap between levels return an UnquantifiableError
+ * and keep the previous level.
+ */
+func TestEvaluateValueUnquantifiable(t *testing.T) {
+	var err error
+
+	// Read config
+	config, err = configManagerPkg.ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		log.Fatal("Could not parse config:", err)
+	}
+
+	// Init sensor
+	sensor := sensorPkg.Sensor{}
+	sensor.Init(&config)
+
+	// Init quantifier and open a gap (40..50) in "normal" level
+	quantifier := Quantifier{}
+	quantifier.Init(&config, &sensor)
+	quantifier.QuantificationLevels = append(quantifier.QuantificationLevels, quantifier.QuantificationLevels[1])
+	quantifier.QuantificationLevels[1].End = 39
+	quantifier.QuantificationLevels[len(quantifier.QuantificationLevels)-1].Start = 51
+
+	if _, _, err := quantifier.EvaluateValue(SENSOR_NORMALIZED_VALUE_NORMAL_LOWEREDGE); err != nil {
+		t.Fatalf("Failed to evaluate value: %s", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		levelDirection, currentLevel, err := quantifier.EvaluateValue(45)
+
+		var unquantifiableErr *UnquantifiableError
+		if !errors.As(err, &unquantifiableErr) {
+			t.Fatalf("Expected UnquantifiableError. Got: %v", err)
+		}
+		if unquantifiableErr.Value != 45 {
+			t.Errorf("Expected unquantifiable value 45. Got %d", unquantifiableErr.Value)
+		}
+		if levelDirection != 0 || currentLevel.Name != "normal" {
+			t.Errorf("Expected to keep level normal with direction 0. Got level %s with direction %d", currentLevel.Name, levelDirection)
+		}
+		if quantifier.Unquantifiable.Count != i {
+			t.Errorf("Expected %d unquantifiable readings. Got %d", i, quantifier.Unquantifiable.Count)
+		}
+	}
+
+	// Series of unquantifiable readings ends with the next valid reading
+	if _, _, err := quantifier.EvaluateValue(SENSOR_NORMALIZED_VALUE_NORMAL); err != nil {
+		t.Fatalf("Failed to evaluate value: %s", err)
+	}
+	if quantifier.Unquantifiable.Count != 0 {
+		t.Errorf("Expected unquantifiable readings to be reset. Got %d", quantifier.Unquantifiable.Count)
+	}
+}
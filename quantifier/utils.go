@@ -5,21 +5,24 @@
 package quantifier
 
 import (
-	"os"
+	"io"
 	"strconv"
 
 	"github.com/olekukonko/tablewriter"
 )
 
-func printLevelTable(levels *[]QuantificationLevel) {
+/*
+ * Renders a table of levels and their thresholds to w
+ */
+func PrintLevelTable(w io.Writer, levels []QuantificationLevel) {
 	data := [][]string{}
 
-	for _, level := range *levels {
+	for _, level := range levels {
 		newlevel := []string{level.Name, strconv.Itoa(level.Start), strconv.Itoa(level.End)}
 		data = append(data, newlevel)
 	}
 
-	table := tablewriter.NewWriter(os.Stdout)
+	table := tablewriter.NewWriter(w)
 	table.SetHeader([]string{"Level", "From", "To"})
 	table.SetBorder(true)  // Set Border to false
 	table.AppendBulk(data) // Add Bulk Data
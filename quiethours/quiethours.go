@@ -0,0 +1,114 @@
+/*
+ * Quiet hours:
+ * Daily time window (e.g. 22:00 - 07:00 in a certain time zone)
+ * during which non-critical notifications should not be delivered.
+ */
+
+package quiethours
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Schedule struct {
+	Start    time.Duration  // Start of quiet hours as offset from midnight
+	End      time.Duration  // End of quiet hours as offset from midnight
+	Location *time.Location // Time zone of Start and End
+}
+
+/*
+ * Parses start and end times ("HH:MM") and an IANA time zone name (e.g. "Europe/Berlin").
+ * An empty time zone means the local time zone.
+ */
+func Parse(start string, end string, timezone string) (Schedule, error) {
+	var schedule Schedule
+	var err error
+
+	schedule.Start, err = ParseTimeOfDay(start)
+	if err != nil {
+		return schedule, fmt.Errorf("invalid start: %s", err)
+	}
+
+	schedule.End, err = ParseTimeOfDay(end)
+	if err != nil {
+		return schedule, fmt.Errorf("invalid end: %s", err)
+	}
+
+	if schedule.Start == schedule.End {
+		return schedule, fmt.Errorf("start and end must not be equal")
+	}
+
+	schedule.Location = time.Local
+	if timezone != "" {
+		schedule.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return schedule, fmt.Errorf("invalid timezone: %s", err)
+		}
+	}
+
+	return schedule, nil
+}
+
+// Parses "HH:MM" to an offset from midnight
+func ParseTimeOfDay(timeOfDay string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(timeOfDay), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("'%s' is not in HH:MM format", timeOfDay)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 23 {
+		return 0, fmt.Errorf("'%s' has an invalid hour", timeOfDay)
+	}
+
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("'%s' has invalid minutes", timeOfDay)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+/*
+ * Whether t is within quiet hours. Quiet hours may span midnight.
+ */
+func (s Schedule) Contains(t time.Time) bool {
+	offset := sinceMidnight(t.In(s.Location))
+
+	if s.Start < s.End {
+		return offset >= s.Start && offset < s.End
+	}
+	return offset >= s.Start || offset < s.End
+}
+
+/*
+ * Returns the next end of quiet hours after t
+ */
+func (s Schedule) NextEnd(t time.Time) time.Time {
+	return NextTimeOfDay(t, s.End, s.Location)
+}
+
+/*
+ * Returns the next point in time after t at which the wall clock in location shows offset
+ * (time of day as offset from midnight). Not computed as midnight + offset, which is an
+ * hour off on days when daylight saving time starts or ends.
+ */
+func NextTimeOfDay(t time.Time, offset time.Duration, location *time.Location) time.Time {
+	localTime := t.In(location)
+	hour := int(offset / time.Hour)
+	minute := int(offset % time.Hour / time.Minute)
+	second := int(offset % time.Minute / time.Second)
+
+	next := time.Date(localTime.Year(), localTime.Month(), localTime.Day(), hour, minute, second, 0, location)
+	if !next.After(t) {
+		next = time.Date(localTime.Year(), localTime.Month(), localTime.Day()+1, hour, minute, second, 0, location)
+	}
+	return next
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
@@ -0,0 +1,76 @@
+package quiethours
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ * Quiet hours spanning midnight
+ */
+func TestContainsAndNextEnd(t *testing.T) {
+	schedule, err := Parse("22:00", "07:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Could not parse quiet hours: %s", err)
+	}
+
+	berlin := schedule.Location
+
+	testcases := []struct {
+		Time            time.Time
+		ExpectedQuiet   bool
+		ExpectedNextEnd time.Time
+	}{
+		{time.Date(2021, time.November, 1, 21, 59, 0, 0, berlin), false, time.Date(2021, time.November, 2, 7, 0, 0, 0, berlin)},
+		{time.Date(2021, time.November, 1, 22, 0, 0, 0, berlin), true, time.Date(2021, time.November, 2, 7, 0, 0, 0, berlin)},
+		{time.Date(2021, time.November, 2, 3, 0, 0, 0, berlin), true, time.Date(2021, time.November, 2, 7, 0, 0, 0, berlin)},
+		{time.Date(2021, time.November, 2, 7, 0, 0, 0, berlin), false, time.Date(2021, time.November, 3, 7, 0, 0, 0, berlin)},
+		{time.Date(2021, time.November, 2, 2, 0, 0, 0, time.UTC), true, time.Date(2021, time.November, 2, 7, 0, 0, 0, berlin)}, // 03:00 in Berlin
+	}
+
+	for i, testcase := range testcases {
+		if quiet := schedule.Contains(testcase.Time); quiet != testcase.ExpectedQuiet {
+			t.Errorf("Testcase %d: Expected quiet=%t for %s. Got %t", i, testcase.ExpectedQuiet, testcase.Time, quiet)
+		}
+		if nextEnd := schedule.NextEnd(testcase.Time); !nextEnd.Equal(testcase.ExpectedNextEnd) {
+			t.Errorf("Testcase %d: Expected next end %s for %s. Got %s", i, testcase.ExpectedNextEnd, testcase.Time, nextEnd)
+		}
+	}
+
+	// Invalid schedules
+	for _, invalid := range [][3]string{{"22:00", "22:00", ""}, {"25:00", "07:00", ""}, {"22:00", "7", ""}, {"22:00", "07:00", "Mars/Olympus"}} {
+		if _, err := Parse(invalid[0], invalid[1], invalid[2]); err == nil {
+			t.Errorf("Expected quiet hours %v to be invalid", invalid)
+		}
+	}
+}
+
+/*
+ * Quiet hours end at the same wall-clock time on days when daylight saving time starts or ends
+ */
+func TestNextEndAcrossDST(t *testing.T) {
+	schedule, err := Parse("22:00", "07:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatalf("Could not parse quiet hours: %s", err)
+	}
+
+	berlin := schedule.Location
+
+	testcases := []struct {
+		Time            time.Time
+		ExpectedNextEnd time.Time
+	}{
+		{time.Date(2021, time.March, 27, 23, 0, 0, 0, berlin), time.Date(2021, time.March, 28, 5, 0, 0, 0, time.UTC)},     // DST starts: 07:00 CEST
+		{time.Date(2021, time.October, 30, 23, 0, 0, 0, berlin), time.Date(2021, time.October, 31, 6, 0, 0, 0, time.UTC)}, // DST ends: 07:00 CET
+	}
+
+	for i, testcase := range testcases {
+		nextEnd := schedule.NextEnd(testcase.Time)
+		if !nextEnd.Equal(testcase.ExpectedNextEnd) {
+			t.Errorf("Testcase %d: Expected next end %s for %s. Got %s", i, testcase.ExpectedNextEnd, testcase.Time, nextEnd)
+		}
+		if !schedule.Contains(nextEnd.Add(-time.Minute)) || schedule.Contains(nextEnd) {
+			t.Errorf("Testcase %d: Expected quiet hours to end at %s", i, nextEnd)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Chat commands for controlling reminders:
+ * "ack", "snooze <duration>" and "unsnooze"
+ */
+
+package reminder
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/messenger"
+)
+
+type ReminderAcknowledgedParams struct {
+	Sender string // JID of the user who takes care
+}
+
+type ReminderSnoozedParams struct {
+	Until    time.Time
+	Duration time.Duration
+}
+
+func (r *Reminder) registerCommands() {
+	r.Messenger.RegisterCommand(messenger.Command{Name: "ack", Handler: r.handleAckCommand})
+	r.Messenger.RegisterCommand(messenger.Command{Name: "snooze", Handler: r.handleSnoozeCommand})
+	r.Messenger.RegisterCommand(messenger.Command{Name: "unsnooze", Handler: r.handleUnsnoozeCommand})
+}
+
+/*
+ * ack: Stop reminders for the current level and tell everybody else
+ */
+func (r *Reminder) handleAckCommand(request messenger.CommandRequest) {
+	answers := &r.Messenger.MessagesFor(request.Sender).Answers
+
+	if !r.Acknowledge(request.Sender) {
+		r.Messenger.Reply(request.Sender, answers.NoActiveReminder)
+		return
+	}
+
+	r.Messenger.Reply(request.Sender, answers.ReminderAcknowledged)
+
+	// Let others know that someone takes care
+	r.Messenger.SendText(r.Messenger.OtherRecipients(request.Sender), func(messages *configmanager.Messages) (string, error) {
+		return r.Messenger.RenderText(messages, messages.Answers.ReminderAcknowledgedBroadcast, ReminderAcknowledgedParams{Sender: request.Sender})
+	})
+}
+
+/*
+ * snooze <duration>: Pause reminders, e.g. "snooze 2h" or "snooze 90m"
+ */
+func (r *Reminder) handleSnoozeCommand(request messenger.CommandRequest) {
+	messages := r.Messenger.MessagesFor(request.Sender)
+	answers := &messages.Answers
+
+	if len(request.Args) != 1 {
+		r.Messenger.Reply(request.Sender, answers.InvalidDuration)
+		return
+	}
+
+	duration, err := time.ParseDuration(strings.TrimSpace(request.Args[0]))
+	if err != nil || duration <= 0 {
+		r.Messenger.Reply(request.Sender, answers.InvalidDuration)
+		return
+	}
+
+	until, ok := r.Snooze(duration)
+	if !ok {
+		r.Messenger.Reply(request.Sender, answers.NoActiveReminder)
+		return
+	}
+
+	answerText, err := r.Messenger.RenderText(messages, answers.ReminderSnoozed, ReminderSnoozedParams{Until: until, Duration: duration})
+	if err != nil {
+		log.Println("Reminder: Could not render snooze answer:", err)
+		return
+	}
+	r.Messenger.Reply(request.Sender, answerText)
+}
+
+/*
+ * unsnooze: Resume reminders
+ */
+func (r *Reminder) handleUnsnoozeCommand(request messenger.CommandRequest) {
+	answers := &r.Messenger.MessagesFor(request.Sender).Answers
+
+	if !r.Unsnooze() {
+		r.Messenger.Reply(request.Sender, answers.NoActiveReminder)
+		return
+	}
+
+	r.Messenger.Reply(request.Sender, answers.ReminderUnsnoozed)
+}
@@ -1,93 +1,325 @@
 /*
  * Reminder:
- * Implements goroutines with timer for reminding of cricital moisture levels
+ * Implements timers for reminding of cricital moisture levels
  */
 
 package reminder
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"sync"
 	"time"
 
+	"thomas-leister.de/plantmonitor/clock"
+	"thomas-leister.de/plantmonitor/configmanager"
 	"thomas-leister.de/plantmonitor/messenger"
 	"thomas-leister.de/plantmonitor/quantifier"
 	"thomas-leister.de/plantmonitor/sensor"
 )
 
-type Reminder struct {
-	quitChannel   chan bool // Control channel to end reminder loop
-	tickerRunning bool
-	Sensor        *sensor.Sensor       // Sensor for retrieving the current moisture value
-	Messenger     *messenger.Messenger // Messenger for sending reminder messages
-	wg            sync.WaitGroup
-}
-
 /*
- * Reminder Notification Loop:
- * Is running as a Goroutine if a ticker / reminder is active.
- * Is _not_ running if no reminder is running.
- * Goroutine / ticker can be quit by putting "true" into quitChannel
+ * Recipients which are reminded once a number of reminders has been sent
+ * or some time has passed (whatever comes first)
  */
-func (r *Reminder) reminderNotificationLoop(quitChannel chan bool, notificationInterval time.Duration, level quantifier.QuantificationLevel) {
-	log.Println("Reminder: Started reminder loop")
-
-	// Set ticker
-	ticker := time.NewTicker(notificationInterval)
-
-	// Send a done signal to waitgroup if this loop has quit
-	defer r.wg.Done()
-
-	for {
-		select {
-		case <-quitChannel:
-			ticker.Stop()
-			log.Println("Reminder: Ticker stopped. Quitting goroutine ...")
-			return
-		case t := <-ticker.C:
-			fmt.Println("Reminder: Remembering user ...", t)
-			r.Messenger.SendReminder(level, r.Sensor.Normalized.Current.Value)
-		}
-	}
+type EscalationTier struct {
+	Recipients     []string
+	AfterReminders int           // 0 = no condition
+	After          time.Duration // 0 = no condition
+}
+
+type Reminder struct {
+	Sensor    *sensor.Sensor       // Sensor for retrieving the current moisture value
+	Messenger *messenger.Messenger // Messenger for sending reminder messages
+	Clock     clock.Clock          // Clock for reminder timers
+
+	mutex          sync.Mutex
+	timer          clock.Timer                    // Timer for next reminder. nil if no reminder is active.
+	level          quantifier.QuantificationLevel // Level to remind of
+	episode        int                            // Incremented on every Set() / Stop(), so outdated timers can be detected
+	active         bool                           // Whether a reminder episode is running (level demands reminders)
+	acknowledged   bool                           // Someone takes care. No more reminders in this episode.
+	acknowledgedBy string                         // JID of the user who acknowledged
+	snoozedUntil   time.Time                      // Reminders are paused until then
+	episodeStart   time.Time                      // Time the level was reached
+	remindersSent  int                            // Number of reminders in this episode
+	delivered      int                            // Number of reminders in this episode which were not held back for quiet hours
+
+	schedules   map[string]Schedule         // Reminder schedules per level name
+	escalations map[string][]EscalationTier // Escalation tiers per level name
+
+	ctx context.Context // No new reminders are set when done. nil = not started via Start().
 }
 
-func (r *Reminder) Init(messenger *messenger.Messenger, sensor *sensor.Sensor) {
+func (r *Reminder) Init(config *configmanager.Config, messenger *messenger.Messenger, sensor *sensor.Sensor) {
 	log.Println("Reminder: Initializing reminder ...")
 
 	r.Messenger = messenger
 	r.Sensor = sensor
+	r.Clock = clock.Real{}
+	r.loadLevelSettings(config)
+
+	r.registerCommands()
+}
+
+func (r *Reminder) Reload(config *configmanager.Config) {
+	log.Println("Reminder: Reloading reminder schedules and escalation tiers")
+	r.loadLevelSettings(config)
+}
+
+func (r *Reminder) loadLevelSettings(config *configmanager.Config) {
+	schedules := make(map[string]Schedule)
+	escalations := make(map[string][]EscalationTier)
+
+	for _, level := range config.Levels {
+		schedules[level.Name] = scheduleFromConfig(level)
+
+		for _, tier := range level.Escalation {
+			escalations[level.Name] = append(escalations[level.Name], EscalationTier{
+				Recipients:     tier.Recipients,
+				AfterReminders: tier.AfterReminders,
+				After:          time.Duration(tier.After) * time.Second,
+			})
+		}
+	}
 
-	// Init quit channel
-	r.quitChannel = make(chan bool)
+	r.mutex.Lock()
+	r.schedules = schedules
+	r.escalations = escalations
+	r.mutex.Unlock()
+}
+
+/*
+ * Stops all reminders as soon as ctx is done. No new reminders are set afterwards.
+ */
+func (r *Reminder) Start(ctx context.Context) {
+	r.mutex.Lock()
+	r.ctx = ctx
+	r.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		r.Stop()
+	}()
 }
 
 /*
  * Stop any running reminder
- * and launch a new reminder goroutine
+ * and set a new reminder timer if the level demands reminders
  */
 func (r *Reminder) Set(currentLevel quantifier.QuantificationLevel) {
 	r.Stop()
 
-	// Create a new reminder loop
-	log.Println("Reminder: Creating a new reminder goroutine")
-	r.wg.Add(1)
-	go r.reminderNotificationLoop(r.quitChannel, currentLevel.NotificationInterval, currentLevel)
-	r.tickerRunning = true
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.ctx != nil && r.ctx.Err() != nil {
+		return
+	}
+
+	if !r.schedules[currentLevel.Name].Enabled(currentLevel.NotificationInterval) {
+		return
+	}
+
+	log.Println("Reminder: Setting a new reminder timer")
+	r.level = currentLevel
+	r.active = true
+	r.episodeStart = r.Clock.Now()
+	r.remindersSent = 0
+	r.delivered = 0
+	r.scheduleNext(r.episode)
 }
 
 /*
- * Just stop the reminder Goroutine
- * and don't start a new one.
+ * Just stop the reminder timer
+ * and don't set a new one.
  */
 func (r *Reminder) Stop() {
-	if r.tickerRunning {
-		log.Println("Reminder: Stopping current reminder goroutine")
-		r.quitChannel <- true
-
-		// Wait until goroutine has quit
-		r.wg.Wait()
-		r.tickerRunning = false
-		log.Println("Reminder: Reminder goroutine was quit")
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.episode++
+	r.active = false
+	r.acknowledged = false
+	r.acknowledgedBy = ""
+	r.snoozedUntil = time.Time{}
+	if r.timer != nil {
+		log.Println("Reminder: Stopping current reminder")
 	}
+	r.stopTimer()
+}
+
+/*
+ * Sets timer for the next reminder of the current level.
+ * Needs to be called with mutex held.
+ */
+func (r *Reminder) schedule(episode int, delay time.Duration) {
+	r.stopTimer()
+	r.timer = r.Clock.AfterFunc(delay, func() {
+		r.remind(episode)
+	})
+}
+
+/*
+ * Sets timer for the next reminder according to the level's reminder schedule.
+ * Needs to be called with mutex held.
+ */
+func (r *Reminder) scheduleNext(episode int) {
+	now := r.Clock.Now()
+
+	next, ok := r.schedules[r.level.Name].Next(r.level.NotificationInterval, r.episodeStart, r.remindersSent, now)
+	if !ok {
+		log.Printf("Reminder: No more reminders scheduled for level %s\n", r.level.Name)
+		r.stopTimer()
+		return
+	}
+	r.schedule(episode, next.Sub(now))
+}
+
+// Needs to be called with mutex held
+func (r *Reminder) stopTimer() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+/*
+ * Is called by the reminder timer: Sends a reminder and sets the timer for the next one.
+ * Reminders of previous episodes (level has changed in the meantime) are dropped.
+ */
+func (r *Reminder) remind(episode int) {
+	r.mutex.Lock()
+	if episode != r.episode || r.acknowledged {
+		r.mutex.Unlock()
+		return
+	}
+	level := r.level
+	recipients := r.escalationRecipients()
+	r.remindersSent++
+	reminderCount := r.delivered + 1
+	r.snoozedUntil = time.Time{}
+	r.scheduleNext(episode)
+	r.mutex.Unlock()
+
+	log.Printf("Reminder: Remembering users %v ...\n", recipients)
+	if !r.Messenger.SendReminder(level, r.Sensor.Normalized.Current.Value, recipients, reminderCount) {
+		return
+	}
+
+	// Only reminders which reached someone count towards escalation
+	r.mutex.Lock()
+	if episode == r.episode {
+		r.delivered++
+	}
+	r.mutex.Unlock()
+}
+
+/*
+ * Returns the recipients of the next reminder: The first escalation tier and all tiers
+ * whose condition is met. nil (= all recipients) if no escalation is configured for the level.
+ * Needs to be called with mutex held.
+ */
+func (r *Reminder) escalationRecipients() []string {
+	var recipients []string
+
+	tiers := r.escalations[r.level.Name]
+	if len(tiers) == 0 {
+		return nil
+	}
+
+	elapsed := r.Clock.Now().Sub(r.episodeStart)
+	for i, tier := range tiers {
+		reached := i == 0 ||
+			(tier.AfterReminders > 0 && r.delivered >= tier.AfterReminders) ||
+			(tier.After > 0 && elapsed >= tier.After)
+
+		if !reached {
+			break
+		}
+		recipients = appendMissing(recipients, tier.Recipients...)
+	}
+
+	return recipients
+}
+
+func appendMissing(list []string, items ...string) []string {
+	for _, item := range items {
+		exists := false
+		for _, existing := range list {
+			if existing == item {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+/*
+ * Acknowledge: Someone takes care of the plant.
+ * No more reminders until the level changes.
+ * Returns false if there is no active reminder.
+ */
+func (r *Reminder) Acknowledge(sender string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.active {
+		return false
+	}
+
+	log.Printf("Reminder: Reminders for level %s acknowledged by %s\n", r.level.Name, sender)
+	r.acknowledged = true
+	r.acknowledgedBy = sender
+	r.snoozedUntil = time.Time{}
+	r.stopTimer()
+
+	return true
+}
+
+/*
+ * Snooze: Pause reminders for a duration. After that, a reminder is sent
+ * and reminders continue as usual.
+ * Returns the time reminders resume and false if there is no active reminder.
+ */
+func (r *Reminder) Snooze(duration time.Duration) (time.Time, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.active {
+		return time.Time{}, false
+	}
+
+	r.acknowledged = false
+	r.acknowledgedBy = ""
+	r.snoozedUntil = r.Clock.Now().Add(duration)
+	r.schedule(r.episode, duration)
+	log.Printf("Reminder: Reminders for level %s snoozed until %s\n", r.level.Name, r.snoozedUntil.Format(time.RFC3339))
+
+	return r.snoozedUntil, true
+}
+
+/*
+ * Unsnooze: Resume reminders after snooze or acknowledgement.
+ * Returns false if there is no active reminder or reminders were not paused.
+ */
+func (r *Reminder) Unsnooze() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.active || (!r.acknowledged && r.snoozedUntil.IsZero()) {
+		return false
+	}
+
+	log.Printf("Reminder: Resuming reminders for level %s\n", r.level.Name)
+	r.acknowledged = false
+	r.acknowledgedBy = ""
+	r.snoozedUntil = time.Time{}
+	r.scheduleNext(r.episode)
+
+	return true
 }
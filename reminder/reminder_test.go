@@ -0,0 +1,225 @@
+package reminder
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/messenger/messengertest"
+	"thomas-leister.de/plantmonitor/quantifier"
+	testingInit "thomas-leister.de/plantmonitor/testing_init"
+	"thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+// Counts reminder messages (text messages) in the out channel
+func countReminders(xmppMessageOutChannel chan interface{}) int {
+	count := 0
+	for {
+		select {
+		case xmppMessage := <-xmppMessageOutChannel:
+			if _, ok := xmppMessage.(xmppmanager.XmppTextMessage); ok {
+				count++
+			}
+		default:
+			return count
+		}
+	}
+}
+
+/*
+ * Reminders can be acknowledged, snoozed and resumed
+ */
+func TestAcknowledgeAndSnooze(t *testing.T) {
+	fixture := messengertest.New(t, nil)
+	start, clock, xmppMessageOutChannel := testingInit.StartTime, fixture.Clock, fixture.OutChannel
+
+	reminder := Reminder{}
+	reminder.Init(fixture.Config, fixture.Messenger, fixture.Sensor)
+	reminder.Clock = clock
+
+	// No reminder active: Nothing to acknowledge
+	if reminder.Acknowledge("recipient1@my.xmpp.host") {
+		t.Error("Expected acknowledgement to fail without active reminder")
+	}
+
+	reminder.Set(quantifier.QuantificationLevel{Name: "low", NotificationInterval: 10 * time.Minute})
+
+	clock.AdvanceTo(start.Add(20 * time.Minute))
+	if count := countReminders(xmppMessageOutChannel); count != 2 {
+		t.Errorf("Expected 2 reminders before acknowledgement. Got %d", count)
+	}
+
+	// Acknowledged: No more reminders
+	if !reminder.Acknowledge("recipient1@my.xmpp.host") {
+		t.Error("Expected acknowledgement to succeed")
+	}
+	clock.AdvanceTo(start.Add(60 * time.Minute))
+	if count := countReminders(xmppMessageOutChannel); count != 0 {
+		t.Errorf("Expected no reminders after acknowledgement. Got %d", count)
+	}
+
+	// Resumed: Reminders continue
+	if !reminder.Unsnooze() {
+		t.Error("Expected unsnooze to succeed")
+	}
+	clock.AdvanceTo(start.Add(70 * time.Minute))
+	if count := countReminders(xmppMessageOutChannel); count != 1 {
+		t.Errorf("Expected 1 reminder after unsnooze. Got %d", count)
+	}
+
+	// Snoozed for 1h: Next reminder after 1h, then every 10 minutes
+	until, ok := reminder.Snooze(time.Hour)
+	if !ok || !until.Equal(start.Add(130*time.Minute)) {
+		t.Errorf("Expected reminders to be snoozed until %s. Got %s", start.Add(130*time.Minute), until)
+	}
+	clock.AdvanceTo(start.Add(129 * time.Minute))
+	if count := countReminders(xmppMessageOutChannel); count != 0 {
+		t.Errorf("Expected no reminders while snoozed. Got %d", count)
+	}
+	clock.AdvanceTo(start.Add(140 * time.Minute))
+	if count := countReminders(xmppMessageOutChannel); count != 2 {
+		t.Errorf("Expected 2 reminders after snooze. Got %d", count)
+	}
+
+	// Level changed: Reminders stop, nothing to snooze
+	reminder.Stop()
+	if _, ok := reminder.Snooze(time.Hour); ok {
+		t.Error("Expected snooze to fail without active reminder")
+	}
+	clock.AdvanceTo(start.Add(300 * time.Minute))
+	if count := countReminders(xmppMessageOutChannel); count != 0 {
+		t.Errorf("Expected no reminders after stop. Got %d", count)
+	}
+}
+
+/*
+ * Reminders escalate to the next tier after a number of reminders or some time
+ */
+func TestEscalation(t *testing.T) {
+	fixture := messengertest.New(t, func(config *configManagerPkg.Config) {
+		// Tier 2 is reminded after 3 reminders or 25 minutes
+		config.Levels[0].Escalation = []configManagerPkg.EscalationTier{
+			{Recipients: []string{"recipient1@my.xmpp.host"}},
+			{Recipients: []string{"recipient2@my.xmpp.host"}, AfterReminders: 3, After: 25 * 60},
+		}
+	})
+	start, clock, xmppMessageOutChannel := testingInit.StartTime, fixture.Clock, fixture.OutChannel
+
+	reminder := Reminder{}
+	reminder.Init(fixture.Config, fixture.Messenger, fixture.Sensor)
+	reminder.Clock = clock
+
+	reminder.Set(quantifier.QuantificationLevel{Name: "low", NotificationInterval: 10 * time.Minute})
+
+	expectedRecipients := []string{
+		"recipient1@my.xmpp.host",                         // 10 min
+		"recipient1@my.xmpp.host",                         // 20 min
+		"recipient1@my.xmpp.host,recipient2@my.xmpp.host", // 30 min: 25 minutes have passed
+	}
+
+	for i, expected := range expectedRecipients {
+		clock.AdvanceTo(start.Add(time.Duration(i+1) * 10 * time.Minute))
+
+		textMessage := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage)
+		if recipients := strings.Join(textMessage.Recipients, ","); recipients != expected {
+			t.Errorf("Reminder %d: Expected recipients %s. Got %s", i+1, expected, recipients)
+		}
+	}
+
+	reminder.Stop()
+}
+
+/*
+ * Reminders held back for quiet hours do not count towards after_reminders escalation
+ */
+func TestEscalationAfterRemindersSkipsQuietHours(t *testing.T) {
+	fixture := messengertest.New(t, func(config *configManagerPkg.Config) {
+		// recipient1 is in quiet hours until 25 minutes after start (13:00 Berlin)
+		config.QuietHours = configManagerPkg.QuietHours{Start: "12:30", End: "13:25", Timezone: "Europe/Berlin"}
+
+		// Tier 2 is reminded after 2 delivered reminders
+		config.Levels[0].Escalation = []configManagerPkg.EscalationTier{
+			{Recipients: []string{"recipient1@my.xmpp.host"}},
+			{Recipients: []string{"recipient2@my.xmpp.host"}, AfterReminders: 2},
+		}
+	})
+	start, clock, xmppMessageOutChannel := testingInit.StartTime, fixture.Clock, fixture.OutChannel
+
+	reminder := Reminder{}
+	reminder.Init(fixture.Config, fixture.Messenger, fixture.Sensor)
+	reminder.Clock = clock
+
+	reminder.Set(quantifier.QuantificationLevel{Name: "low", NotificationInterval: 10 * time.Minute})
+
+	// Reminders at 10 and 20 min are held back
+	clock.AdvanceTo(start.Add(20 * time.Minute))
+	if count := countReminders(xmppMessageOutChannel); count != 0 {
+		t.Fatalf("Expected reminders to be held back during quiet hours. Got %d messages", count)
+	}
+
+	expectedRecipients := []string{
+		"recipient1@my.xmpp.host",                         // 30 min: 1st delivered reminder
+		"recipient1@my.xmpp.host",                         // 40 min: 2nd delivered reminder
+		"recipient1@my.xmpp.host,recipient2@my.xmpp.host", // 50 min: 2 reminders were delivered
+	}
+
+	for i, expected := range expectedRecipients {
+		clock.AdvanceTo(start.Add(time.Duration(i+3) * 10 * time.Minute))
+
+		// The quiet hours summary may precede the first reminder
+		var textMessage xmppmanager.XmppTextMessage
+		for len(xmppMessageOutChannel) > 0 {
+			if message, ok := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage); ok {
+				textMessage = message
+			}
+		}
+		if recipients := strings.Join(textMessage.Recipients, ","); recipients != expected {
+			t.Errorf("Reminder %d: Expected recipients %s. Got %s", i+1, expected, recipients)
+		}
+	}
+
+	reminder.Stop()
+}
+
+/*
+ * Reminder schedules: Exponential backoff with cap, offsets, times of day and max. count
+ */
+func TestScheduleNext(t *testing.T) {
+	start := testingInit.StartTime
+	interval := 10 * time.Minute
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		sent     int
+		now      time.Time
+		expected time.Time // Zero = no more reminders
+	}{
+		{"interval", Schedule{}, 3, start.Add(30 * time.Minute), start.Add(40 * time.Minute)},
+		{"interval max count", Schedule{MaxCount: 3}, 3, start.Add(30 * time.Minute), time.Time{}},
+		{"exponential first", Schedule{Type: "exponential", Factor: 2}, 0, start, start.Add(10 * time.Minute)},
+		{"exponential third", Schedule{Type: "exponential", Factor: 2}, 2, start.Add(30 * time.Minute), start.Add(70 * time.Minute)},
+		{"exponential capped", Schedule{Type: "exponential", Factor: 2, MaxInterval: time.Hour}, 5, start, start.Add(time.Hour)},
+		{"exponential capped after many reminders", Schedule{Type: "exponential", Factor: 2, MaxInterval: time.Hour}, 1000, start, start.Add(time.Hour)},
+		{"exponential without cap after many reminders", Schedule{Type: "exponential", Factor: 2}, 1000, start, start.Add(maxExponentialDelay)},
+		{"offsets", Schedule{Type: "offsets", Offsets: []time.Duration{time.Hour, 3 * time.Hour}}, 1, start.Add(time.Hour), start.Add(3 * time.Hour)},
+		{"offsets passed while paused", Schedule{Type: "offsets", Offsets: []time.Duration{time.Hour, 3 * time.Hour}}, 0, start.Add(2 * time.Hour), start.Add(3 * time.Hour)},
+		{"offsets exhausted", Schedule{Type: "offsets", Offsets: []time.Duration{time.Hour}}, 1, start.Add(time.Hour), time.Time{}},
+		{"times same day", Schedule{Type: "times", Times: []time.Duration{8 * time.Hour, 18 * time.Hour}, Location: time.UTC}, 0, start, start.Add(6 * time.Hour)},
+		{"times next day", Schedule{Type: "times", Times: []time.Duration{8 * time.Hour, 18 * time.Hour}, Location: time.UTC}, 1, start.Add(6 * time.Hour), start.Add(20 * time.Hour)},
+	}
+
+	for _, test := range tests {
+		next, ok := test.schedule.Next(interval, start, test.sent, test.now)
+		if test.expected.IsZero() {
+			if ok {
+				t.Errorf("%s: Expected no more reminders. Got %s", test.name, next)
+			}
+			continue
+		}
+		if !ok || !next.Equal(test.expected) {
+			t.Errorf("%s: Expected next reminder at %s. Got %s (%t)", test.name, test.expected, next, ok)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Reminder schedules:
+ * Decide when the next reminder of a level is due
+ */
+
+package reminder
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/quiethours"
+)
+
+// Max. time between two reminders of an exponential schedule without max_interval
+const maxExponentialDelay = 365 * 24 * time.Hour
+
+type Schedule struct {
+	Type        string          // One of the configmanager.ReminderSchedule* types. Empty = interval.
+	Factor      float64         // exponential: Interval is multiplied by factor after every reminder
+	MaxInterval time.Duration   // exponential: Max. time between two reminders (0 = no limit)
+	Offsets     []time.Duration // offsets: Time since the level was reached, ascending
+	Times       []time.Duration // times: Times of day as offset from midnight
+	Location    *time.Location  // times: Time zone of Times
+	MaxCount    int             // Max. number of reminders per episode (0 = no limit)
+}
+
+/*
+ * Converts the reminder schedule of a level config.
+ * Invalid times of day and time zones are skipped (they are reported by config validation).
+ */
+func scheduleFromConfig(level configmanager.Level) Schedule {
+	scheduleConfig := level.ReminderSchedule
+
+	schedule := Schedule{
+		Type:        scheduleConfig.Type,
+		Factor:      scheduleConfig.Factor,
+		MaxInterval: time.Duration(scheduleConfig.MaxInterval) * time.Second,
+		MaxCount:    scheduleConfig.MaxCount,
+		Location:    time.Local,
+	}
+	if schedule.Factor == 0 {
+		schedule.Factor = 2
+	}
+
+	for _, offset := range scheduleConfig.Offsets {
+		schedule.Offsets = append(schedule.Offsets, time.Duration(offset)*time.Second)
+	}
+
+	for _, timeOfDay := range scheduleConfig.Times {
+		offset, err := quiethours.ParseTimeOfDay(timeOfDay)
+		if err != nil {
+			log.Printf("Reminder: Skipping reminder time of level %s: %s\n", level.Name, err)
+			continue
+		}
+		schedule.Times = append(schedule.Times, offset)
+	}
+
+	if scheduleConfig.Timezone != "" {
+		location, err := time.LoadLocation(scheduleConfig.Timezone)
+		if err != nil {
+			log.Printf("Reminder: Invalid time zone for level %s. Using local time zone: %s\n", level.Name, err)
+		} else {
+			schedule.Location = location
+		}
+	}
+
+	return schedule
+}
+
+/*
+ * Whether the schedule produces any reminders.
+ * interval: Notification interval of the level
+ */
+func (s Schedule) Enabled(interval time.Duration) bool {
+	switch s.Type {
+	case configmanager.ReminderScheduleOffsets:
+		return len(s.Offsets) > 0
+	case configmanager.ReminderScheduleTimes:
+		return len(s.Times) > 0
+	default:
+		return interval > 0
+	}
+}
+
+/*
+ * Returns the time of the next reminder and false if no more reminders are due in this episode.
+ * interval:     Notification interval of the level
+ * episodeStart: Time the level was reached
+ * sent:         Number of reminders sent since then
+ */
+func (s Schedule) Next(interval time.Duration, episodeStart time.Time, sent int, now time.Time) (time.Time, bool) {
+	if s.MaxCount > 0 && sent >= s.MaxCount {
+		return time.Time{}, false
+	}
+
+	switch s.Type {
+	case configmanager.ReminderScheduleExponential:
+		// Clamp before converting: Large delays do not fit into time.Duration
+		maxDelay := maxExponentialDelay
+		if s.MaxInterval > 0 && s.MaxInterval < maxDelay {
+			maxDelay = s.MaxInterval
+		}
+		delay := float64(interval) * math.Pow(s.Factor, float64(sent))
+		if delay > float64(maxDelay) {
+			return now.Add(maxDelay), true
+		}
+		return now.Add(time.Duration(delay)), true
+
+	case configmanager.ReminderScheduleOffsets:
+		// Offsets which have passed while reminders were paused are skipped
+		for i := sent; i < len(s.Offsets); i++ {
+			if next := episodeStart.Add(s.Offsets[i]); next.After(now) {
+				return next, true
+			}
+		}
+		return time.Time{}, false
+
+	case configmanager.ReminderScheduleTimes:
+		var next time.Time
+		for _, timeOfDay := range s.Times {
+			candidate := quiethours.NextTimeOfDay(now, timeOfDay, s.Location)
+			if next.IsZero() || candidate.Before(next) {
+				next = candidate
+			}
+		}
+		return next, !next.IsZero()
+
+	default:
+		if interval <= 0 {
+			return time.Time{}, false
+		}
+		return now.Add(interval), true
+	}
+}
@@ -0,0 +1,376 @@
+/*
+ * Replay:
+ * Drives recorded sensor readings through sensor, quantifier, reminder, watchdog
+ * and messenger using a virtual clock and prints the messages that would have been sent.
+ * No connections to MQTT or XMPP are made.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	clockPkg "thomas-leister.de/plantmonitor/clock"
+	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
+	gifManagerPkg "thomas-leister.de/plantmonitor/gifmanager"
+	messengerPkg "thomas-leister.de/plantmonitor/messenger"
+	quantifierPkg "thomas-leister.de/plantmonitor/quantifier"
+	reminderPkg "thomas-leister.de/plantmonitor/reminder"
+	sensorPkg "thomas-leister.de/plantmonitor/sensor"
+	watchdogPkg "thomas-leister.de/plantmonitor/watchdog"
+	xmppManagerPkg "thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+type ReplayReading struct {
+	Time         time.Time
+	MoistureRaw  int
+	DeviceId     string  // end_device_ids.device_id of TTN uplink messages. Empty if unknown.
+	FrameCounter *uint32 // f_cnt of TTN uplink messages. nil if unknown.
+}
+
+/*
+ * A line of a JSONL input file. Either a simple record
+ *     {"time": "2021-11-01T12:00:00Z", "moisture_raw": 2557}
+ * or an uplink message as published by TTN via MQTT.
+ */
+type replayJSONRecord struct {
+	Time         string `json:"time"`
+	ReceivedAt   string `json:"received_at"`
+	MoistureRaw  *int   `json:"moisture_raw"`
+	EndDeviceIds struct {
+		DeviceId string `json:"device_id"`
+	} `json:"end_device_ids"`
+	UplinkMessage *struct {
+		FCnt           *uint32 `json:"f_cnt"`
+		DecodedPayload struct {
+			MoistureRaw *int `json:"moisture_raw"`
+		} `json:"decoded_payload"`
+	} `json:"uplink_message"`
+}
+
+/*
+ * Replays readings from inputPath and writes all messages to outputPath (or stdout if empty).
+ * runOn: how long to keep simulating after the last reading (e.g. to see reminders and watchdog warnings)
+ * Returns exit code.
+ */
+func replayReadings(configFilePath string, langDirPath string, inputPath string, outputPath string, runOn time.Duration, verbose bool) int {
+	if !verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	config, err := configManagerPkg.ReadConfig(configFilePath, langDirPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not parse config: %s\n", err)
+		return 1
+	}
+
+	readings, err := readReplayReadings(inputPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read readings from %s: %s\n", inputPath, err)
+		return 1
+	}
+	if len(readings) == 0 {
+		fmt.Fprintf(os.Stderr, "No readings found in %s\n", inputPath)
+		return 1
+	}
+
+	output := os.Stdout
+	if outputPath != "" {
+		output, err = os.Create(outputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not create output file: %s\n", err)
+			return 1
+		}
+		defer output.Close()
+	}
+
+	clock := clockPkg.NewVirtual(readings[0].Time)
+	collector := newReplayCollector()
+	defer collector.Stop()
+	xmppMessageOutChannel := collector.OutChannel
+
+	// Init components just like in runPlantmonitor(), but with virtual clock
+	sensor := sensorPkg.Sensor{}
+	sensor.Init(&config)
+	sensor.Clock = clock
+
+	quantifier := quantifierPkg.Quantifier{}
+	quantifier.Init(&config, &sensor)
+
+	// No GIFs are retrieved in replay mode
+	messenger := messengerPkg.Messenger{}
+	err = messenger.Init(&config, xmppMessageOutChannel, nil, gifManagerPkg.NoopProvider{}, &sensor)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not initialize messenger: %s\n", err)
+		return 1
+	}
+	messenger.Clock = clock
+	messenger.PresenceOutChannel = xmppMessageOutChannel
+
+	reminder := reminderPkg.Reminder{}
+	reminder.Init(&config, &messenger, &sensor)
+	reminder.Clock = clock
+
+	watchdog := watchdogPkg.Watchdog{}
+	watchdog.Init(&config, &messenger)
+	watchdog.Clock = clock
+
+	dataQuality := watchdogPkg.DataQuality{}
+	dataQuality.Init(&config, &messenger)
+	dataQuality.Clock = clock
+
+	monitor := Monitor{
+		Sensor:      &sensor,
+		Quantifier:  &quantifier,
+		Messenger:   &messenger,
+		Reminder:    &reminder,
+		Watchdog:    &watchdog,
+		DataQuality: &dataQuality,
+	}
+
+	// Run all timers (reminders, watchdog) which are due until t, and print their messages
+	advanceTo := func(t time.Time) {
+		for {
+			deadline, ok := clock.NextDeadline()
+			if !ok || deadline.After(t) {
+				break
+			}
+			clock.AdvanceTo(deadline)
+			printReplayMessages(output, clock.Now(), collector.Flush())
+		}
+		clock.AdvanceTo(t)
+	}
+
+	for _, reading := range readings {
+		advanceTo(reading.Time)
+
+		fmt.Fprintf(output, "%s  [reading]  raw=%d\n", reading.Time.Format(time.RFC3339), reading.MoistureRaw)
+		monitor.ProcessReading(reading.MoistureRaw, reading.DeviceId, reading.FrameCounter)
+		printReplayMessages(output, clock.Now(), collector.Flush())
+	}
+
+	advanceTo(readings[len(readings)-1].Time.Add(runOn))
+
+	return 0
+}
+
+/*
+ * Collects messages sent to OutChannel in the background, so that sending
+ * never blocks, no matter how many messages a replay produces
+ */
+type replayCollector struct {
+	OutChannel chan interface{}
+
+	flush chan chan []interface{}
+	done  chan struct{}
+}
+
+func newReplayCollector() *replayCollector {
+	collector := &replayCollector{
+		OutChannel: make(chan interface{}),
+		flush:      make(chan chan []interface{}),
+		done:       make(chan struct{}),
+	}
+	go collector.run()
+	return collector
+}
+
+func (c *replayCollector) run() {
+	var messages []interface{}
+	for {
+		select {
+		case message := <-c.OutChannel:
+			messages = append(messages, message)
+		case reply := <-c.flush:
+			reply <- messages
+			messages = nil
+		case <-c.done:
+			return
+		}
+	}
+}
+
+/*
+ * Returns all messages which have been sent since the last call
+ */
+func (c *replayCollector) Flush() []interface{} {
+	reply := make(chan []interface{})
+	c.flush <- reply
+	return <-reply
+}
+
+func (c *replayCollector) Stop() {
+	close(c.done)
+}
+
+/*
+ * Prints messages with time t
+ */
+func printReplayMessages(output io.Writer, t time.Time, xmppMessages []interface{}) {
+	for _, xmppMessage := range xmppMessages {
+		var recipients []string
+		var text string
+
+		switch m := xmppMessage.(type) {
+		case xmppManagerPkg.XmppTextMessage:
+			recipients = m.Recipients
+			text = m.Text
+		case xmppManagerPkg.XmppGifMessage:
+			recipients = m.Recipients
+			text = "[GIF] " + m.Url
+		case xmppManagerPkg.XmppPresence:
+			show := m.Show
+			if show == "" {
+				show = "available"
+			}
+			text = fmt.Sprintf("[Presence %s] %s", show, m.Status)
+		default:
+			text = fmt.Sprintf("[unknown message type %T]", xmppMessage)
+		}
+
+		recipientsString := "all"
+		if len(recipients) > 0 {
+			recipientsString = strings.Join(recipients, ",")
+		}
+
+		// Indent multi-line messages
+		text = strings.ReplaceAll(strings.TrimSpace(text), "\n", "\n    ")
+		fmt.Fprintf(output, "%s  [to: %s]\n    %s\n", t.Format(time.RFC3339), recipientsString, text)
+	}
+}
+
+/*
+ * Reads readings from a CSV file (.csv) or a JSON lines file (any other extension).
+ * CSV format: <time>,<moisture_raw> with an optional header line.
+ * Time is either RFC 3339 or a unix timestamp in seconds.
+ * Readings are sorted by time.
+ */
+func readReplayReadings(inputPath string) ([]ReplayReading, error) {
+	var readings []ReplayReading
+
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer inputFile.Close()
+
+	if strings.ToLower(filepath.Ext(inputPath)) == ".csv" {
+		readings, err = readReplayCSV(inputFile)
+	} else {
+		readings, err = readReplayJSONL(inputFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(readings, func(a, b int) bool {
+		return readings[a].Time.Before(readings[b].Time)
+	})
+
+	return readings, nil
+}
+
+func readReplayCSV(input io.Reader) ([]ReplayReading, error) {
+	var readings []ReplayReading
+
+	csvReader := csv.NewReader(input)
+	csvReader.FieldsPerRecord = 2
+	csvReader.TrimLeadingSpace = true
+	csvReader.Comment = '#'
+
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, record := range records {
+		readingTime, err := parseReplayTime(record[0])
+		if err != nil {
+			// Skip header line
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+
+		moistureRaw, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid moisture_raw value: %s", i+1, err)
+		}
+
+		readings = append(readings, ReplayReading{Time: readingTime, MoistureRaw: moistureRaw})
+	}
+
+	return readings, nil
+}
+
+func readReplayJSONL(input io.Reader) ([]ReplayReading, error) {
+	var readings []ReplayReading
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024) // TTN uplink messages can be large
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var record replayJSONRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+
+		timeString := record.Time
+		if timeString == "" {
+			timeString = record.ReceivedAt
+		}
+		readingTime, err := parseReplayTime(timeString)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+
+		moistureRaw := record.MoistureRaw
+		var frameCounter *uint32
+		if record.UplinkMessage != nil {
+			if moistureRaw == nil {
+				moistureRaw = record.UplinkMessage.DecodedPayload.MoistureRaw
+			}
+			frameCounter = record.UplinkMessage.FCnt
+		}
+		if moistureRaw == nil {
+			return nil, fmt.Errorf("line %d: no moisture_raw value", lineNumber)
+		}
+
+		readings = append(readings, ReplayReading{Time: readingTime, MoistureRaw: *moistureRaw, DeviceId: record.EndDeviceIds.DeviceId, FrameCounter: frameCounter})
+	}
+
+	return readings, scanner.Err()
+}
+
+// Parses RFC 3339 time strings or unix timestamps (seconds)
+func parseReplayTime(timeString string) (time.Time, error) {
+	timeString = strings.TrimSpace(timeString)
+
+	if unixSeconds, err := strconv.ParseInt(timeString, 10, 64); err == nil {
+		return time.Unix(unixSeconds, 0).UTC(), nil
+	}
+
+	readingTime, err := time.Parse(time.RFC3339Nano, timeString)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s'. Use RFC 3339 or unix timestamp", timeString)
+	}
+	return readingTime, nil
+}
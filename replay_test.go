@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	testingInit "thomas-leister.de/plantmonitor/testing_init"
+	xmppManagerPkg "thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+/*
+ * CSV input: RFC 3339 or unix timestamps, optional header, comments. Malformed lines are errors.
+ */
+func TestReadReplayCSV(t *testing.T) {
+	start := testingInit.StartTime // 2021-11-01T12:00:00Z
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []ReplayReading // nil = error expected
+	}{
+		{"rfc 3339 with header", "time,moisture_raw\n2021-11-01T12:00:00Z,2557\n2021-11-01T12:10:00+01:00, 2600\n", []ReplayReading{
+			{Time: start, MoistureRaw: 2557},
+			{Time: start.Add(10*time.Minute - time.Hour), MoistureRaw: 2600}, // 12:10 in UTC+1
+		}},
+		{"unix timestamps and comments", "# recorded in the living room\n1635768000,2557\n", []ReplayReading{
+			{Time: start, MoistureRaw: 2557},
+		}},
+		{"invalid time", "2021-11-01T12:00:00Z,2557\nyesterday,2600\n", nil},
+		{"invalid moisture", "2021-11-01T12:00:00Z,wet\n", nil},
+		{"missing column", "2021-11-01T12:00:00Z\n", nil},
+		{"too many columns", "2021-11-01T12:00:00Z,2557,3\n", nil},
+	}
+
+	for _, test := range tests {
+		readings, err := readReplayCSV(strings.NewReader(test.input))
+		checkReplayReadings(t, test.name, test.expected, readings, err)
+	}
+}
+
+/*
+ * JSON lines input: simple records or TTN uplink messages. Malformed lines are errors.
+ */
+func TestReadReplayJSONL(t *testing.T) {
+	start := testingInit.StartTime // 2021-11-01T12:00:00Z
+	frameCounter := uint32(42)
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []ReplayReading // nil = error expected
+	}{
+		{"simple records and empty lines", "{\"time\": \"2021-11-01T12:00:00Z\", \"moisture_raw\": 2557}\n\n{\"time\": \"1635768600\", \"moisture_raw\": 2600}\n", []ReplayReading{
+			{Time: start, MoistureRaw: 2557},
+			{Time: start.Add(10 * time.Minute), MoistureRaw: 2600},
+		}},
+		{"ttn uplink", `{"end_device_ids": {"device_id": "plant-a"}, "received_at": "2021-11-01T12:00:00.123Z", "uplink_message": {"f_cnt": 42, "decoded_payload": {"moisture_raw": 2557}}}`, []ReplayReading{
+			{Time: start.Add(123 * time.Millisecond), MoistureRaw: 2557, DeviceId: "plant-a", FrameCounter: &frameCounter},
+		}},
+		{"invalid json", "{\"time\": \"2021-11-01T12:00:00Z\", \"moisture_raw\": 2557\n", nil},
+		{"missing time", "{\"moisture_raw\": 2557}\n", nil},
+		{"invalid time", "{\"time\": \"noon\", \"moisture_raw\": 2557}\n", nil},
+		{"missing moisture", "{\"time\": \"2021-11-01T12:00:00Z\"}\n", nil},
+	}
+
+	for _, test := range tests {
+		readings, err := readReplayJSONL(strings.NewReader(test.input))
+		checkReplayReadings(t, test.name, test.expected, readings, err)
+	}
+}
+
+func checkReplayReadings(t *testing.T, name string, expected []ReplayReading, readings []ReplayReading, err error) {
+	t.Helper()
+
+	if expected == nil {
+		if err == nil {
+			t.Errorf("%s: Expected error. Got readings %v", name, readings)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: Unexpected error: %s", name, err)
+		return
+	}
+	if len(readings) != len(expected) {
+		t.Errorf("%s: Expected %d reading(s). Got %d", name, len(expected), len(readings))
+		return
+	}
+
+	for i, reading := range readings {
+		expectedReading := expected[i]
+		if !reading.Time.Equal(expectedReading.Time) || reading.MoistureRaw != expectedReading.MoistureRaw || reading.DeviceId != expectedReading.DeviceId {
+			t.Errorf("%s: Expected reading %+v. Got %+v", name, expectedReading, reading)
+		}
+		if (reading.FrameCounter == nil) != (expectedReading.FrameCounter == nil) || (reading.FrameCounter != nil && *reading.FrameCounter != *expectedReading.FrameCounter) {
+			t.Errorf("%s: Expected frame counter %v. Got %v", name, expectedReading.FrameCounter, reading.FrameCounter)
+		}
+	}
+}
+
+/*
+ * Sending to the collector never blocks, no matter how many messages are sent before they are flushed
+ */
+func TestReplayCollector(t *testing.T) {
+	collector := newReplayCollector()
+	defer collector.Stop()
+
+	for i := 0; i < 1000; i++ {
+		collector.OutChannel <- xmppManagerPkg.XmppTextMessage{Text: "message"}
+	}
+
+	if messages := collector.Flush(); len(messages) != 1000 {
+		t.Errorf("Expected 1000 messages. Got %d", len(messages))
+	}
+	if messages := collector.Flush(); len(messages) != 0 {
+		t.Errorf("Expected no more messages. Got %d", len(messages))
+	}
+}
@@ -6,11 +6,11 @@
 package sensor
 
 import (
-	"fmt"
 	"log"
 	"math"
 	"time"
 
+	"thomas-leister.de/plantmonitor/clock"
 	"thomas-leister.de/plantmonitor/configmanager"
 )
 
@@ -38,12 +38,16 @@ type Sensor struct {
 		}
 		NoiseMargin int
 	}
-	LastUpdated time.Time // Time of last sensor value update
+	Watering    Watering    // Detected waterings and drying since then
+	LastUpdated time.Time   // Time of last sensor value update
+	Clock       clock.Clock // Source of time for LastUpdated
 }
 
 func (s *Sensor) Init(config *configmanager.Config) {
 	log.Println("Initializing sensor ...")
 
+	s.Clock = clock.Real{}
+
 	s.Adc.RawLowerBound = config.Sensor.Adc.RawLowerBound
 	s.Adc.RawUpperBound = config.Sensor.Adc.RawUpperBound
 	s.Adc.RawNoiseMargin = config.Sensor.Adc.RawNoiseMargin
@@ -58,6 +62,12 @@ func (s *Sensor) Init(config *configmanager.Config) {
 		s.Normalized.MvgAvg.MaxSeriesLen = 1
 	}
 	log.Printf("Sensor: Moving average filter length is: %d", s.Normalized.MvgAvg.MaxSeriesLen)
+
+	// Rise of moisture which counts as watering. Default: 10 %
+	s.Watering.Threshold = config.Sensor.WateringThreshold
+	if s.Watering.Threshold <= 0 {
+		s.Watering.Threshold = 10
+	}
 }
 
 /*
@@ -97,11 +107,14 @@ func (s *Sensor) UpdateCurrentValue(currentRaw int) {
 		s.Normalized.Current.Direction = 0
 	}
 
+	// Save timestamp of sensor update
+	s.LastUpdated = s.Clock.Now()
+
+	// Detect watering
+	s.updateWatering()
+
 	// History is valid after 1st UpdateCurrentValue() run
 	s.Normalized.History.Valid = true
-
-	// Save timestamp of sensor update
-	s.LastUpdated = time.Now()
 }
 
 /*
@@ -142,7 +155,7 @@ func (s *Sensor) mvgAvgAddValue(newValue int) {
 	 * If there's no capacity left, shift everthing to left to make space
 	 */
 	if len(s.Normalized.MvgAvg.SensorValues) < s.Normalized.MvgAvg.MaxSeriesLen {
-		fmt.Println("mvg avg: Filling up ...")
+		log.Println("mvg avg: Filling up ...")
 		s.Normalized.MvgAvg.SensorValues = append(s.Normalized.MvgAvg.SensorValues, newValue)
 	} else {
 		// Shift left
@@ -170,3 +183,60 @@ func (s *Sensor) mvgAvgAddValue(newValue int) {
 	// ... and devide
 	s.Normalized.MvgAvg.Average = int(math.Round(float64(sum) / float64(validValuesCnt)))
 }
+
+/*
+ * Sensor state which is persisted across restarts
+ */
+type State struct {
+	Valid        bool      `json:"valid"`
+	Value        int       `json:"value"`
+	LastValue    int       `json:"last_value"`
+	MvgAvgValues []int     `json:"mvg_avg_values"`
+	LastUpdated  time.Time `json:"last_updated"`
+	LastWatering time.Time `json:"last_watering"`
+	WateringLow  int       `json:"watering_low"`
+	WateringPeak int       `json:"watering_peak"`
+	PeakTime     time.Time `json:"peak_time"`
+}
+
+func (s *Sensor) State() State {
+	return State{
+		Valid:        s.Normalized.History.Valid,
+		Value:        s.Normalized.Current.Value,
+		LastValue:    s.Normalized.History.LastValue,
+		MvgAvgValues: s.Normalized.MvgAvg.SensorValues,
+		LastUpdated:  s.LastUpdated,
+		LastWatering: s.Watering.LastWatering,
+		WateringLow:  s.Watering.Low,
+		WateringPeak: s.Watering.Peak,
+		PeakTime:     s.Watering.PeakTime,
+	}
+}
+
+/*
+ * Restores a persisted state. The moving average filter keeps the most recent values
+ * if its length has been reduced in the meantime.
+ */
+func (s *Sensor) Restore(state State) {
+	if !state.Valid {
+		return
+	}
+
+	mvgAvgValues := state.MvgAvgValues
+	if len(mvgAvgValues) > s.Normalized.MvgAvg.MaxSeriesLen {
+		mvgAvgValues = mvgAvgValues[len(mvgAvgValues)-s.Normalized.MvgAvg.MaxSeriesLen:]
+	}
+
+	s.Normalized.History.Valid = true
+	s.Normalized.Current.Value = state.Value
+	s.Normalized.History.LastValue = state.LastValue
+	s.Normalized.MvgAvg.SensorValues = append([]int{}, mvgAvgValues...)
+	s.Normalized.MvgAvg.Average = state.Value
+	s.LastUpdated = state.LastUpdated
+	s.Watering.LastWatering = state.LastWatering
+	s.Watering.Low = state.WateringLow
+	s.Watering.Peak = state.WateringPeak
+	s.Watering.PeakTime = state.PeakTime
+
+	log.Printf("Sensor: Restored value %d %% from %s\n", state.Value, state.LastUpdated.Format(time.RFC3339))
+}
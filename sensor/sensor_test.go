@@ -3,7 +3,9 @@ package sensor
 import (
 	"log"
 	"testing"
+	"time"
 
+	"thomas-leister.de/plantmonitor/clock"
 	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
 	_ "thomas-leister.de/plantmonitor/testing_init"
 )
@@ -24,7 +26,7 @@ func TestNormalizeRawValue(t *testing.T) {
 	}
 
 	// Read config
-	config, err = configManagerPkg.ReadConfig("config.example.yaml")
+	config, err = configManagerPkg.ReadConfig("config.example.yaml", ".")
 	if err != nil {
 		log.Fatal("Could not parse config:", err)
 	} else {
@@ -42,3 +44,46 @@ func TestNormalizeRawValue(t *testing.T) {
 		}
 	}
 }
+
+/*
+ * A rise of moisture is detected as watering. The drying rate afterwards yields a forecast.
+ */
+func TestWateringAndForecast(t *testing.T) {
+	config, err := configManagerPkg.ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		log.Fatal("Could not parse config:", err)
+	}
+	config.Sensor.MvgAvgLen = 1
+	config.Sensor.WateringThreshold = 10
+
+	start := time.Date(2021, time.November, 1, 12, 0, 0, 0, time.UTC)
+	virtualClock := clock.NewVirtual(start)
+
+	sensor := Sensor{}
+	sensor.Init(&config)
+	sensor.Clock = virtualClock
+
+	// 40 % => 55 %: Watering
+	sensor.UpdateCurrentValue(2770)
+	virtualClock.AdvanceTo(start.Add(time.Hour))
+	sensor.UpdateCurrentValue(2450)
+	if !sensor.Watering.LastWatering.Equal(start.Add(time.Hour)) {
+		t.Fatalf("Expected watering at %s. Got %s", start.Add(time.Hour), sensor.Watering.LastWatering)
+	}
+
+	// No forecast right after watering
+	if _, ok := sensor.TimeUntilBelow(30); ok {
+		t.Errorf("Expected no forecast right after watering")
+	}
+
+	// 55 % => 50 % in 5 hours: 1 % per hour. 21 % left until below 30 %.
+	virtualClock.AdvanceTo(start.Add(6 * time.Hour))
+	sensor.UpdateCurrentValue(2557)
+	forecast, ok := sensor.TimeUntilBelow(30)
+	if !ok || forecast != 21*time.Hour {
+		t.Errorf("Expected forecast of 21h. Got %s (%t)", forecast, ok)
+	}
+	if !sensor.Watering.LastWatering.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected no further watering. Got %s", sensor.Watering.LastWatering)
+	}
+}
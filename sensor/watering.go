@@ -0,0 +1,79 @@
+/*
+ * Watering detection:
+ * Detects waterings from rising moisture values and estimates how fast
+ * the soil dries out since then
+ */
+
+package sensor
+
+import (
+	"log"
+	"time"
+)
+
+type Watering struct {
+	Threshold    int       // Min. rise of moisture (%) over the lowest value since the last watering which is detected as watering
+	LastWatering time.Time // Time of last detected watering. Zero if no watering has been detected, yet.
+	Low          int       // Lowest value since the last watering
+	Peak         int       // Highest value since the last watering
+	PeakTime     time.Time // Time of the highest value
+}
+
+/*
+ * Updates the watering state with the current value.
+ * Needs to be called after LastUpdated has been set.
+ */
+func (s *Sensor) updateWatering() {
+	value := s.Normalized.Current.Value
+	w := &s.Watering
+
+	// First value: Start tracking from here
+	if !s.Normalized.History.Valid {
+		w.Low, w.Peak, w.PeakTime = value, value, s.LastUpdated
+		return
+	}
+
+	if value < w.Low {
+		w.Low = value
+	}
+
+	if value-w.Low >= w.Threshold {
+		log.Printf("Sensor: Moisture rose from %d %% to %d %%. Detected watering.", w.Low, value)
+		w.LastWatering = s.LastUpdated
+		w.Low, w.Peak, w.PeakTime = value, value, s.LastUpdated
+		return
+	}
+
+	if value >= w.Peak {
+		w.Peak, w.PeakTime = value, s.LastUpdated
+	}
+}
+
+/*
+ * Returns the rate (% per hour) at which the soil has dried out since the highest value
+ * after the last watering. ok is false if the soil has not dried out for at least an hour.
+ */
+func (s *Sensor) DryingRate() (rate float64, ok bool) {
+	elapsed := s.LastUpdated.Sub(s.Watering.PeakTime)
+	drop := s.Watering.Peak - s.Normalized.Current.Value
+
+	if !s.Normalized.History.Valid || elapsed < time.Hour || drop <= 0 {
+		return 0, false
+	}
+
+	return float64(drop) / elapsed.Hours(), true
+}
+
+/*
+ * Estimates the time until the moisture falls below the given value at the current drying rate.
+ * ok is false if there is no estimate.
+ */
+func (s *Sensor) TimeUntilBelow(value int) (time.Duration, bool) {
+	rate, ok := s.DryingRate()
+	remaining := s.Normalized.Current.Value - value + 1
+	if !ok || value <= 0 || remaining <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(float64(remaining) / rate * float64(time.Hour)), true
+}
@@ -0,0 +1,73 @@
+/*
+ * State:
+ * Persists the state of sensor, quantifier and messenger across restarts,
+ * so that history, the current level and notifications held back during quiet hours are not lost.
+ */
+
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"thomas-leister.de/plantmonitor/messenger"
+	"thomas-leister.de/plantmonitor/quantifier"
+	"thomas-leister.de/plantmonitor/sensor"
+)
+
+type State struct {
+	SavedAt    time.Time        `json:"saved_at"`
+	Sensor     sensor.State     `json:"sensor"`
+	Quantifier quantifier.State `json:"quantifier"`
+	Messenger  messenger.State  `json:"messenger"`
+}
+
+/*
+ * Reads state from file. Returns nil if there is no state file, yet.
+ */
+func Load(filePath string) (*State, error) {
+	stateJSON, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(stateJSON, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+/*
+ * Writes state to file. The file is replaced atomically, so it does not
+ * get corrupted if plantmonitor is killed while writing.
+ */
+func Save(filePath string, state State) error {
+	stateJSON, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(stateJSON); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), filePath)
+}
@@ -0,0 +1,73 @@
+package state
+
+import (
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
+	quantifierPkg "thomas-leister.de/plantmonitor/quantifier"
+	sensorPkg "thomas-leister.de/plantmonitor/sensor"
+	_ "thomas-leister.de/plantmonitor/testing_init"
+)
+
+/*
+ * Sensor history and level survive a restart
+ */
+func TestSaveAndRestore(t *testing.T) {
+	config, err := configManagerPkg.ReadConfig("config.example.yaml", ".")
+	if err != nil {
+		log.Fatal("Could not parse config:", err)
+	}
+	stateFilePath := filepath.Join(t.TempDir(), "state.json")
+
+	// No state file, yet
+	if savedState, err := Load(stateFilePath); savedState != nil || err != nil {
+		t.Fatalf("Expected no state and no error for missing file. Got %v, %v", savedState, err)
+	}
+
+	sensor := sensorPkg.Sensor{}
+	sensor.Init(&config)
+	quantifier := quantifierPkg.Quantifier{}
+	quantifier.Init(&config, &sensor)
+
+	for _, raw := range []int{2557, 2493, 2472} {
+		sensor.UpdateCurrentValue(raw)
+		quantifier.EvaluateValue(sensor.Normalized.Current.Value)
+	}
+
+	err = Save(stateFilePath, State{SavedAt: time.Now(), Sensor: sensor.State(), Quantifier: quantifier.State()})
+	if err != nil {
+		t.Fatalf("Could not save state: %s", err)
+	}
+
+	// Restart
+	restoredSensor := sensorPkg.Sensor{}
+	restoredSensor.Init(&config)
+	restoredQuantifier := quantifierPkg.Quantifier{}
+	restoredQuantifier.Init(&config, &restoredSensor)
+
+	savedState, err := Load(stateFilePath)
+	if err != nil || savedState == nil {
+		t.Fatalf("Could not load state: %v", err)
+	}
+	restoredSensor.Restore(savedState.Sensor)
+	level, ok := restoredQuantifier.Restore(savedState.Quantifier)
+
+	if !ok || level.Name != quantifier.History.QuantificationLevel.Name {
+		t.Errorf("Expected level %s to be restored. Got %s (%t)", quantifier.History.QuantificationLevel.Name, level.Name, ok)
+	}
+	if restoredSensor.Normalized.Current.Value != sensor.Normalized.Current.Value {
+		t.Errorf("Expected value %d. Got %d", sensor.Normalized.Current.Value, restoredSensor.Normalized.Current.Value)
+	}
+	if !restoredSensor.LastUpdated.Equal(sensor.LastUpdated) {
+		t.Errorf("Expected last update %s. Got %s", sensor.LastUpdated, restoredSensor.LastUpdated)
+	}
+
+	// Same level again: No level change after restart
+	restoredSensor.UpdateCurrentValue(2472)
+	if direction, _, _ := restoredQuantifier.EvaluateValue(restoredSensor.Normalized.Current.Value); direction != 0 || !restoredQuantifier.HistoryExists() {
+		t.Errorf("Expected no level change after restart. Got direction %d", direction)
+	}
+}
@@ -8,8 +8,12 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"time"
 )
 
+// Fixed start time for tests on a virtual clock (13:00 in Europe/Berlin).
+var StartTime = time.Date(2021, time.November, 1, 12, 0, 0, 0, time.UTC)
+
 /*
  * init() function is run whenever this package has been included in another package.
  * It is solely used in _test.go files of packages and will automatically chdir() to the main directory "plantmonitor" for execution.
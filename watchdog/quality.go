@@ -0,0 +1,200 @@
+/*
+ * Data quality: Observes raw sensor values and warns users if the sensor
+ * keeps sending values which cannot be real, e.g. because the probe is
+ * corroded or has been pulled out of the soil:
+ *   - the same raw value for a long time (stuck sensor)
+ *   - raw values at or beyond raw_lower_bound / raw_upper_bound (pinned sensor)
+ *   - (almost) no variation across recent values (variance collapse)
+ * Every problem is reported once. It is reported again after it has disappeared and reappeared.
+ */
+
+package watchdog
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"thomas-leister.de/plantmonitor/clock"
+	"thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/messenger"
+)
+
+type DataQuality struct {
+	Messenger      *messenger.Messenger
+	Clock          clock.Clock
+	RawLowerBound  int
+	RawUpperBound  int
+	StuckTime      time.Duration // Warn if the raw value has not changed for this long. 0 = off
+	PinnedReadings int           // Warn after this many consecutive readings at a raw bound. 0 = off
+	VarianceWindow int           // Number of recent readings for the variance check. 0 = off
+	MinStdDev      float64       // Warn if the standard deviation of recent raw values is below this value
+
+	mutex          sync.Mutex
+	stuckValue     int       // Raw value which has been received since stuckSince
+	stuckSince     time.Time // Time of the first reading with stuckValue. Zero if there was no reading yet.
+	pinnedCount    int       // Number of consecutive readings at a raw bound
+	recentValues   []int     // Recent raw values for the variance check
+	stuckWarned    bool
+	pinnedWarned   bool
+	varianceWarned bool
+}
+
+func (d *DataQuality) Init(config *configmanager.Config, messenger *messenger.Messenger) {
+	log.Println("Initializing data quality checks ...")
+
+	d.Messenger = messenger
+	d.Clock = clock.Real{}
+	d.loadSettings(config)
+}
+
+func (d *DataQuality) Reload(config *configmanager.Config) {
+	log.Println("Data quality: Reloading settings")
+	d.loadSettings(config)
+}
+
+func (d *DataQuality) loadSettings(config *configmanager.Config) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.RawLowerBound = config.Sensor.Adc.RawLowerBound
+	d.RawUpperBound = config.Sensor.Adc.RawUpperBound
+	d.StuckTime = time.Duration(config.Watchdog.DataQuality.StuckTime) * time.Second
+	d.PinnedReadings = config.Watchdog.DataQuality.PinnedReadings
+	d.VarianceWindow = config.Watchdog.DataQuality.VarianceWindow
+	d.MinStdDev = config.Watchdog.DataQuality.MinStdDev
+
+	if len(d.recentValues) > d.VarianceWindow {
+		d.recentValues = d.recentValues[len(d.recentValues)-d.VarianceWindow:]
+	}
+}
+
+/*
+ * Checks a new raw sensor value. Should be called for every reading.
+ */
+func (d *DataQuality) Check(moistureRaw int) {
+	d.mutex.Lock()
+	stuckFor, stuck := d.checkStuck(moistureRaw)
+	pinned := d.checkPinned(moistureRaw)
+	stdDev, collapsed := d.checkVariance(moistureRaw)
+	dry := moistureRaw >= d.RawUpperBound // High raw values mean dry soil
+	pinnedReadings := d.PinnedReadings
+	varianceWindow := d.VarianceWindow
+	d.mutex.Unlock()
+
+	if stuck {
+		log.Printf("Data quality: Raw value %d has not changed for %s\n", moistureRaw, stuckFor)
+		d.Messenger.SendSensorStuckWarning(moistureRaw, stuckFor)
+	}
+	if pinned {
+		log.Printf("Data quality: Raw value %d is at the bound of the calibrated range\n", moistureRaw)
+		d.Messenger.SendSensorPinnedWarning(moistureRaw, dry, pinnedReadings)
+	}
+	if collapsed {
+		log.Printf("Data quality: Standard deviation of the last %d raw values is %.1f\n", varianceWindow, stdDev)
+		d.Messenger.SendVarianceCollapseWarning(stdDev, varianceWindow)
+	}
+}
+
+/*
+ * Returns how long the raw value has not changed and whether users need to be warned.
+ * Needs to be called with mutex held.
+ */
+func (d *DataQuality) checkStuck(moistureRaw int) (time.Duration, bool) {
+	now := d.Clock.Now()
+	if d.stuckSince.IsZero() || moistureRaw != d.stuckValue {
+		if d.stuckWarned {
+			log.Println("Data quality: Raw value is changing again")
+		}
+		d.stuckValue = moistureRaw
+		d.stuckSince = now
+		d.stuckWarned = false
+		return 0, false
+	}
+
+	stuckFor := now.Sub(d.stuckSince)
+	if d.StuckTime <= 0 || stuckFor < d.StuckTime || d.stuckWarned {
+		return stuckFor, false
+	}
+	d.stuckWarned = true
+	return stuckFor, true
+}
+
+/*
+ * Returns whether users need to be warned about raw values at the bounds of the calibrated range.
+ * Needs to be called with mutex held.
+ */
+func (d *DataQuality) checkPinned(moistureRaw int) bool {
+	if moistureRaw > d.RawLowerBound && moistureRaw < d.RawUpperBound {
+		if d.pinnedWarned {
+			log.Println("Data quality: Raw value is within the calibrated range again")
+		}
+		d.pinnedCount = 0
+		d.pinnedWarned = false
+		return false
+	}
+
+	d.pinnedCount++
+	if d.PinnedReadings <= 0 || d.pinnedCount < d.PinnedReadings || d.pinnedWarned {
+		return false
+	}
+	d.pinnedWarned = true
+	return true
+}
+
+/*
+ * Returns the standard deviation of the recent raw values and whether users need to be warned.
+ * Identical values are not reported here: That is a stuck sensor.
+ * Needs to be called with mutex held.
+ */
+func (d *DataQuality) checkVariance(moistureRaw int) (float64, bool) {
+	if d.VarianceWindow <= 0 {
+		d.recentValues = nil
+		return 0, false
+	}
+
+	d.recentValues = append(d.recentValues, moistureRaw)
+	if len(d.recentValues) > d.VarianceWindow {
+		d.recentValues = d.recentValues[len(d.recentValues)-d.VarianceWindow:]
+	}
+	if len(d.recentValues) < d.VarianceWindow {
+		return 0, false
+	}
+
+	stdDev, identical := standardDeviation(d.recentValues)
+	if stdDev >= d.MinStdDev {
+		if d.varianceWarned {
+			log.Println("Data quality: Raw values are varying again")
+		}
+		d.varianceWarned = false
+		return stdDev, false
+	}
+
+	// Identical values keep a previous warning: The sensor is not varying again
+	if identical || d.varianceWarned {
+		return stdDev, false
+	}
+	d.varianceWarned = true
+	return stdDev, true
+}
+
+// Returns the standard deviation of values and whether all values are identical
+func standardDeviation(values []int) (float64, bool) {
+	sum := 0.0
+	identical := true
+	for _, value := range values {
+		sum += float64(value)
+		if value != values[0] {
+			identical = false
+		}
+	}
+	mean := sum / float64(len(values))
+
+	squaredDiffs := 0.0
+	for _, value := range values {
+		squaredDiffs += (float64(value) - mean) * (float64(value) - mean)
+	}
+
+	return math.Sqrt(squaredDiffs / float64(len(values))), identical
+}
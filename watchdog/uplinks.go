@@ -0,0 +1,51 @@
+/*
+ * Uplink intervals:
+ * Keeps the most recent intervals between sensor uplinks and derives the typical interval
+ */
+
+package watchdog
+
+import (
+	"sort"
+	"time"
+)
+
+// Number of recent intervals the typical interval is derived from
+const maxUplinkIntervals = 20
+
+// Number of intervals which need to be known before the typical interval is used
+const minUplinkIntervals = 3
+
+type uplinkIntervals struct {
+	intervals []time.Duration
+}
+
+func (u *uplinkIntervals) add(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	u.intervals = append(u.intervals, interval)
+	if len(u.intervals) > maxUplinkIntervals {
+		u.intervals = u.intervals[len(u.intervals)-maxUplinkIntervals:]
+	}
+}
+
+/*
+ * Returns the median of the recent intervals. The median is not affected by
+ * single late or early uplinks. ok is false if not enough intervals are known.
+ */
+func (u *uplinkIntervals) typical() (time.Duration, bool) {
+	if len(u.intervals) < minUplinkIntervals {
+		return 0, false
+	}
+
+	sorted := append([]time.Duration{}, u.intervals...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2, true
+	}
+	return sorted[middle], true
+}
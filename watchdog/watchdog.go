@@ -1,51 +1,300 @@
 /*
  * Watchdog: Observes sensor data and notifies users if
  * no new sensor data has been received for a certain time.
+ * Warnings can be repeated while the sensor is offline.
+ * Users are notified when the sensor is back online.
+ * The watchdog is armed at startup, so a sensor which is dead from the start is detected, too.
+ * In adaptive mode, the timeout is derived from the typical interval between uplinks.
+ * State is kept per device (e.g. TTN device ID), so every sensor has its own timeout.
  */
 
 package watchdog
 
 import (
+	"context"
 	"log"
+	"sync"
 	"time"
 
+	"thomas-leister.de/plantmonitor/clock"
 	"thomas-leister.de/plantmonitor/configmanager"
 	"thomas-leister.de/plantmonitor/messenger"
 )
 
 type Watchdog struct {
-	Messenger    *messenger.Messenger
-	Timer        *time.Timer
-	TimerRunning bool
-	Timeout      time.Duration
+	Messenger       *messenger.Messenger
+	Clock           clock.Clock
+	Timeout         time.Duration // Fixed timeout. Used in adaptive mode until the uplink interval is known.
+	RepeatInterval  time.Duration // Interval of repeated warnings while the sensor is offline. 0 = warn once.
+	Adaptive        bool          // Derive timeout from the typical uplink interval
+	MissedUplinks   int           // Adaptive mode: Number of missed uplinks until users are warned
+	FrameGapWarning int           // Warn admins if at least this many uplinks are missing according to the frame counter. 0 = off
+
+	mutex   sync.Mutex
+	devices map[string]*deviceWatchdog // Watchdog state by device ID
+
+	ctx context.Context // Watchdog does not trigger when done. nil = not started via Start().
+}
+
+/*
+ * Watchdog state of a single device
+ */
+type deviceWatchdog struct {
+	id                string // Device ID. Empty if unknown (armed at startup or uplinks without device ID).
+	armedAtStartup    bool   // Armed by Start() and no reading since then
+	timer             clock.Timer
+	timerRunning      bool
+	triggered         bool      // Whether the sensor is considered offline
+	warnedId          string    // Device ID the offline warning was sent under. Empty at startup, before the device ID is known.
+	lastReading       time.Time // Time of the last sensor reading (last Reset()) or of arming the watchdog
+	lastReadingKnown  bool      // Whether lastReading is the time of an actual reading
+	uplinks           uplinkIntervals
+	frameCounter      uint32 // Frame counter of the last uplink
+	frameCounterKnown bool
 }
 
 func (w *Watchdog) Init(config *configmanager.Config, messenger *messenger.Messenger) {
 	log.Println("Initializing watchdog ...")
 
-	w.Timeout = time.Duration(config.Watchdog.Timeout) * time.Second
 	w.Messenger = messenger
+	w.Clock = clock.Real{}
+	w.devices = make(map[string]*deviceWatchdog)
+	w.loadSettings(config)
+}
+
+func (w *Watchdog) Reload(config *configmanager.Config) {
+	log.Println("Watchdog: Reloading settings")
+	w.loadSettings(config)
+}
+
+func (w *Watchdog) loadSettings(config *configmanager.Config) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.Timeout = time.Duration(config.Watchdog.Timeout) * time.Second
+	w.RepeatInterval = time.Duration(config.Watchdog.RepeatInterval) * time.Second
+	w.Adaptive = config.Watchdog.Adaptive
+	w.MissedUplinks = config.Watchdog.MissedUplinks
+	if w.MissedUplinks <= 0 {
+		w.MissedUplinks = 3
+	}
+	w.FrameGapWarning = config.Watchdog.FrameGapWarning
+}
+
+/*
+ * Returns the state of a device. The first device which sends a reading takes over
+ * the state armed at startup, when its ID was not known yet.
+ * Needs to be called with mutex held.
+ */
+func (w *Watchdog) device(id string) *deviceWatchdog {
+	if d, ok := w.devices[id]; ok {
+		return d
+	}
+
+	d, ok := w.devices[""]
+	if ok && d.armedAtStartup {
+		delete(w.devices, "")
+		d.id = id
+	} else {
+		d = &deviceWatchdog{id: id}
+	}
+	w.devices[id] = d
+
+	return d
+}
+
+/*
+ * Returns the current timeout of a device: In adaptive mode a multiple of the typical
+ * uplink interval (as soon as it is known), otherwise the fixed timeout.
+ * Needs to be called with mutex held.
+ */
+func (w *Watchdog) currentTimeout(d *deviceWatchdog) time.Duration {
+	if w.Adaptive {
+		if typicalInterval, ok := d.uplinks.typical(); ok {
+			return time.Duration(w.MissedUplinks) * typicalInterval
+		}
+	}
+	return w.Timeout
+}
+
+/*
+ * Returns the number of uplinks which have been missed in a period without readings.
+ * 0 if the typical uplink interval is unknown.
+ */
+func (d *deviceWatchdog) missedUplinks(offline time.Duration) int {
+	typicalInterval, ok := d.uplinks.typical()
+	if !ok {
+		return 0
+	}
+	return int(offline / typicalInterval)
+}
+
+/*
+ * Arms the watchdog, so that users are warned even if no reading arrives at all.
+ * lastReading is the time of the last known reading, e.g. restored from the state file.
+ * If it is unknown (zero), the timeout starts now.
+ * The watchdog does not trigger anymore when ctx is done.
+ */
+func (w *Watchdog) Start(ctx context.Context, lastReading time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.ctx = ctx
+
+	// The ID of the device is not known before its first reading
+	d := w.device("")
+
+	now := w.Clock.Now()
+	d.armedAtStartup = true
+	d.lastReadingKnown = !lastReading.IsZero()
+	if lastReading.IsZero() || lastReading.After(now) {
+		lastReading = now
+	}
+	d.lastReading = lastReading
+
+	delay := w.currentTimeout(d) - now.Sub(lastReading)
+	if delay < 0 {
+		delay = 0
+	}
+	log.Printf("Watchdog: Armed. Expecting a sensor reading within %s\n", delay)
+	w.arm(d, delay)
 }
 
-// Initial start of watchdog
-func (w *Watchdog) Start() {
-	w.Timer = time.AfterFunc(w.Timeout, func() {
-		log.Println("Watchdog: Watchdog triggered! Warning users ...")
-		w.Messenger.SendSensorWarning(w.Timeout)
-	})
-	w.TimerRunning = true
+/*
+ * Stops the watchdog timers of all devices
+ */
+func (w *Watchdog) Stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, d := range w.devices {
+		if d.timerRunning {
+			d.timer.Stop()
+			d.timerRunning = false
+		}
+	}
+}
+
+/*
+ * (Re)sets the watchdog timer of a device.
+ * Needs to be called with mutex held.
+ */
+func (w *Watchdog) arm(d *deviceWatchdog, delay time.Duration) {
+	if d.timerRunning {
+		d.timer.Stop()
+		d.timer.Reset(delay)
+	} else {
+		d.timer = w.Clock.AfterFunc(delay, func() { w.trigger(d) })
+		d.timerRunning = true
+	}
+}
+
+/*
+ * Is called by the timer if no sensor reading of a device has arrived in time:
+ * Warns users and sets the timer for the next warning (if enabled)
+ */
+func (w *Watchdog) trigger(d *deviceWatchdog) {
+	w.mutex.Lock()
+
+	now := w.Clock.Now()
+	offline := now.Sub(d.lastReading)
+
+	// Watchdog has been stopped or a reading arrived while the timer fired
+	if (w.ctx != nil && w.ctx.Err() != nil) || !d.timerRunning || (!d.triggered && offline < w.currentTimeout(d)) {
+		w.mutex.Unlock()
+		return
+	}
+
+	if d.triggered {
+		log.Printf("Watchdog: Sensor '%s' is still offline! Warning users again ...\n", d.id)
+	} else {
+		log.Printf("Watchdog: Watchdog of sensor '%s' triggered! Warning users ...\n", d.id)
+	}
+	if !d.triggered {
+		d.warnedId = d.id
+	}
+	d.triggered = true
+
+	if w.RepeatInterval > 0 {
+		w.arm(d, w.RepeatInterval)
+	} else {
+		d.timerRunning = false
+	}
+	missedUplinks := d.missedUplinks(offline)
+	device := d.id
+	w.mutex.Unlock()
+
+	w.Messenger.SendSensorWarning(device, offline, missedUplinks)
 }
 
 /*
  * Resets timer and starts the timer
  * This function should be called if a new MQTT message has arrived.
  * If no further MQTT message follows in time, the timer will trigger.
+ * If the watchdog has been triggered before, users are told that the sensor is back.
+ * deviceId: ID of the device which sent the reading. Empty if unknown.
+ * frameCounter: Frame counter (f_cnt) of the uplink, used to detect lost uplinks. nil if unknown.
  */
-func (w *Watchdog) Reset() {
-	if !w.TimerRunning {
-		w.Start()
-	} else {
-		w.Timer.Stop()
-		w.Timer.Reset(w.Timeout)
+func (w *Watchdog) Reset(deviceId string, frameCounter *uint32) {
+	w.mutex.Lock()
+
+	if w.ctx != nil && w.ctx.Err() != nil {
+		w.mutex.Unlock()
+		return
+	}
+
+	d := w.device(deviceId)
+	now := w.Clock.Now()
+	recovered := d.triggered
+	warnedId := d.warnedId
+	outage := now.Sub(d.lastReading)
+	lostUplinks := d.checkFrameCounter(frameCounter)
+
+	// Learn uplink interval from regular uplinks. Lost uplinks (according to frame counter) are taken into account.
+	if d.lastReadingKnown && !recovered {
+		d.uplinks.add(outage / time.Duration(lostUplinks+1))
+	}
+
+	d.triggered = false
+	d.armedAtStartup = false
+	d.lastReading = now
+	d.lastReadingKnown = true
+	w.arm(d, w.currentTimeout(d))
+	w.mutex.Unlock()
+
+	if recovered {
+		// Recovery is reported under the ID of the warning, so that it refers to the same sensor
+		log.Printf("Watchdog: Sensor '%s' is back online after %s\n", deviceId, outage)
+		w.Messenger.SendSensorRecovered(warnedId, outage)
+	} else if w.FrameGapWarning > 0 && lostUplinks >= w.FrameGapWarning {
+		w.Messenger.SendFrameCounterGapWarning(lostUplinks)
 	}
 }
+
+/*
+ * Compares the frame counter to the one of the previous uplink.
+ * Returns the number of uplinks which got lost in between.
+ */
+func (d *deviceWatchdog) checkFrameCounter(frameCounter *uint32) int {
+	if frameCounter == nil {
+		return 0
+	}
+
+	lostUplinks := 0
+	if d.frameCounterKnown {
+		if *frameCounter > d.frameCounter {
+			lostUplinks = int(*frameCounter - d.frameCounter - 1)
+		} else {
+			// Device has been reset or has joined again
+			log.Printf("Watchdog: Frame counter was reset (%d => %d)\n", d.frameCounter, *frameCounter)
+		}
+	}
+	if lostUplinks > 0 {
+		log.Printf("Watchdog: Frame counter gap (%d => %d): %d uplink(s) lost\n", d.frameCounter, *frameCounter, lostUplinks)
+	}
+
+	d.frameCounter = *frameCounter
+	d.frameCounterKnown = true
+
+	return lostUplinks
+}
@@ -0,0 +1,298 @@
+package watchdog
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	clockPkg "thomas-leister.de/plantmonitor/clock"
+	configManagerPkg "thomas-leister.de/plantmonitor/configmanager"
+	"thomas-leister.de/plantmonitor/messenger/messengertest"
+	quantifierPkg "thomas-leister.de/plantmonitor/quantifier"
+	testingInit "thomas-leister.de/plantmonitor/testing_init"
+	"thomas-leister.de/plantmonitor/xmppmanager"
+)
+
+var start = testingInit.StartTime
+
+/*
+ * Watchdog on a virtual clock starting at start. configure adjusts the example config before.
+ */
+func newTestWatchdog(t *testing.T, configure func(config *configManagerPkg.Config)) (*Watchdog, *clockPkg.Virtual, chan interface{}) {
+	t.Helper()
+
+	fixture := messengertest.New(t, configure)
+
+	watchdog := Watchdog{}
+	watchdog.Init(fixture.Config, fixture.Messenger)
+	watchdog.Clock = fixture.Clock
+
+	return &watchdog, fixture.Clock, fixture.OutChannel
+}
+
+/*
+ * Warnings are repeated while the sensor is offline. Users are told when it is back.
+ */
+func TestRepeatedWarningsAndRecovery(t *testing.T) {
+	watchdog, clock, xmppMessageOutChannel := newTestWatchdog(t, func(config *configManagerPkg.Config) {
+		config.Watchdog.Timeout = 600
+		config.Watchdog.RepeatInterval = 3600
+	})
+
+	watchdog.Reset("", nil)
+
+	// Timeout after 10 minutes, repeated after 1h10m and 2h10m
+	clock.AdvanceTo(start.Add(2*time.Hour + 30*time.Minute))
+	for _, expected := range []string{"10 Minuten", "1 Stunde und 10 Minuten", "2 Stunden und 10 Minuten"} {
+		select {
+		case message := <-xmppMessageOutChannel:
+			if text := message.(xmppmanager.XmppTextMessage).Text; !strings.Contains(text, expected) {
+				t.Errorf("Expected warning containing \"%s\". Got \"%s\"", expected, text)
+			}
+		default:
+			t.Fatalf("Expected warning containing \"%s\"", expected)
+		}
+	}
+
+	// Sensor is back
+	watchdog.Reset("", nil)
+	select {
+	case message := <-xmppMessageOutChannel:
+		if text := message.(xmppmanager.XmppTextMessage).Text; !strings.Contains(text, "2 Stunden und 30 Minuten") {
+			t.Errorf("Expected recovery message with outage duration. Got \"%s\"", text)
+		}
+	default:
+		t.Fatal("Expected recovery message")
+	}
+
+	// Next reading in time: No more messages
+	clock.AdvanceTo(start.Add(2*time.Hour + 35*time.Minute))
+	watchdog.Reset("", nil)
+	if len(xmppMessageOutChannel) != 0 {
+		t.Errorf("Expected no more messages. Got %v", <-xmppMessageOutChannel)
+	}
+}
+
+/*
+ * The watchdog triggers without any reading, starting from the last known reading
+ */
+func TestArmedAtStartup(t *testing.T) {
+	watchdog, clock, xmppMessageOutChannel := newTestWatchdog(t, func(config *configManagerPkg.Config) {
+		config.Watchdog.Timeout = 600
+		config.Watchdog.RepeatInterval = 0
+	})
+
+	// Last reading (restored from state) was 8 minutes before startup: Timeout 2 minutes after startup
+	watchdog.Start(context.Background(), start.Add(-8*time.Minute))
+
+	clock.AdvanceTo(start.Add(time.Minute))
+	if len(xmppMessageOutChannel) != 0 {
+		t.Fatalf("Expected no warning before timeout. Got %v", <-xmppMessageOutChannel)
+	}
+
+	clock.AdvanceTo(start.Add(time.Hour))
+	if len(xmppMessageOutChannel) != 1 {
+		t.Fatalf("Expected exactly one warning. Got %d message(s)", len(xmppMessageOutChannel))
+	}
+	if text := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage).Text; !strings.Contains(text, "10 Minuten") {
+		t.Errorf("Expected warning about 10 minutes without reading. Got \"%s\"", text)
+	}
+
+	// Stopped watchdog does not trigger
+	watchdog.Reset("", nil)
+	<-xmppMessageOutChannel // Sensor is back
+	watchdog.Stop()
+	clock.AdvanceTo(start.Add(2 * time.Hour))
+	if len(xmppMessageOutChannel) != 0 {
+		t.Errorf("Expected no warning after Stop(). Got %v", <-xmppMessageOutChannel)
+	}
+}
+
+/*
+ * A warning sent at startup, before the device ID is known, is cleared by the recovery of the first device.
+ * The presence does not stay "xa".
+ */
+func TestStartupWarningRecoveredByNamedDevice(t *testing.T) {
+	watchdog, clock, xmppMessageOutChannel := newTestWatchdog(t, func(config *configManagerPkg.Config) {
+		config.Watchdog.Timeout = 600
+		config.Watchdog.RepeatInterval = 0
+	})
+	presenceChannel := make(chan interface{}, 10)
+	watchdog.Messenger.PresenceOutChannel = presenceChannel
+	watchdog.Start(context.Background(), time.Time{})
+
+	expectPresence := func(expected string) {
+		t.Helper()
+		select {
+		case message := <-presenceChannel:
+			if show := message.(xmppmanager.XmppPresence).Show; show != expected {
+				t.Errorf("Expected presence \"%s\". Got \"%s\"", expected, show)
+			}
+		default:
+			t.Errorf("Expected presence \"%s\". Got none", expected)
+		}
+	}
+
+	clock.AdvanceTo(start.Add(15 * time.Minute))
+	<-xmppMessageOutChannel // Warning
+	expectPresence("xa")
+
+	watchdog.Reset("plant-a", nil)
+	<-xmppMessageOutChannel // Recovery
+	watchdog.Messenger.RestoreLevel(quantifierPkg.QuantificationLevel{Name: "normal", Presence: configManagerPkg.PresenceAvailable})
+	expectPresence("")
+	watchdog.Stop()
+}
+
+/*
+ * Every device has its own watchdog state. The first device takes over the state armed at startup.
+ */
+func TestPerDeviceState(t *testing.T) {
+	watchdog, clock, xmppMessageOutChannel := newTestWatchdog(t, func(config *configManagerPkg.Config) {
+		config.Watchdog.Timeout = 600
+		config.Watchdog.RepeatInterval = 0
+	})
+	watchdog.Start(context.Background(), time.Time{})
+
+	clock.AdvanceTo(start.Add(5 * time.Minute))
+	watchdog.Reset("plant-a", nil)
+	watchdog.Reset("plant-b", nil)
+
+	// plant-b keeps sending, plant-a times out after 15 minutes
+	for _, minutes := range []int{12, 20, 28} {
+		clock.AdvanceTo(start.Add(time.Duration(minutes) * time.Minute))
+		watchdog.Reset("plant-b", nil)
+	}
+	if len(xmppMessageOutChannel) != 1 {
+		t.Fatalf("Expected exactly one warning. Got %d message(s)", len(xmppMessageOutChannel))
+	}
+	if text := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage).Text; !strings.Contains(text, "plant-a") {
+		t.Errorf("Expected warning about plant-a. Got \"%s\"", text)
+	}
+
+	watchdog.Reset("plant-a", nil)
+	if text := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage).Text; !strings.Contains(text, "plant-a") || !strings.Contains(text, "23 Minuten") {
+		t.Errorf("Expected recovery message for plant-a. Got \"%s\"", text)
+	}
+	watchdog.Stop()
+}
+
+/*
+ * In adaptive mode, the timeout is derived from the uplink interval. Lost uplinks are detected via the frame counter.
+ */
+func TestAdaptiveTimeout(t *testing.T) {
+	watchdog, clock, xmppMessageOutChannel := newTestWatchdog(t, func(config *configManagerPkg.Config) {
+		config.Watchdog.Timeout = 3600
+		config.Watchdog.RepeatInterval = 0
+		config.Watchdog.Adaptive = true
+		config.Watchdog.MissedUplinks = 3
+		config.Watchdog.FrameGapWarning = 2
+	})
+
+	uplink := func(minutes int, frameCounter uint32) {
+		clock.AdvanceTo(start.Add(time.Duration(minutes) * time.Minute))
+		watchdog.Reset("", &frameCounter)
+	}
+
+	// Uplinks every 5 minutes. One uplink lost (f_cnt 5) does not disturb the interval and is not reported.
+	uplink(0, 1)
+	uplink(5, 2)
+	uplink(10, 3)
+	uplink(20, 5)
+	if len(xmppMessageOutChannel) != 0 {
+		t.Fatalf("Expected no message. Got %v", <-xmppMessageOutChannel)
+	}
+
+	// Two uplinks lost: Admins are warned
+	uplink(30, 8)
+	if len(xmppMessageOutChannel) != 1 {
+		t.Fatalf("Expected warning about lost uplinks. Got %d message(s)", len(xmppMessageOutChannel))
+	}
+	if text := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage).Text; !strings.Contains(text, "2 Meldungen") {
+		t.Errorf("Expected warning about 2 lost uplinks. Got \"%s\"", text)
+	}
+
+	// Timeout after 3 missed uplinks (15 minutes) instead of one hour
+	clock.AdvanceTo(start.Add(44 * time.Minute))
+	if len(xmppMessageOutChannel) != 0 {
+		t.Fatalf("Expected no warning before timeout. Got %v", <-xmppMessageOutChannel)
+	}
+	clock.AdvanceTo(start.Add(50 * time.Minute))
+	if len(xmppMessageOutChannel) != 1 {
+		t.Fatalf("Expected exactly one warning. Got %d message(s)", len(xmppMessageOutChannel))
+	}
+	if text := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage).Text; !strings.Contains(text, "15 Minuten") || !strings.Contains(text, "3 Meldungen") {
+		t.Errorf("Expected warning about 3 missed uplinks in 15 minutes. Got \"%s\"", text)
+	}
+}
+
+/*
+ * Stuck, pinned and flatlined sensors are reported once per episode
+ */
+func TestDataQuality(t *testing.T) {
+	fixture := messengertest.New(t, func(config *configManagerPkg.Config) {
+		config.Sensor.Adc.RawLowerBound = 1500
+		config.Sensor.Adc.RawUpperBound = 3600
+		config.Watchdog.DataQuality.StuckTime = 3600
+		config.Watchdog.DataQuality.PinnedReadings = 3
+		config.Watchdog.DataQuality.VarianceWindow = 5
+		config.Watchdog.DataQuality.MinStdDev = 2
+	})
+
+	clock, xmppMessageOutChannel := fixture.Clock, fixture.OutChannel
+
+	dataQuality := DataQuality{}
+	dataQuality.Init(fixture.Config, fixture.Messenger)
+	dataQuality.Clock = clock
+
+	minutes := 0
+	readings := func(rawValues ...int) {
+		for _, rawValue := range rawValues {
+			clock.AdvanceTo(start.Add(time.Duration(minutes) * time.Minute))
+			dataQuality.Check(rawValue)
+			minutes += 10
+		}
+	}
+	expectWarning := func(expected string) {
+		t.Helper()
+		if len(xmppMessageOutChannel) != 1 {
+			t.Fatalf("Expected warning containing \"%s\". Got %d message(s)", expected, len(xmppMessageOutChannel))
+		}
+		if text := (<-xmppMessageOutChannel).(xmppmanager.XmppTextMessage).Text; !strings.Contains(text, expected) {
+			t.Errorf("Expected warning containing \"%s\". Got \"%s\"", expected, text)
+		}
+	}
+
+	// Normal noisy values: No warning
+	readings(2500, 2510, 2490, 2520, 2495, 2505)
+	if len(xmppMessageOutChannel) != 0 {
+		t.Fatalf("Expected no warning. Got %v", <-xmppMessageOutChannel)
+	}
+
+	// Values barely vary
+	readings(2500, 2501, 2500, 2501, 2500)
+	expectWarning("schwanken kaum")
+
+	// Same value for one hour: Stuck sensor is reported once, no variance warning
+	readings(2500, 2500, 2500, 2500, 2500, 2500, 2500, 2500)
+	expectWarning("1 Stunde")
+
+	// Barely varying after being stuck: Still the same episode, no new variance warning
+	readings(2501, 2500)
+	if len(xmppMessageOutChannel) != 0 {
+		t.Fatalf("Expected no repeated variance warning. Got %v", <-xmppMessageOutChannel)
+	}
+
+	// Probe pulled out of the soil: Pinned at the dry bound after 3 readings
+	readings(3600, 3650)
+	if len(xmppMessageOutChannel) != 0 {
+		t.Fatalf("Expected no warning before 3 readings at the bound. Got %v", <-xmppMessageOutChannel)
+	}
+	readings(3640)
+	expectWarning("trockensten")
+	readings(3660, 3650, 3640)
+	if len(xmppMessageOutChannel) != 0 {
+		t.Errorf("Expected no repeated warning. Got %v", <-xmppMessageOutChannel)
+	}
+}
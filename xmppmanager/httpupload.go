@@ -0,0 +1,344 @@
+/*
+ * HTTP File Upload (XEP-0363):
+ * Downloads media (e.g. a GIF) and uploads it to the user's XMPP server,
+ * so that recipients' clients load it from there instead of from the GIF platform.
+ */
+
+package xmppmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+const nsHttpUpload = "urn:xmpp:http:upload:0"
+
+// Timeout of IQ requests (service discovery, upload slot)
+const iqTimeout = 10 * time.Second
+
+// Max. number of uploaded URLs to remember. The cache is cleared when it is full.
+const maxCachedUploads = 256
+
+// Request for an upload slot
+type uploadRequest struct {
+	XMLName     xml.Name `xml:"urn:xmpp:http:upload:0 request"`
+	Filename    string   `xml:"filename,attr"`
+	Size        int64    `xml:"size,attr"`
+	ContentType string   `xml:"content-type,attr,omitempty"`
+}
+
+func (u *uploadRequest) Namespace() string {
+	return u.XMLName.Space
+}
+
+func (u *uploadRequest) GetSet() *stanza.ResultSet {
+	return nil
+}
+
+// Upload slot: The file is uploaded to Put.Url and can be downloaded from Get.Url
+type uploadSlot struct {
+	XMLName xml.Name `xml:"urn:xmpp:http:upload:0 slot"`
+	Put     struct {
+		Url     string         `xml:"url,attr"`
+		Headers []uploadHeader `xml:"header"`
+	} `xml:"put"`
+	Get struct {
+		Url string `xml:"url,attr"`
+	} `xml:"get"`
+}
+
+type uploadHeader struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (u *uploadSlot) Namespace() string {
+	return u.XMLName.Space
+}
+
+func (u *uploadSlot) GetSet() *stanza.ResultSet {
+	return nil
+}
+
+func init() {
+	stanza.TypeRegistry.MapExtension(stanza.PKTIQ, xml.Name{Space: nsHttpUpload, Local: "slot"}, uploadSlot{})
+}
+
+// Headers of the upload slot which may be passed to the HTTP server (XEP-0363, section 5)
+var allowedUploadHeaders = map[string]bool{"Authorization": true, "Cookie": true, "Expires": true}
+
+// Sends IQs and waits for results. Implemented by xmpp.Client.
+type iqSender interface {
+	SendIQ(ctx context.Context, iq *stanza.IQ) (chan stanza.IQ, error)
+}
+
+type httpUploader struct {
+	Service    string // JID of the upload service. Discovered if empty.
+	Domain     string // Domain of the XMPP server, used for discovery
+	MaxSize    int64  // Max. size of uploaded files (bytes)
+	HttpClient *http.Client
+
+	serviceMutex sync.Mutex // Held during service discovery
+
+	uploadsMutex sync.Mutex
+	uploads      map[string]*uploadResult // Uploads by source URL
+}
+
+// Result of an upload. done is closed when url and err are set.
+type uploadResult struct {
+	done chan struct{}
+	url  string
+	err  error
+}
+
+/*
+ * Like upload(), but every source URL is only uploaded once. Concurrent requests for the
+ * same URL wait for the first upload. Failed uploads are tried again next time.
+ */
+func (u *httpUploader) uploadCached(ctx context.Context, client iqSender, sourceUrl string) (string, error) {
+	u.uploadsMutex.Lock()
+	result, found := u.uploads[sourceUrl]
+	if !found {
+		if u.uploads == nil || len(u.uploads) >= maxCachedUploads {
+			u.uploads = make(map[string]*uploadResult)
+		}
+		result = &uploadResult{done: make(chan struct{})}
+		u.uploads[sourceUrl] = result
+	}
+	u.uploadsMutex.Unlock()
+
+	if found {
+		select {
+		case <-result.done:
+			return result.url, result.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	result.url, result.err = u.upload(ctx, client, sourceUrl)
+	if result.err != nil {
+		u.uploadsMutex.Lock()
+		if u.uploads[sourceUrl] == result {
+			delete(u.uploads, sourceUrl)
+		}
+		u.uploadsMutex.Unlock()
+	}
+	close(result.done)
+
+	return result.url, result.err
+}
+
+/*
+ * Downloads the file at sourceUrl, uploads it via the XMPP server and returns its new URL.
+ * Gives up when ctx is done.
+ */
+func (u *httpUploader) upload(ctx context.Context, client iqSender, sourceUrl string) (string, error) {
+	data, contentType, err := u.download(ctx, sourceUrl)
+	if err != nil {
+		return "", fmt.Errorf("could not download %s: %s", sourceUrl, err)
+	}
+
+	service, err := u.service(ctx, client)
+	if err != nil {
+		return "", err
+	}
+
+	filename := path.Base(sourceUrl)
+	if parsedUrl, err := url.Parse(sourceUrl); err == nil {
+		filename = path.Base(parsedUrl.Path)
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = "media"
+	}
+
+	slot, err := u.requestSlot(ctx, client, service, filename, int64(len(data)), contentType)
+	if err != nil {
+		return "", err
+	}
+
+	if err := u.put(ctx, slot, data, contentType); err != nil {
+		return "", err
+	}
+
+	return slot.Get.Url, nil
+}
+
+// Returns the JID of the upload service. Discovers it on first use.
+func (u *httpUploader) service(ctx context.Context, client iqSender) (string, error) {
+	u.serviceMutex.Lock()
+	defer u.serviceMutex.Unlock()
+
+	if u.Service == "" {
+		service, err := u.discoverService(ctx, client)
+		if err != nil {
+			return "", err
+		}
+		u.Service = service
+		log.Printf("XMPP: Using HTTP upload service %s\n", u.Service)
+	}
+
+	return u.Service, nil
+}
+
+// Downloads a file of at most MaxSize bytes
+func (u *httpUploader) download(ctx context.Context, sourceUrl string) ([]byte, string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceUrl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	response, err := u.HttpClient.Do(request)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("server returned %s", response.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, u.MaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > u.MaxSize {
+		return nil, "", fmt.Errorf("file is larger than %d bytes", u.MaxSize)
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	return data, contentType, nil
+}
+
+// Finds the upload service among the services of the XMPP server
+func (u *httpUploader) discoverService(ctx context.Context, client iqSender) (string, error) {
+	// Server itself might offer HTTP upload
+	candidates := []string{u.Domain}
+
+	itemsIq, err := stanza.NewIQ(stanza.Attrs{Type: stanza.IQTypeGet, To: u.Domain})
+	if err != nil {
+		return "", err
+	}
+	itemsIq.DiscoItems()
+	itemsResult, err := sendIQ(ctx, client, itemsIq)
+	if err != nil {
+		return "", fmt.Errorf("could not discover services: %s", err)
+	}
+	if items, ok := itemsResult.Payload.(*stanza.DiscoItems); ok {
+		for _, item := range items.Items {
+			candidates = append(candidates, item.JID)
+		}
+	}
+
+	for _, candidate := range candidates {
+		infoIq, err := stanza.NewIQ(stanza.Attrs{Type: stanza.IQTypeGet, To: candidate})
+		if err != nil {
+			return "", err
+		}
+		infoIq.DiscoInfo()
+		infoResult, err := sendIQ(ctx, client, infoIq)
+		if err != nil {
+			continue
+		}
+		if info, ok := infoResult.Payload.(*stanza.DiscoInfo); ok {
+			for _, feature := range info.Features {
+				if feature.Var == nsHttpUpload {
+					return candidate, nil
+				}
+			}
+		}
+	}
+
+	return "", fmt.Errorf("XMPP server %s does not offer HTTP upload", u.Domain)
+}
+
+// Requests an upload slot from the upload service
+func (u *httpUploader) requestSlot(ctx context.Context, client iqSender, service string, filename string, size int64, contentType string) (*uploadSlot, error) {
+	slotIq, err := stanza.NewIQ(stanza.Attrs{Type: stanza.IQTypeGet, To: service})
+	if err != nil {
+		return nil, err
+	}
+	slotIq.Payload = &uploadRequest{Filename: filename, Size: size, ContentType: contentType}
+
+	result, err := sendIQ(ctx, client, slotIq)
+	if err != nil {
+		return nil, fmt.Errorf("could not request upload slot: %s", err)
+	}
+
+	slot, ok := result.Payload.(*uploadSlot)
+	if !ok || slot.Put.Url == "" || slot.Get.Url == "" {
+		return nil, fmt.Errorf("upload service returned no slot")
+	}
+
+	return slot, nil
+}
+
+// Uploads data to the slot's PUT URL
+func (u *httpUploader) put(ctx context.Context, slot *uploadSlot, data []byte, contentType string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, slot.Put.Url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.ContentLength = int64(len(data))
+	request.Header.Set("Content-Type", contentType)
+	for _, header := range slot.Put.Headers {
+		if allowedUploadHeaders[http.CanonicalHeaderKey(header.Name)] {
+			request.Header.Set(header.Name, header.Value)
+		}
+	}
+
+	response, err := u.HttpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("could not upload file: %s", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		return fmt.Errorf("upload server returned %s", response.Status)
+	}
+
+	return nil
+}
+
+// Sends an IQ and waits for its result (at most iqTimeout). IQ errors are returned as error.
+func sendIQ(ctx context.Context, client iqSender, iq *stanza.IQ) (*stanza.IQ, error) {
+	ctx, cancel := context.WithTimeout(ctx, iqTimeout)
+	defer cancel()
+
+	resultChannel, err := client.SendIQ(ctx, iq)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case result, ok := <-resultChannel:
+		if !ok {
+			return nil, fmt.Errorf("no result")
+		}
+		if result.Type == stanza.IQTypeError {
+			if result.Error != nil {
+				return nil, fmt.Errorf("%s: %s", result.Error.Reason, result.Error.Text)
+			}
+			return nil, fmt.Errorf("IQ error")
+		}
+		return &result, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no result: %s", ctx.Err())
+	}
+}
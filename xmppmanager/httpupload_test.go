@@ -0,0 +1,234 @@
+package xmppmanager
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gosrc.io/xmpp"
+	"gosrc.io/xmpp/stanza"
+)
+
+// Answers IQs like a server with an upload service at upload.example.com
+type fakeUploadServer struct {
+	putUrl string
+}
+
+func (f *fakeUploadServer) SendIQ(ctx context.Context, iq *stanza.IQ) (chan stanza.IQ, error) {
+	result := stanza.IQ{Attrs: stanza.Attrs{Type: stanza.IQTypeResult, Id: iq.Id, From: iq.To}}
+
+	switch payload := iq.Payload.(type) {
+	case *stanza.DiscoItems:
+		result.Payload = &stanza.DiscoItems{Items: []stanza.DiscoItem{{JID: "upload.example.com"}}}
+	case *stanza.DiscoInfo:
+		info := &stanza.DiscoInfo{}
+		if iq.To == "upload.example.com" {
+			info.Features = []stanza.Feature{{Var: nsHttpUpload}}
+		}
+		result.Payload = info
+	case *uploadRequest:
+		slot := &uploadSlot{}
+		slot.Put.Url = f.putUrl + "/" + payload.Filename
+		slot.Put.Headers = []uploadHeader{{Name: "Authorization", Value: "Basic secret"}}
+		slot.Get.Url = "https://upload.example.com/get/" + payload.Filename
+		result.Payload = slot
+	}
+
+	resultChannel := make(chan stanza.IQ, 1)
+	resultChannel <- result
+	return resultChannel, nil
+}
+
+// Connection to a fake server with an upload service. Sent packets are passed to sent.
+type fakeConnection struct {
+	fakeUploadServer
+	sent         chan stanza.Packet
+	disconnected int32
+}
+
+func (f *fakeConnection) Send(packet stanza.Packet) error {
+	f.sent <- packet
+	return nil
+}
+
+func (f *fakeConnection) SetHandler(handler xmpp.EventHandler) {}
+
+func (f *fakeConnection) Disconnect() error {
+	atomic.StoreInt32(&f.disconnected, 1)
+	return nil
+}
+
+// Waits for the next sent message
+func (f *fakeConnection) nextMessage(t *testing.T) stanza.Message {
+	t.Helper()
+	select {
+	case packet := <-f.sent:
+		return packet.(stanza.Message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a message to be sent")
+		return stanza.Message{}
+	}
+}
+
+/*
+ * Media is downloaded, uploaded to a slot of the discovered upload service and linked via the GET URL
+ */
+func TestHttpUpload(t *testing.T) {
+	var uploaded []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "video/mp4")
+			_, _ = w.Write([]byte("gif data"))
+		case http.MethodPut:
+			if r.Header.Get("Authorization") != "Basic secret" || r.Header.Get("Content-Type") != "video/mp4" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			uploaded, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	uploader := httpUploader{
+		Domain:     "example.com",
+		MaxSize:    1024,
+		HttpClient: &http.Client{Timeout: time.Second},
+	}
+
+	getUrl, err := uploader.upload(context.Background(), &fakeUploadServer{putUrl: server.URL + "/put"}, server.URL+"/media/giphy.mp4?cid=1")
+	if err != nil {
+		t.Fatalf("Upload failed: %s", err)
+	}
+	if getUrl != "https://upload.example.com/get/giphy.mp4" {
+		t.Errorf("Expected GET URL of the slot. Got \"%s\"", getUrl)
+	}
+	if string(uploaded) != "gif data" {
+		t.Errorf("Expected downloaded media to be uploaded. Got \"%s\"", uploaded)
+	}
+	if uploader.Service != "upload.example.com" {
+		t.Errorf("Expected upload service to be discovered. Got \"%s\"", uploader.Service)
+	}
+
+	// Too large files are not uploaded
+	uploader.MaxSize = 4
+	if _, err := uploader.upload(context.Background(), &fakeUploadServer{putUrl: server.URL + "/put"}, server.URL+"/media/giphy.mp4"); err == nil {
+		t.Error("Expected error for file larger than max_size")
+	}
+}
+
+/*
+ * Slot results of the server are decoded into uploadSlot
+ */
+func TestUploadSlotDecoding(t *testing.T) {
+	slotXml := `<iq type="result" id="1" from="upload.example.com"><slot xmlns="urn:xmpp:http:upload:0"><put url="https://upload.example.com/put/a.mp4"><header name="Authorization">Basic secret</header></put><get url="https://upload.example.com/get/a.mp4"/></slot></iq>`
+
+	var iq stanza.IQ
+	if err := xml.Unmarshal([]byte(slotXml), &iq); err != nil {
+		t.Fatalf("Could not decode IQ: %s", err)
+	}
+
+	slot, ok := iq.Payload.(*uploadSlot)
+	if !ok {
+		t.Fatalf("Expected upload slot payload. Got %T", iq.Payload)
+	}
+	if slot.Put.Url != "https://upload.example.com/put/a.mp4" || slot.Get.Url != "https://upload.example.com/get/a.mp4" {
+		t.Errorf("Unexpected slot URLs: %+v", slot)
+	}
+	if len(slot.Put.Headers) != 1 || slot.Put.Headers[0].Value != "Basic secret" {
+		t.Errorf("Expected Authorization header. Got %+v", slot.Put.Headers)
+	}
+}
+
+/*
+ * Text messages are not held up by GIF uploads and every GIF is only uploaded once
+ */
+func TestUploadInBackground(t *testing.T) {
+	var downloads int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&downloads, 1)
+			<-release
+			_, _ = w.Write([]byte("gif data"))
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	connection := &fakeConnection{fakeUploadServer: fakeUploadServer{putUrl: server.URL + "/put"}, sent: make(chan stanza.Packet, 10)}
+	x := XmppClient{
+		Recipients:            []string{"recipient@example.com"},
+		rooms:                 newMucRooms(nil),
+		HttpUpload:            &httpUploader{Domain: "example.com", MaxSize: 1024, HttpClient: &http.Client{Timeout: 5 * time.Second}},
+		XmppMessageOutChannel: make(chan interface{}, 10),
+	}
+	go x.sendLoop(connection)
+
+	x.XmppMessageOutChannel <- XmppGifMessage{Url: server.URL + "/giphy.mp4"}
+	x.XmppMessageOutChannel <- XmppGifMessage{Recipients: []string{"other@example.com"}, Url: server.URL + "/giphy.mp4"}
+	x.XmppMessageOutChannel <- XmppTextMessage{Text: "hello"}
+
+	if message := connection.nextMessage(t); message.Body != "hello" {
+		t.Errorf("Expected text message to be sent while the GIF is uploaded. Got %+v", message)
+	}
+
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if message := connection.nextMessage(t); message.Body != "https://upload.example.com/get/giphy.mp4" {
+			t.Errorf("Expected uploaded GIF. Got %+v", message)
+		}
+	}
+	if downloads := atomic.LoadInt32(&downloads); downloads != 1 {
+		t.Errorf("Expected GIF to be uploaded once. Got %d downloads", downloads)
+	}
+
+	if err := x.Stop(time.Second); err != nil {
+		t.Errorf("Could not stop: %s", err)
+	}
+}
+
+/*
+ * On shutdown, uploads which do not finish before the deadline are cancelled and their GIFs are linked
+ */
+func TestUploadCancelledOnShutdown(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	connection := &fakeConnection{fakeUploadServer: fakeUploadServer{putUrl: server.URL + "/put"}, sent: make(chan stanza.Packet, 10)}
+	x := XmppClient{
+		Recipients:            []string{"recipient@example.com"},
+		rooms:                 newMucRooms(nil),
+		HttpUpload:            &httpUploader{Domain: "example.com", MaxSize: 1024, HttpClient: &http.Client{Timeout: time.Minute}},
+		XmppMessageOutChannel: make(chan interface{}, 10),
+	}
+	go x.sendLoop(connection)
+
+	gifUrl := server.URL + "/giphy.mp4"
+	x.XmppMessageOutChannel <- XmppGifMessage{Url: gifUrl}
+
+	if err := x.Stop(1500 * time.Millisecond); err != nil {
+		t.Fatalf("Expected shutdown within the deadline. Got %s", err)
+	}
+
+	message := connection.nextMessage(t)
+	if len(message.Extensions) != 1 || message.Extensions[0].(stanza.OOB).URL != gifUrl {
+		t.Errorf("Expected linked GIF. Got %+v", message)
+	}
+	if atomic.LoadInt32(&connection.disconnected) != 1 {
+		t.Error("Expected connection to be closed")
+	}
+}
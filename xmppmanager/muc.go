@@ -0,0 +1,206 @@
+/*
+ * Multi-user chat (XEP-0045):
+ * Joins the configured rooms after every (re)connect, sends notifications to them
+ * as groupchat messages and passes commands of permitted occupants to the messenger.
+ */
+
+package xmppmanager
+
+import (
+	"encoding/xml"
+	"log"
+	"strings"
+	"sync"
+
+	"gosrc.io/xmpp/stanza"
+	"thomas-leister.de/plantmonitor/configmanager"
+)
+
+// MUC status codes (XEP-0045, section 15.6)
+const (
+	mucStatusSelfPresence = "110"
+	mucStatusKicked       = "307"
+)
+
+// Occupant information of presences in rooms (muc#user)
+type mucUser struct {
+	stanza.PresExtension
+	XMLName xml.Name `xml:"http://jabber.org/protocol/muc#user x"`
+	Items   []struct {
+		Jid string `xml:"jid,attr"`
+	} `xml:"item"`
+	Statuses []struct {
+		Code string `xml:"code,attr"`
+	} `xml:"status"`
+}
+
+func (u *mucUser) hasStatus(code string) bool {
+	for _, status := range u.Statuses {
+		if status.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Delayed delivery (XEP-0203): Marks room history sent after joining
+type delay struct {
+	stanza.MsgExtension
+	XMLName xml.Name `xml:"urn:xmpp:delay delay"`
+	Stamp   string   `xml:"stamp,attr"`
+}
+
+func init() {
+	stanza.TypeRegistry.MapExtension(stanza.PKTPresence, xml.Name{Space: "http://jabber.org/protocol/muc#user", Local: "x"}, mucUser{})
+	stanza.TypeRegistry.MapExtension(stanza.PKTMessage, xml.Name{Space: "urn:xmpp:delay", Local: "delay"}, delay{})
+}
+
+// Sends stanzas. Implemented by xmpp.Sender.
+type packetSender interface {
+	Send(packet stanza.Packet) error
+}
+
+type mucRoom struct {
+	configmanager.MucRoom
+
+	occupants map[string]string // Real bare JIDs by nickname, if the room discloses them
+	joined    bool
+}
+
+type mucRooms struct {
+	mutex sync.Mutex
+	rooms map[string]*mucRoom // Rooms by bare JID
+}
+
+func newMucRooms(configRooms []configmanager.MucRoom) *mucRooms {
+	r := &mucRooms{rooms: make(map[string]*mucRoom)}
+	for _, configRoom := range configRooms {
+		r.rooms[configRoom.Jid] = &mucRoom{MucRoom: configRoom, occupants: make(map[string]string)}
+	}
+	return r
+}
+
+// Whether jid is the bare JID of a configured room
+func (r *mucRooms) isRoom(jid string) bool {
+	_, exists := r.rooms[jid]
+	return exists
+}
+
+/*
+ * Joins all rooms. Needs to be done after every connect, because the room
+ * membership ends with the session. Room history is not requested.
+ */
+func (r *mucRooms) join(s packetSender) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, room := range r.rooms {
+		room.joined = false
+		room.occupants = make(map[string]string)
+
+		presence := stanza.NewPresence(stanza.Attrs{To: room.Jid + "/" + room.Nickname})
+		presence.Extensions = append(presence.Extensions, stanza.MucPresence{
+			Password: room.Password,
+			History:  stanza.History{MaxStanzas: stanza.NewNullableInt(0)},
+		})
+
+		log.Printf("XMPP: Joining room %s as %s\n", room.Jid, room.Nickname)
+		if err := s.Send(presence); err != nil {
+			log.Printf("ERROR: Could not join room %s: %s\n", room.Jid, err)
+		}
+	}
+}
+
+// Returns our own occupant JIDs (room/nickname) of all rooms
+func (r *mucRooms) occupantJids() []string {
+	var occupantJids []string
+	for _, room := range r.rooms {
+		occupantJids = append(occupantJids, room.Jid+"/"+room.Nickname)
+	}
+	return occupantJids
+}
+
+/*
+ * Tracks occupants of rooms and our own membership
+ */
+func (r *mucRooms) handlePresence(presence stanza.Presence) {
+	roomJid, nickname := splitJid(presence.From)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	room, exists := r.rooms[roomJid]
+	if !exists {
+		return
+	}
+
+	var user mucUser
+	hasUser := presence.Get(&user)
+	self := nickname == room.Nickname || (hasUser && user.hasStatus(mucStatusSelfPresence))
+
+	switch presence.Type {
+	case stanza.PresenceTypeError:
+		log.Printf("ERROR: Could not join room %s: %s %s\n", roomJid, presence.Error.Reason, presence.Error.Text)
+		room.joined = false
+	case stanza.PresenceTypeUnavailable:
+		delete(room.occupants, nickname)
+		if self {
+			room.joined = false
+			if hasUser && user.hasStatus(mucStatusKicked) {
+				log.Printf("XMPP: Kicked from room %s. Rejoining after the next reconnect.\n", roomJid)
+			} else {
+				log.Printf("XMPP: Left room %s\n", roomJid)
+			}
+		}
+	default:
+		realJid := ""
+		if hasUser && len(user.Items) > 0 {
+			realJid, _ = splitJid(user.Items[0].Jid)
+		}
+		room.occupants[nickname] = realJid
+		if self && !room.joined {
+			room.joined = true
+			log.Printf("XMPP: Joined room %s\n", roomJid)
+		}
+	}
+}
+
+/*
+ * Returns the room JID if a groupchat message is a command of a permitted occupant.
+ * Own messages, room history and messages of other occupants are ignored.
+ */
+func (r *mucRooms) commandSender(msg stanza.Message) (string, bool) {
+	roomJid, nickname := splitJid(msg.From)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	room, exists := r.rooms[roomJid]
+	if !exists || nickname == "" || nickname == room.Nickname {
+		return "", false
+	}
+
+	var delayed delay
+	if msg.Get(&delayed) {
+		return "", false
+	}
+
+	realJid := room.occupants[nickname]
+	for _, allowedSender := range room.AllowedSenders {
+		if allowedSender == nickname || (realJid != "" && allowedSender == realJid) {
+			return roomJid, true
+		}
+	}
+
+	log.Printf("XMPP: Ignoring message of %s in room %s: Not in allowed_senders\n", nickname, roomJid)
+	return "", false
+}
+
+// Splits a full JID into bare JID and resource (nickname in rooms)
+func splitJid(jid string) (string, string) {
+	parts := strings.SplitN(jid, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,118 @@
+package xmppmanager
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"gosrc.io/xmpp/stanza"
+	"thomas-leister.de/plantmonitor/configmanager"
+)
+
+// Records sent packets
+type fakeSender struct {
+	sent []stanza.Packet
+}
+
+func (f *fakeSender) Send(packet stanza.Packet) error {
+	f.sent = append(f.sent, packet)
+	return nil
+}
+
+func decodePresence(t *testing.T, presenceXml string) stanza.Presence {
+	var presence stanza.Presence
+	if err := xml.Unmarshal([]byte(presenceXml), &presence); err != nil {
+		t.Fatalf("Could not decode presence: %s", err)
+	}
+	return presence
+}
+
+func decodeMessage(t *testing.T, messageXml string) stanza.Message {
+	var message stanza.Message
+	if err := xml.Unmarshal([]byte(messageXml), &message); err != nil {
+		t.Fatalf("Could not decode message: %s", err)
+	}
+	return message
+}
+
+/*
+ * Rooms are joined, occupants are tracked and only commands of allowed occupants are accepted
+ */
+func TestMucRooms(t *testing.T) {
+	rooms := newMucRooms([]configmanager.MucRoom{{
+		Jid:            "plants@conference.example.com",
+		Nickname:       "Ficus",
+		Password:       "secret",
+		AllowedSenders: []string{"alice@example.com", "Bob"},
+	}})
+
+	sender := &fakeSender{}
+	rooms.join(sender)
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected one join presence. Got %d packets", len(sender.sent))
+	}
+	if presence := sender.sent[0].(stanza.Presence); presence.To != "plants@conference.example.com/Ficus" {
+		t.Errorf("Expected presence to room with nickname. Got %s", presence.To)
+	}
+
+	// Alice joins with a nickname, room discloses her real JID
+	rooms.handlePresence(decodePresence(t, `<presence from="plants@conference.example.com/Ali"><x xmlns="http://jabber.org/protocol/muc#user"><item jid="alice@example.com/phone" role="participant"/></x></presence>`))
+	rooms.handlePresence(decodePresence(t, `<presence from="plants@conference.example.com/Ficus"><x xmlns="http://jabber.org/protocol/muc#user"><item role="participant"/><status code="110"/></x></presence>`))
+	if !rooms.rooms["plants@conference.example.com"].joined {
+		t.Error("Expected room to be joined after self-presence")
+	}
+
+	tests := []struct {
+		description string
+		messageXml  string
+		permitted   bool
+	}{
+		{"allowed by real JID", `<message type="groupchat" from="plants@conference.example.com/Ali"><body>status</body></message>`, true},
+		{"allowed by nickname", `<message type="groupchat" from="plants@conference.example.com/Bob"><body>status</body></message>`, true},
+		{"not allowed", `<message type="groupchat" from="plants@conference.example.com/Eve"><body>status</body></message>`, false},
+		{"own message", `<message type="groupchat" from="plants@conference.example.com/Ficus"><body>status</body></message>`, false},
+		{"room history", `<message type="groupchat" from="plants@conference.example.com/Bob"><body>status</body><delay xmlns="urn:xmpp:delay" stamp="2021-11-01T12:00:00Z"/></message>`, false},
+	}
+	for _, test := range tests {
+		roomJid, permitted := rooms.commandSender(decodeMessage(t, test.messageXml))
+		if permitted != test.permitted {
+			t.Errorf("%s: Expected permitted = %v", test.description, test.permitted)
+		}
+		if permitted && roomJid != "plants@conference.example.com" {
+			t.Errorf("Expected answers to go to the room. Got %s", roomJid)
+		}
+	}
+
+	// Alice leaves: Her nickname alone is not allowed
+	rooms.handlePresence(decodePresence(t, `<presence type="unavailable" from="plants@conference.example.com/Ali"/>`))
+	if _, permitted := rooms.commandSender(decodeMessage(t, `<message type="groupchat" from="plants@conference.example.com/Ali"><body>status</body></message>`)); permitted {
+		t.Error("Expected message of unknown occupant to be ignored")
+	}
+}
+
+/*
+ * Messages to rooms are groupchat messages, messages to users in the same list are chat messages
+ */
+func TestSendMessageToRoomsAndUsers(t *testing.T) {
+	x := XmppClient{rooms: newMucRooms([]configmanager.MucRoom{{Jid: "plants@conference.example.com", Nickname: "Ficus"}})}
+
+	sender := &fakeSender{}
+	x.sendMessage(sender, preparedMessage{
+		Recipients: []string{"alice@example.com", "plants@conference.example.com", "bob@example.com"},
+		Stanza:     stanza.Message{Body: "Water me!"},
+	})
+
+	expectedTypes := map[string]stanza.StanzaType{
+		"alice@example.com":             stanza.MessageTypeChat,
+		"plants@conference.example.com": stanza.MessageTypeGroupchat,
+		"bob@example.com":               stanza.MessageTypeChat,
+	}
+	if len(sender.sent) != len(expectedTypes) {
+		t.Fatalf("Expected %d messages. Got %d", len(expectedTypes), len(sender.sent))
+	}
+	for _, packet := range sender.sent {
+		message := packet.(stanza.Message)
+		if message.Type != expectedTypes[message.To] || message.Body != "Water me!" {
+			t.Errorf("%s: Expected %s message. Got %s \"%s\"", message.To, expectedTypes[message.To], message.Type, message.Body)
+		}
+	}
+}
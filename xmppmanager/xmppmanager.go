@@ -8,10 +8,14 @@
 package xmppmanager
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	"gosrc.io/xmpp"
 	"gosrc.io/xmpp/stanza"
@@ -28,6 +32,40 @@ type XmppGifMessage struct {
 	Url        string
 }
 
+/*
+ * Presence of plantmonitor, shown in the contacts' rosters and in rooms
+ */
+type XmppPresence struct {
+	Show   string // "" (available), "away", "dnd" or "xa"
+	Status string
+}
+
+/*
+ * Disconnects from the XMPP server after all messages queued before have been sent.
+ * Done is closed afterwards. Uploads which are still running at Deadline are cancelled.
+ */
+type disconnectRequest struct {
+	Done     chan struct{}
+	Deadline time.Time
+}
+
+// Message stanza which is ready to be sent, e.g. after its GIF has been uploaded
+type preparedMessage struct {
+	Recipients []string
+	Stanza     stanza.Message
+}
+
+// Connection to the XMPP server used for sending. Implemented by xmpp.Client.
+type xmppConnection interface {
+	packetSender
+	iqSender
+	SetHandler(handler xmpp.EventHandler)
+	Disconnect() error
+}
+
+// Time left for sending GIFs whose upload has been cancelled on shutdown
+const uploadCancelMargin = time.Second
+
 // General incoming XMPP message
 type XmppInMessage struct {
 	From string
@@ -42,6 +80,18 @@ type XmppClient struct {
 	Recipients            []string
 	XmppMessageOutChannel chan interface{}
 	XmppMessageInChannel  chan XmppInMessage
+
+	rooms *mucRooms // Joined group chats
+
+	presenceMutex sync.Mutex
+	presence      *XmppPresence // Current presence, sent again after reconnects. nil = initial presence.
+
+	HttpUpload *httpUploader // Uploads GIFs to the XMPP server before sending them. nil = GIFs are linked.
+
+	OnSessionEstablished func(reconnect bool) // Called after (re)connecting to the XMPP server. Optional.
+	sessions             int                  // Number of established sessions
+
+	ctx context.Context // Incoming messages are dropped when done
 }
 
 func (x *XmppClient) HandleXmppMessage(s xmpp.Sender, p stanza.Packet) {
@@ -53,9 +103,36 @@ func (x *XmppClient) HandleXmppMessage(s xmpp.Sender, p stanza.Packet) {
 
 	inMsg := XmppInMessage{From: msg.From, Body: msg.Body}
 
+	// Group chats: Only commands of permitted occupants. Answers go to the room.
+	if roomJid, _ := splitJid(msg.From); x.rooms.isRoom(roomJid) {
+		if msg.Type == stanza.MessageTypeError {
+			log.Printf("XMPP: Room %s returned an error: %s %s\n", roomJid, msg.Error.Reason, msg.Error.Text)
+			return
+		}
+		if msg.Type != stanza.MessageTypeGroupchat {
+			log.Printf("XMPP: Ignoring private message from room occupant %s\n", msg.From)
+			return
+		}
+		sender, permitted := x.rooms.commandSender(msg)
+		if !permitted {
+			return
+		}
+		inMsg.From = sender
+	}
+
 	// Just feed messages with Body into messenger responder. Not "typing" notifications etc.
 	if msg.Body != "" {
-		x.XmppMessageInChannel <- inMsg
+		select {
+		case x.XmppMessageInChannel <- inMsg:
+		case <-x.ctx.Done():
+			log.Println("XMPP: Shutting down. Dropping received message.")
+		}
+	}
+}
+
+func (x *XmppClient) HandleXmppPresence(s xmpp.Sender, p stanza.Packet) {
+	if presence, ok := p.(stanza.Presence); ok {
+		x.rooms.handlePresence(presence)
 	}
 }
 
@@ -70,12 +147,38 @@ func (x *XmppClient) Init(config *configmanager.Config) error {
 	x.Port = config.Xmpp.Port
 	x.Username = config.Xmpp.Username
 	x.Password = config.Xmpp.Password
-	x.Recipients = config.Xmpp.Recipients
+	x.Recipients = append(append([]string{}, config.Xmpp.Recipients...), config.RoomJids()...)
+	x.rooms = newMucRooms(config.Xmpp.Rooms)
+
+	if config.Xmpp.HttpUpload.Enabled {
+		jid, err := stanza.NewJid(x.Username)
+		if err != nil {
+			return err
+		}
+
+		maxSize := config.Xmpp.HttpUpload.MaxSize
+		if maxSize <= 0 {
+			maxSize = 10 * 1024 * 1024
+		}
+
+		x.HttpUpload = &httpUploader{
+			Service:    config.Xmpp.HttpUpload.Service,
+			Domain:     jid.Domain,
+			MaxSize:    maxSize,
+			HttpClient: &http.Client{Timeout: 30 * time.Second},
+		}
+	}
 
 	return nil
 }
 
-func (x *XmppClient) RunXMPPClient(xmppMessageOutChannel chan interface{}, xmppMessageInChannel chan XmppInMessage) {
+/*
+ * Connects to the XMPP server and starts sending messages from xmppMessageOutChannel.
+ * Incoming messages are sent to xmppMessageInChannel until ctx is done.
+ * Sending goes on until Stop() is called.
+ */
+func (x *XmppClient) Start(ctx context.Context, xmppMessageOutChannel chan interface{}, xmppMessageInChannel chan XmppInMessage) error {
+	x.ctx = ctx
 	x.XmppMessageOutChannel = xmppMessageOutChannel
 	x.XmppMessageInChannel = xmppMessageInChannel
 
@@ -91,65 +194,224 @@ func (x *XmppClient) RunXMPPClient(xmppMessageOutChannel chan interface{}, xmppM
 
 	router := xmpp.NewRouter()
 	router.HandleFunc("message", x.HandleXmppMessage)
+	router.HandleFunc("presence", x.HandleXmppPresence)
 
 	client, err := xmpp.NewClient(&xmppClientConfig, router, x.XmppErrorHandler)
 	if err != nil {
-		log.Fatalf("%+v", err)
+		return err
 	}
 
 	// If you pass the client to a connection manager, it will handle the reconnect policy
 	// for you automatically.
-	cm := xmpp.NewStreamManager(client, nil)
+	cm := xmpp.NewStreamManager(client, x.postConnect)
 	go cm.Run()
 
-	// Wait for a new message to send (listen on channel)
-	for xmppMessage := range xmppMessageOutChannel {
-		xmppMessageStanza := stanza.Message{}
-		var recipients []string
+	go x.sendLoop(client)
+
+	return nil
+}
+
+/*
+ * Sends all messages which have been queued in the out channel before and disconnects.
+ * Gives up after timeout.
+ */
+func (x *XmppClient) Stop(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	done := make(chan struct{})
+
+	select {
+	case x.XmppMessageOutChannel <- disconnectRequest{Done: done, Deadline: time.Now().Add(timeout)}:
+	case <-deadline:
+		return fmt.Errorf("timeout: out channel is full")
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-deadline:
+		return fmt.Errorf("timeout: pending messages could not be sent")
+	}
+}
+
+/*
+ * Sends messages from the out channel until a disconnect is requested.
+ * GIFs are uploaded in the background (if HTTP upload is enabled), so that other
+ * messages do not wait for the upload.
+ */
+func (x *XmppClient) sendLoop(client xmppConnection) {
+	uploadCtx, cancelUploads := context.WithCancel(context.Background())
+	defer cancelUploads()
+
+	uploaded := make(chan preparedMessage)
+	pendingUploads := 0
+
+	for {
+		var xmppMessage interface{}
+		select {
+		case message := <-uploaded:
+			pendingUploads--
+			x.sendMessage(client, message)
+			continue
+		case xmppMessage = <-x.XmppMessageOutChannel:
+		}
 
 		// Find out stanza type (TextMessage or GifMessage)
-		switch xmppMessage.(type) {
+		switch m := xmppMessage.(type) {
 		case XmppTextMessage:
 			log.Println("XMPP: Sending a text message")
-			m := xmppMessage.(XmppTextMessage)
+			x.sendMessage(client, preparedMessage{
+				Recipients: m.Recipients,
+				Stanza:     stanza.Message{Body: m.Text},
+			})
 
-			recipients = m.Recipients
-			xmppMessageStanza = stanza.Message{
-				Body: string(m.Text),
+		case XmppGifMessage:
+			if x.HttpUpload == nil {
+				log.Println("XMPP: Sending a GIF message")
+				x.sendMessage(client, preparedMessage{Recipients: m.Recipients, Stanza: linkedGifStanza(m.Url)})
+				continue
 			}
 
-		case XmppGifMessage:
-			log.Println("XMPP: Sending a GIF message")
-			m := xmppMessage.(XmppGifMessage)
-
-			recipients = m.Recipients
-			xmppMessageStanza = stanza.Message{
-				Extensions: []stanza.MsgExtension{
-					stanza.OOB{
-						URL:  string(m.Url),
-						Desc: "GIF with meme",
-					},
-				},
+			log.Println("XMPP: Uploading a GIF")
+			pendingUploads++
+			go func() {
+				uploaded <- preparedMessage{Recipients: m.Recipients, Stanza: x.uploadedGifStanza(uploadCtx, client, m.Url)}
+			}()
+
+		case XmppPresence:
+			log.Printf("XMPP: Setting presence to '%s' (%s)\n", m.Show, m.Status)
+
+			x.presenceMutex.Lock()
+			x.presence = &m
+			x.presenceMutex.Unlock()
+
+			x.sendPresence(client, m)
+
+		case disconnectRequest:
+			// Send GIFs which are being uploaded. Uploads still running shortly before the deadline are cancelled and their GIFs are linked.
+			if pendingUploads > 0 {
+				log.Printf("XMPP: Waiting for %d GIF upload(s)\n", pendingUploads)
+				timer := time.AfterFunc(time.Until(m.Deadline)-uploadCancelMargin, cancelUploads)
+				for ; pendingUploads > 0; pendingUploads-- {
+					x.sendMessage(client, <-uploaded)
+				}
+				timer.Stop()
+			}
+
+			log.Println("XMPP: Disconnecting")
+
+			// Do not reconnect
+			client.SetHandler(nil)
+			if err := client.Disconnect(); err != nil {
+				log.Println("ERROR: Could not disconnect:", err)
 			}
+			close(m.Done)
+			return
 
 		default:
 			log.Println("ERROR: Type of message to send is unknown. Send one of XmppTextMessage or XmppGifMessage!")
-			continue // Quit this for() round
 		}
+	}
+}
 
-		// If recipients are undefined, broadcast to all users
-		if len(recipients) == 0 {
-			recipients = x.Recipients
+/*
+ * Sends a message stanza to its recipients
+ */
+func (x *XmppClient) sendMessage(client packetSender, message preparedMessage) {
+	// If recipients are undefined, broadcast to all users
+	recipients := message.Recipients
+	if len(recipients) == 0 {
+		recipients = x.Recipients
+	}
+
+	// For each recipient: Set recipient in stanza and send message
+	xmppMessageStanza := message.Stanza
+	for _, recipient := range recipients {
+		messageType := stanza.MessageTypeChat
+		if x.rooms.isRoom(recipient) {
+			messageType = stanza.MessageTypeGroupchat
 		}
+		xmppMessageStanza.Attrs = stanza.Attrs{To: recipient, Type: messageType}
 
-		// For each recipient: Set recipient in stanza and send message
-		for _, recipient := range recipients {
-			xmppMessageStanza.Attrs = stanza.Attrs{To: recipient}
+		err := client.Send(xmppMessageStanza)
+		if err != nil {
+			log.Println("ERROR: Could not send stanza to: ", err)
+		}
+	}
+}
 
-			err := client.Send(xmppMessageStanza)
-			if err != nil {
-				log.Println("ERROR: Could not send stanza to: ", err)
-			}
+/*
+ * Uploads the GIF to the XMPP server and returns a message stanza with its new URL as body and OOB,
+ * so that all clients show it. If the upload fails, the original URL is linked.
+ */
+func (x *XmppClient) uploadedGifStanza(ctx context.Context, client iqSender, gifUrl string) stanza.Message {
+	uploadedUrl, err := x.HttpUpload.uploadCached(ctx, client, gifUrl)
+	if err != nil {
+		log.Println("XMPP: HTTP upload failed. Linking GIF instead:", err)
+		return linkedGifStanza(gifUrl)
+	}
+
+	return stanza.Message{
+		Body: uploadedUrl,
+		Extensions: []stanza.MsgExtension{
+			stanza.OOB{URL: uploadedUrl},
+		},
+	}
+}
+
+/*
+ * Returns a message stanza which links the GIF via OOB
+ */
+func linkedGifStanza(gifUrl string) stanza.Message {
+	return stanza.Message{
+		Extensions: []stanza.MsgExtension{
+			stanza.OOB{
+				URL:  gifUrl,
+				Desc: "GIF with meme",
+			},
+		},
+	}
+}
+
+/*
+ * Broadcasts presence to contacts and sends it to all rooms
+ */
+func (x *XmppClient) sendPresence(s packetSender, presence XmppPresence) {
+	presenceStanza := stanza.NewPresence(stanza.Attrs{})
+	presenceStanza.Show = stanza.PresenceShow(presence.Show)
+	presenceStanza.Status = presence.Status
+
+	if err := s.Send(presenceStanza); err != nil {
+		log.Println("ERROR: Could not send presence:", err)
+	}
+
+	for _, occupantJid := range x.rooms.occupantJids() {
+		presenceStanza.Attrs = stanza.Attrs{To: occupantJid}
+		if err := s.Send(presenceStanza); err != nil {
+			log.Println("ERROR: Could not send presence to room:", err)
 		}
 	}
 }
+
+/*
+ * Is called by the stream manager after the session has been established
+ */
+func (x *XmppClient) postConnect(s xmpp.Sender) {
+	x.sessions++
+	log.Printf("XMPP: Session established (%d. session)\n", x.sessions)
+
+	// Room membership ends with the session: (Re)join rooms
+	x.rooms.join(s)
+
+	// Presence is reset to "available" on connect
+	x.presenceMutex.Lock()
+	presence := x.presence
+	x.presenceMutex.Unlock()
+	if presence != nil {
+		x.sendPresence(s, *presence)
+	}
+
+	// Do not block the stream manager: The callback might send messages, which are sent by sendLoop().
+	if x.OnSessionEstablished != nil {
+		go x.OnSessionEstablished(x.sessions > 1)
+	}
+}
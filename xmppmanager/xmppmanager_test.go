@@ -0,0 +1,86 @@
+package xmppmanager
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+/*
+ * Stop sends all messages queued before and disconnects afterwards
+ */
+func TestStopSendsQueuedMessages(t *testing.T) {
+	connection := &fakeConnection{sent: make(chan stanza.Packet, 10)}
+	x := XmppClient{
+		Recipients:            []string{"recipient@example.com"},
+		rooms:                 newMucRooms(nil),
+		XmppMessageOutChannel: make(chan interface{}, 10),
+	}
+
+	for _, text := range []string{"first", "second", "third"} {
+		x.XmppMessageOutChannel <- XmppTextMessage{Text: text}
+	}
+	go x.sendLoop(connection)
+
+	if err := x.Stop(time.Second); err != nil {
+		t.Fatalf("Could not stop: %s", err)
+	}
+	if atomic.LoadInt32(&connection.disconnected) != 1 {
+		t.Error("Expected connection to be closed")
+	}
+	if len(connection.sent) != 3 {
+		t.Fatalf("Expected 3 messages to be sent before disconnecting. Got %d", len(connection.sent))
+	}
+	for _, text := range []string{"first", "second", "third"} {
+		if message := connection.nextMessage(t); message.Body != text {
+			t.Errorf("Expected message \"%s\". Got \"%s\"", text, message.Body)
+		}
+	}
+}
+
+/*
+ * Stop gives up if the send loop does not take the disconnect request
+ */
+func TestStopTimeout(t *testing.T) {
+	x := XmppClient{XmppMessageOutChannel: make(chan interface{})} // No send loop running
+
+	if err := x.Stop(10 * time.Millisecond); err == nil {
+		t.Error("Expected timeout")
+	}
+}
+
+/*
+ * Incoming messages are forwarded until the context is done and dropped afterwards
+ */
+func TestHandleXmppMessageAfterShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	x := XmppClient{
+		rooms:                newMucRooms(nil),
+		XmppMessageInChannel: make(chan XmppInMessage, 1),
+		ctx:                  ctx,
+	}
+	message := stanza.Message{Attrs: stanza.Attrs{From: "recipient@example.com/phone"}, Body: "status"}
+
+	x.HandleXmppMessage(nil, message)
+	if received := <-x.XmppMessageInChannel; received.From != "recipient@example.com/phone" || received.Body != "status" {
+		t.Errorf("Unexpected incoming message %+v", received)
+	}
+
+	// Nobody receives anymore after shutdown
+	cancel()
+	x.XmppMessageInChannel = make(chan XmppInMessage)
+	done := make(chan struct{})
+	go func() {
+		x.HandleXmppMessage(nil, message)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected incoming message to be dropped after shutdown")
+	}
+}